@@ -15,8 +15,8 @@ func TestWrongFingerprint(t *testing.T) {
 	// create an unknown client
 	client, certificate, err := NewClient(false)
 	require.Nil(t, err, "Failed to create a new client %v", err)
-	peer, err := peers.NewPeer(&peers.Conf{Logger: Logger,
-		Certificate: certificate})
+	peer, err := peers.NewServer(&peers.Conf{Logger: Logger,
+		Certificate: certificate}).NewPeer("")
 	require.NoError(t, err, "NewPeer failed with: %s", err)
 	require.NotNil(t, peer, "NewPeer returned nil")
 	dc, err := client.CreateDataChannel("echo,Failed", nil)
@@ -28,7 +28,7 @@ func TestWrongFingerprint(t *testing.T) {
 	case <-failed:
 		t.Error("Data channel is opened even though no authentication")
 	}
-	// peers.Shutdown()
+	// server.Shutdown()
 }
 */
 
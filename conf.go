@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/kardianos/osext"
 	"github.com/pelletier/go-toml"
 	"github.com/pion/webrtc/v3"
 	"github.com/tuzig/webexec/httpserver"
@@ -38,6 +39,28 @@ failed = 6000
 keep_alive = 500
 ice_gathering = 5000
 peerbook = 3000
+exited_pane = 60000
+stale_peer = 30000
+[keeper]
+# keep panes running when the agent restarts
+enabled = false
+[scrollback]
+# bytes of output each pane keeps in memory
+size = 100000
+# spill older output to compressed files on disk
+spill = false
+[output]
+# msec to collect a burst of output into one message, 0 to turn off
+coalesce = 5
+max_message = 16384
+[panes]
+# allow clients to launch only the profiles
+profiles_only = false
+# a profile clients launch with add_pane {"profile": "dev"}
+# [[profiles]]
+# name = "dev"
+# command = [ "*" ]
+# cwd = "~/src"
 [[ice_servers]]
 urls = [ "stun:stun.l.google.com:19302" ]
 [env]
@@ -57,6 +80,17 @@ type ICEServer struct {
 	Password string   `toml:"password,omitempty"`
 }
 
+// Profile is a command profile in the conf file
+type Profile struct {
+	Name       string            `toml:"name"`
+	Command    []string          `toml:"command"`
+	Cwd        string            `toml:"cwd,omitempty"`
+	Env        map[string]string `toml:"env,omitempty"`
+	Term       string            `toml:"term,omitempty"`
+	Scrollback int               `toml:"scrollback,omitempty"`
+	PreLaunch  string            `toml:"pre_launch,omitempty"`
+}
+
 // Conf hold the configuration variables
 var Conf struct {
 	logFilePath     string
@@ -131,6 +165,18 @@ func parseConf(s string) (*peers.Conf, httpserver.AddressType, error) {
 	} else {
 		peersConf.GatheringTimeout = 3 * time.Second
 	}
+	v = t.Get("timeouts.exited_pane")
+	if v != nil {
+		peersConf.ExitedPaneTimeout = time.Duration(v.(int64)) * time.Millisecond
+	} else {
+		peersConf.ExitedPaneTimeout = peers.DefaultExitedPaneTimeout
+	}
+	v = t.Get("timeouts.stale_peer")
+	if v != nil {
+		peersConf.StalePeerTimeout = time.Duration(v.(int64)) * time.Millisecond
+	} else {
+		peersConf.StalePeerTimeout = peers.DefaultStalePeerTimeout
+	}
 	v = t.Get("ice_servers")
 	if v != nil {
 		Conf.iceServers = []webrtc.ICEServer{}
@@ -176,6 +222,77 @@ func parseConf(s string) (*peers.Conf, httpserver.AddressType, error) {
 	if v != nil {
 		Conf.insecure = v.(bool)
 	}
+	v = t.Get("keeper.enabled")
+	if v != nil && v.(bool) {
+		peersConf.KeeperDir = RunPath("keepers")
+	}
+	v = t.Get("scrollback.size")
+	if v != nil {
+		peersConf.ScrollbackSize = int(v.(int64))
+	} else {
+		peersConf.ScrollbackSize = peers.DefaultScrollbackSize
+	}
+	v = t.Get("scrollback.spill")
+	if v != nil && v.(bool) {
+		peersConf.SpillDir = RunPath("scrollback")
+		v = t.Get("scrollback.spill_max")
+		if v != nil {
+			peersConf.SpillMax = v.(int64)
+		} else {
+			peersConf.SpillMax = peers.DefaultSpillMax
+		}
+	}
+	v = t.Get("output.coalesce")
+	if v != nil {
+		peersConf.CoalesceWindow = time.Duration(v.(int64)) * time.Millisecond
+		if peersConf.CoalesceWindow == 0 {
+			// 0 turns coalescing off
+			peersConf.CoalesceWindow = -1
+		}
+	} else {
+		peersConf.CoalesceWindow = peers.DefaultCoalesceWindow
+	}
+	v = t.Get("output.max_message")
+	if v != nil {
+		peersConf.MaxMessageSize = int(v.(int64))
+	} else {
+		peersConf.MaxMessageSize = peers.DefaultMaxMessageSize
+	}
+	v = t.Get("profiles")
+	if v != nil {
+		trees, ok := v.([]*toml.Tree)
+		if !ok {
+			return nil, "", fmt.Errorf("profiles should be an array of tables")
+		}
+		for _, tree := range trees {
+			var p Profile
+			err := tree.Unmarshal(&p)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to parse profile: %s", err)
+			}
+			if p.Name == "" || len(p.Command) == 0 {
+				return nil, "", fmt.Errorf("a profile needs a name & a command")
+			}
+			for _, o := range peersConf.Profiles {
+				if o.Name == p.Name {
+					return nil, "", fmt.Errorf("profile %q is defined twice", p.Name)
+				}
+			}
+			peersConf.Profiles = append(peersConf.Profiles, peers.Profile{
+				Name:           p.Name,
+				Command:        p.Command,
+				Cwd:            p.Cwd,
+				Env:            p.Env,
+				Term:           p.Term,
+				ScrollbackSize: p.Scrollback,
+				PreLaunch:      p.PreLaunch,
+			})
+		}
+	}
+	v = t.Get("panes.profiles_only")
+	if v != nil {
+		peersConf.ProfilesOnly = v.(bool)
+	}
 	// get env vars
 	m := t.Get("env")
 	if m != nil {
@@ -204,6 +321,7 @@ func parseConf(s string) (*peers.Conf, httpserver.AddressType, error) {
 			}
 		}
 	}
+	peersConf.Version = version
 	Conf.peerConf = peersConf
 	return peersConf, addr, nil
 }
@@ -240,6 +358,14 @@ func LoadConf(certs []webrtc.Certificate) (*peers.Conf, httpserver.AddressType,
 	conf.Certificate = &certs[0]
 	conf.Logger = Logger
 	conf.GetICEServers = GetICEServers
+	conf.GetPolicy = NewFilePolicy("").Get
+	if conf.KeeperDir != "" {
+		execPath, err := osext.Executable()
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to find the executable: %s", err)
+		}
+		conf.KeeperCommand = []string{execPath, "keeper"}
+	}
 
 	return conf, addr, err
 }
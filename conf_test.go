@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tuzig/webexec/peers"
 )
 
 func TestConfEnv(t *testing.T) {
@@ -12,3 +13,74 @@ func TestConfEnv(t *testing.T) {
 	require.EqualValues(t, Conf.peerConf.Env["TERM"], "xterm")
 	require.EqualValues(t, Conf.peerConf.Env["COLORTERM"], "truecolor")
 }
+
+func TestConfScrollback(t *testing.T) {
+	conf, _, err := parseConf(`[scrollback]
+size = 2000
+spill = true
+`)
+	require.NoError(t, err)
+	require.Equal(t, 2000, conf.ScrollbackSize)
+	require.Equal(t, RunPath("scrollback"), conf.SpillDir)
+	require.EqualValues(t, peers.DefaultSpillMax, conf.SpillMax)
+}
+
+func TestConfOutput(t *testing.T) {
+	conf, _, err := parseConf(`[output]
+coalesce = 0
+`)
+	require.NoError(t, err)
+	require.Negative(t, int64(conf.CoalesceWindow))
+	require.Equal(t, peers.DefaultMaxMessageSize, conf.MaxMessageSize)
+	conf, _, err = parseConf("")
+	require.NoError(t, err)
+	require.Equal(t, peers.DefaultCoalesceWindow, conf.CoalesceWindow)
+}
+
+func TestConfProfiles(t *testing.T) {
+	conf, _, err := parseConf(`[panes]
+profiles_only = true
+[[profiles]]
+name = "dev"
+command = [ "zsh", "-l" ]
+cwd = "~/src"
+term = "xterm-256color"
+scrollback = 500000
+pre_launch = "git pull"
+[profiles.env]
+EDITOR = "vim"
+[[profiles]]
+name = "top"
+command = [ "htop" ]
+`)
+	require.NoError(t, err)
+	require.True(t, conf.ProfilesOnly)
+	require.Equal(t, []peers.Profile{{
+		Name:           "dev",
+		Command:        []string{"zsh", "-l"},
+		Cwd:            "~/src",
+		Env:            map[string]string{"EDITOR": "vim"},
+		Term:           "xterm-256color",
+		ScrollbackSize: 500000,
+		PreLaunch:      "git pull",
+	}, {
+		Name:    "top",
+		Command: []string{"htop"},
+	}}, conf.Profiles)
+	_, _, err = parseConf(`[[profiles]]
+name = "dev"
+command = [ "zsh" ]
+[[profiles]]
+name = "dev"
+command = [ "bash" ]
+`)
+	require.Error(t, err)
+	_, _, err = parseConf(`[[profiles]]
+name = "nocommand"
+`)
+	require.Error(t, err)
+	conf, _, err = parseConf(defaultConf)
+	require.NoError(t, err)
+	require.False(t, conf.ProfilesOnly)
+	require.Empty(t, conf.Profiles)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/rs/cors"
@@ -22,8 +23,11 @@ type AuthBackend interface {
 }
 type ConnectHandler struct {
 	authBackend AuthBackend
-	peerConf    *peers.Conf
+	server      *peers.Server
 	logger      *zap.SugaredLogger
+	// sessions holds the trickle ICE sessions by id
+	sessions  map[string]*iceSession
+	sessionsM sync.Mutex
 }
 
 // ConnectRequest is the schema for the connect POST request
@@ -34,12 +38,13 @@ type ConnectRequest struct {
 }
 
 func NewConnectHandler(
-	backend AuthBackend, conf *peers.Conf, logger *zap.SugaredLogger) *ConnectHandler {
+	backend AuthBackend, server *peers.Server, logger *zap.SugaredLogger) *ConnectHandler {
 
 	return &ConnectHandler{
 		authBackend: backend,
-		peerConf:    conf,
+		server:      server,
 		logger:      logger,
+		sessions:    make(map[string]*iceSession),
 	}
 }
 
@@ -48,8 +53,9 @@ func NewConnectHandler(
 func StartHTTPServer(lc fx.Lifecycle, address AddressType,
 	c *ConnectHandler, logger *zap.SugaredLogger) *http.Server {
 
-	c.peerConf.Logger = logger
+	c.server.Conf.Logger = logger
 	http.HandleFunc("/connect", c.HandleConnect)
+	http.HandleFunc("/candidates/", c.HandleCandidates)
 	h := cors.Default().Handler(http.DefaultServeMux)
 	server := &http.Server{Addr: string(address), Handler: h}
 	lc.Append(fx.Hook{
@@ -59,7 +65,7 @@ func StartHTTPServer(lc fx.Lifecycle, address AddressType,
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
-			// peers.Shutdown()
+			// c.server.Shutdown()
 			logger.Info("Stopping HTTP server")
 			return server.Shutdown(ctx)
 		},
@@ -112,11 +118,17 @@ func (h *ConnectHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	peer, err := peers.NewPeer(fp, h.peerConf)
+	peer, err := h.server.NewPeer(fp)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create a new peer: %s", err), http.StatusInternalServerError)
 		return
 	}
+	// the token selects the peer's policy
+	peer.Token = bearer
+	if req.APIVer >= TrickleAPIVersion {
+		h.answerTrickle(w, peer, offer)
+		return
+	}
 	answer, err := peer.Listen(offer)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Peer failed to listen : %s", err), http.StatusInternalServerError)
@@ -140,6 +152,11 @@ func parsePeerReq(message io.Reader, cr *ConnectRequest,
 	if err != nil {
 		return fmt.Errorf("Failed to read connection request: %w", err)
 	}
+	// requests with no version are from version 1 clients
+	if cr.APIVer < 0 || cr.APIVer > peers.APIVersion {
+		return fmt.Errorf("Unsupported API version %d, webexec supports versions %d to %d",
+			cr.APIVer, peers.MinAPIVersion, peers.APIVersion)
+	}
 	err = peers.DecodeOffer(offer, []byte(cr.Offer))
 	if err != nil {
 		return fmt.Errorf("Failed to decode client's offer: %w", err)
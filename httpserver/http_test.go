@@ -146,7 +146,7 @@ func TestConnectGoodFP(t *testing.T) {
 		}
 		h := &ConnectHandler{
 			authBackend: a,
-			peerConf:    conf,
+			server:      peers.NewServer(conf),
 			logger:      logger,
 		}
 		h.HandleConnect(w, req)
@@ -214,7 +214,7 @@ func TestConnectBadFP(t *testing.T) {
 				return nil, nil
 			},
 		}
-		h := NewConnectHandler(a, conf, logger)
+		h := NewConnectHandler(a, peers.NewServer(conf), logger)
 		h.HandleConnect(w, req)
 		require.Equal(t, http.StatusUnauthorized, w.Code)
 	}
@@ -261,7 +261,7 @@ func TestConnectWithBearer(t *testing.T) {
 				return nil, nil
 			},
 		}
-		h := NewConnectHandler(a, conf, logger)
+		h := NewConnectHandler(a, peers.NewServer(conf), logger)
 		h.HandleConnect(w, req)
 		require.Equal(t, http.StatusOK, w.Code)
 	}
@@ -309,7 +309,7 @@ func TestConnectWithBadBearer(t *testing.T) {
 				return nil, nil
 			},
 		}
-		h := NewConnectHandler(a, conf, logger)
+		h := NewConnectHandler(a, peers.NewServer(conf), logger)
 		h.HandleConnect(w, req)
 		require.Equal(t, http.StatusUnauthorized, w.Code)
 	}
@@ -325,3 +325,43 @@ func TestEncodeDecodeStringArray(t *testing.T) {
 	require.Nil(t, err, "Failed to decode offer: %s", err)
 	require.Equal(t, a, c)
 }
+
+func TestConnectUnsupportedVersion(t *testing.T) {
+	b, err := json.Marshal(ConnectRequest{"BADWOLF", peers.APIVersion + 1, ""})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/connect", bytes.NewBuffer(b))
+	w := httptest.NewRecorder()
+	logger := zaptest.NewLogger(t).Sugar()
+	h := NewConnectHandler(&MockAuthBackend{},
+		peers.NewServer(&peers.Conf{Logger: logger}), logger)
+	h.HandleConnect(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "Unsupported API version")
+}
+
+func TestCandidatesPoll(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	h := NewConnectHandler(&MockAuthBackend{},
+		peers.NewServer(&peers.Conf{Logger: logger}), logger)
+	s := newICESession(nil)
+	h.addSession("BADWOLF", s)
+	w := httptest.NewRecorder()
+	h.HandleCandidates(w, httptest.NewRequest(http.MethodGet, "/candidates/nope", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	// the GET should wait for the candidate
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.onCandidate(&webrtc.ICECandidate{})
+	}()
+	w = httptest.NewRecorder()
+	h.HandleCandidates(w, httptest.NewRequest(http.MethodGet, "/candidates/BADWOLF", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var cs []webrtc.ICECandidateInit
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &cs))
+	require.Len(t, cs, 1)
+	// once gathering is complete, GET replies with no content
+	s.onCandidate(nil)
+	w = httptest.NewRecorder()
+	h.HandleCandidates(w, httptest.NewRequest(http.MethodGet, "/candidates/BADWOLF", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+}
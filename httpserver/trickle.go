@@ -0,0 +1,180 @@
+// This file holds the code for trickle ICE over HTTP. Clients using api
+// version 2 get the answer right away with a session id and use it to
+// exchange candidates at `/candidates/<id>`
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/pion/webrtc/v3"
+	"github.com/tuzig/webexec/peers"
+)
+
+// TrickleAPIVersion is the first API version that uses trickle ICE
+const TrickleAPIVersion = 2
+
+// sessionTimeout is how long a session's candidates can be exchanged
+const sessionTimeout = 30 * time.Second
+
+// pollTimeout is how long a GET waits for new candidates
+const pollTimeout = 5 * time.Second
+
+// ConnectReply is the reply to a connect request from a trickling client
+type ConnectReply struct {
+	// ID is the session id used to exchange candidates
+	ID string `json:"id"`
+	// Answer is the base64 encoded answer, with no candidates
+	Answer string `json:"answer"`
+}
+
+// iceSession holds the local candidates waiting for the client to get them
+type iceSession struct {
+	peer       *peers.Peer
+	m          sync.Mutex
+	candidates []webrtc.ICECandidateInit
+	complete   bool
+	// changed is closed & replaced when a candidate is added
+	changed chan struct{}
+}
+
+func newICESession(peer *peers.Peer) *iceSession {
+	return &iceSession{peer: peer, changed: make(chan struct{})}
+}
+
+// onCandidate is called with each local candidate and with nil once
+// gathering is complete
+func (s *iceSession) onCandidate(c *webrtc.ICECandidate) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if c == nil {
+		s.complete = true
+	} else {
+		s.candidates = append(s.candidates, c.ToJSON())
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// next returns the candidates gathered since the last call, waiting for one
+// if there are none. It returns false once gathering is complete and all
+// the candidates were returned.
+func (s *iceSession) next(ctx context.Context, timeout time.Duration) ([]webrtc.ICECandidateInit, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.m.Lock()
+		if len(s.candidates) > 0 {
+			cs := s.candidates
+			s.candidates = nil
+			s.m.Unlock()
+			return cs, true
+		}
+		if s.complete {
+			s.m.Unlock()
+			return nil, false
+		}
+		changed := s.changed
+		s.m.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return []webrtc.ICECandidateInit{}, true
+		case <-ctx.Done():
+			return []webrtc.ICECandidateInit{}, true
+		}
+	}
+}
+
+func (h *ConnectHandler) addSession(id string, s *iceSession) {
+	h.sessionsM.Lock()
+	defer h.sessionsM.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*iceSession)
+	}
+	h.sessions[id] = s
+}
+
+func (h *ConnectHandler) getSession(id string) *iceSession {
+	h.sessionsM.Lock()
+	defer h.sessionsM.Unlock()
+	return h.sessions[id]
+}
+
+func (h *ConnectHandler) deleteSession(id string) {
+	h.sessionsM.Lock()
+	defer h.sessionsM.Unlock()
+	delete(h.sessions, id)
+}
+
+// answerTrickle replies to a connect request with the answer and a session
+// id, leaving the candidates for the client to get
+func (h *ConnectHandler) answerTrickle(w http.ResponseWriter, peer *peers.Peer,
+	offer webrtc.SessionDescription) {
+
+	s := newICESession(peer)
+	answer, err := peer.Answer(offer, s.onCandidate)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Peer failed to answer : %s", err), http.StatusInternalServerError)
+		return
+	}
+	id := uniuri.New()
+	h.addSession(id, s)
+	time.AfterFunc(sessionTimeout, func() {
+		h.deleteSession(id)
+	})
+	payload := make([]byte, 4096)
+	l, err := peers.EncodeOffer(payload, answer)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode offer : %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConnectReply{ID: id, Answer: string(payload[:l])})
+}
+
+// HandleCandidates exchanges the candidates of a trickling client.
+// POST adds a client's candidate and GET waits for the server's candidates,
+// replying with 204 once all were sent.
+func (h *ConnectHandler) HandleCandidates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	id := strings.TrimPrefix(r.URL.Path, "/candidates/")
+	s := h.getSession(id)
+	if s == nil {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		cs, more := s.next(r.Context(), pollTimeout)
+		if !more {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs)
+	case "POST":
+		var c webrtc.ICECandidateInit
+		err := json.NewDecoder(r.Body).Decode(&c)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode candidate: %s", err),
+				http.StatusBadRequest)
+			return
+		}
+		err = s.peer.AddCandidate(c)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add candidate: %s", err),
+				http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "This endpoint accepts only GET & POST requests",
+			http.StatusMethodNotAllowed)
+	}
+}
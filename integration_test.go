@@ -3,8 +3,10 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"regexp"
 	"strconv"
 	"strings"
@@ -24,7 +26,7 @@ func SendRestore(cdc *webrtc.DataChannel, ref int, marker int) error {
 		Time: time.Now().UnixNano(),
 		Type: "restore",
 		Ref:  ref,
-		Args: peers.RestoreArgs{marker},
+		Args: peers.RestoreArgs{Marker: marker},
 	}
 	restoreMsg, err := json.Marshal(msg)
 	if err != nil {
@@ -121,7 +123,8 @@ func TestSimpleEcho(t *testing.T) {
 	Logger.Infof("TestSimpleEcho")
 	closed := make(chan bool)
 	client, certs, err := NewClient(true)
-	peer := newPeer(t, "A", certs)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
 	// count the incoming messages
 	count := 0
 	dc, err := client.CreateDataChannel("echo,hello world", nil)
@@ -151,7 +154,7 @@ func TestSimpleEcho(t *testing.T) {
 	Logger.Infof("Waiting for the channel to close")
 	<-closed
 	Logger.Infof("TestSimpleEcho done")
-	panes := peers.Panes.All()
+	panes := server.Panes.All()
 	lp := panes[len(panes)-1]
 
 	waitForChild(lp.C.Process.Pid, time.Second)
@@ -160,12 +163,64 @@ func TestSimpleEcho(t *testing.T) {
 	require.GreaterOrEqual(t, count, 2, "Expected to recieve 2 messages and got %d", count)
 }
 
+func TestProfilesOnlyLabel(t *testing.T) {
+	initTest(t)
+	client, certs, err := NewClient(true)
+	require.NoError(t, err)
+	server := newServer(t, certs)
+	server.Conf.ProfilesOnly = true
+	peer := newPeer(t, server, "A")
+	got := make(chan string, 1)
+	dc, err := client.CreateDataChannel("echo,hello world", nil)
+	require.NoError(t, err)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		got <- string(msg.Data)
+	})
+	err = SignalPair(client, peer)
+	require.NoError(t, err, "Signaling failed: %v", err)
+	select {
+	case msg := <-got:
+		require.Contains(t, msg, "Only profiles can be launched")
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the channel to be refused")
+	}
+	require.Empty(t, server.Panes.All())
+}
+
+func TestNoPTYLabel(t *testing.T) {
+	initTest(t)
+	client, certs, err := NewClient(true)
+	require.NoError(t, err)
+	server := newServer(t, certs)
+	server.Conf.GetPolicy = func(fp string, token string) (*peers.Policy, error) {
+		return &peers.Policy{Name: "pipes", NoPTY: true}, nil
+	}
+	peer := newPeer(t, server, "A")
+	got := make(chan string, 1)
+	// a label with no size still runs the command under a pty
+	dc, err := client.CreateDataChannel("bash", nil)
+	require.NoError(t, err)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		got <- string(msg.Data)
+	})
+	err = SignalPair(client, peer)
+	require.NoError(t, err, "Signaling failed: %v", err)
+	select {
+	case msg := <-got:
+		require.Contains(t, msg, "no pty panes")
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the channel to be refused")
+	}
+	require.Empty(t, server.Panes.All())
+}
+
 func TestResizeCommand(t *testing.T) {
 	initTest(t)
 	done := make(chan bool)
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
-	peer := newPeer(t, "A", certs)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
 	cdc, err := client.CreateDataChannel("%", nil)
 	require.Nil(t, err, "failed to create the control data channel: %v", err)
 	cdc.OnOpen(func() {
@@ -175,8 +230,8 @@ func TestResizeCommand(t *testing.T) {
 		// require.Nil(t, err, "failed to create the a channel: %v", err)
 		addPaneArgs := peers.AddPaneArgs{Rows: 12, Cols: 34,
 			Command: []string{"bash"}}
-		m := peers.CTRLMessage{time.Now().UnixNano(), 123, "add_pane",
-			&addPaneArgs}
+		m := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 123, Type: "add_pane",
+			Args: &addPaneArgs}
 		addPaneMsg, err := json.Marshal(m)
 		require.NoError(t, err, "failed marshilng ctrl msg: %s", err)
 		Logger.Info("Sending the addPane message")
@@ -191,9 +246,9 @@ func TestResizeCommand(t *testing.T) {
 			err := json.Unmarshal(ack.Body, &paneID)
 			require.NoError(t, err, "failed to unmarshal ack body: %s", err)
 			require.NotEqual(t, -1, paneID, "Got a bad pane id: %d", paneID)
-			resizeArgs := peers.ResizeArgs{paneID, 80, 24}
-			m := peers.CTRLMessage{time.Now().UnixNano(), 456, "resize",
-				&resizeArgs}
+			resizeArgs := peers.ResizeArgs{PaneID: paneID, Sx: 80, Sy: 24}
+			m := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 456, Type: "resize",
+				Args: &resizeArgs}
 			resizeMsg, err := json.Marshal(m)
 			require.Nil(t, err, "failed marshilng ctrl msg: %v", err)
 			Logger.Info("Sending the resize message")
@@ -217,15 +272,16 @@ func TestPayloadOperations(t *testing.T) {
 	done := make(chan bool)
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
-	peer := newPeer(t, "A", certs)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
 	cdc, err := client.CreateDataChannel("%", nil)
 	require.Nil(t, err, "Failed to create the control data channel: %v", err)
 	payload := []byte("[\"Better payload\"]")
 	cdc.OnOpen(func() {
 		time.Sleep(10 * time.Millisecond)
-		args := peers.SetPayloadArgs{payload}
-		setPayload := peers.CTRLMessage{time.Now().UnixNano(), 777,
-			"set_payload", &args}
+		args := peers.SetPayloadArgs{Payload: payload}
+		setPayload := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 777,
+			Type: "set_payload", Args: &args}
 		setMsg, err := json.Marshal(setPayload)
 		require.Nil(t, err, "Failed to marshal the auth args: %v", err)
 		Logger.Info("Sending set_payload msg")
@@ -250,6 +306,104 @@ func TestPayloadOperations(t *testing.T) {
 	}
 	// TODO: now get_payload and make sure it's the same
 }
+func TestHello(t *testing.T) {
+	initTest(t)
+	done := make(chan bool)
+	client, certs, err := NewClient(true)
+	require.Nil(t, err, "Failed to create a new client %v", err)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.Nil(t, err, "Failed to create the control data channel: %v", err)
+	cdc.OnOpen(func() {
+		args := peers.HelloArgs{APIVersion: 2, Features: []string{"offsets", "teleport"}}
+		hello := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 1,
+			Type: "hello", Args: &args}
+		msg, err := json.Marshal(hello)
+		require.Nil(t, err, "Failed to marshal the hello: %v", err)
+		cdc.Send(msg)
+		args.APIVersion = 99
+		hello.Ref = 2
+		msg, err = json.Marshal(hello)
+		require.Nil(t, err, "Failed to marshal the hello: %v", err)
+		cdc.Send(msg)
+	})
+	cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m peers.CTRLMessage
+		var args peers.AckArgs
+		m.Args = &args
+		err := json.Unmarshal(msg.Data, &m)
+		require.Nil(t, err, "Failed to parse a control message: %v", err)
+		if args.Ref == 1 {
+			require.Equal(t, "ack", m.Type)
+			var reply peers.HelloReply
+			err = json.Unmarshal(args.Body, &reply)
+			require.Nil(t, err, "Failed to parse the hello reply: %v", err)
+			require.Equal(t, peers.APIVersion, reply.APIVersion)
+			require.Contains(t, reply.MessageTypes, "add_pane")
+			require.Equal(t, []string{"offsets"}, reply.Features)
+		} else if args.Ref == 2 {
+			require.Equal(t, "nack", m.Type)
+			done <- true
+		}
+	})
+	SignalPair(client, peer)
+	select {
+	case <-time.After(3 * time.Second):
+		t.Error("Timeout waiting for the hello replies")
+	case <-done:
+	}
+	require.True(t, peer.HasFeature("offsets"))
+	require.False(t, peer.HasFeature("teleport"))
+}
+
+func TestNackCodes(t *testing.T) {
+	initTest(t)
+	client, certs, err := NewClient(true)
+	require.Nil(t, err, "Failed to create a new client %v", err)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.Nil(t, err, "Failed to create the control data channel: %v", err)
+	msgs := []peers.CTRLMessage{
+		{Ref: 1, Type: "teleport"},
+		{Ref: 2, Type: "add_pane", Args: peers.AddPaneArgs{}},
+		{Ref: 3, Type: "get_pane", Args: peers.GetPaneArgs{ID: 999}},
+		{Ref: 4, Type: "resize", Args: "24x80"},
+	}
+	codes := map[int]string{
+		1: peers.CodeUnknownType,
+		2: peers.CodeInvalidArgs,
+		3: peers.CodePaneNotFound,
+		4: peers.CodeInvalidArgs,
+	}
+	got := make(chan peers.NAckArgs, len(msgs))
+	cdc.OnOpen(func() {
+		for _, m := range msgs {
+			b, err := json.Marshal(m)
+			require.Nil(t, err, "Failed to marshal a message: %v", err)
+			cdc.Send(b)
+		}
+	})
+	cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var args peers.NAckArgs
+		m := peers.CTRLMessage{Args: &args}
+		err := json.Unmarshal(msg.Data, &m)
+		require.Nil(t, err, "Failed to parse a control message: %v", err)
+		require.Equal(t, "nack", m.Type)
+		got <- args
+	})
+	SignalPair(client, peer)
+	for range msgs {
+		select {
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout waiting for a nack")
+		case args := <-got:
+			require.Equal(t, codes[args.Ref], args.Code)
+		}
+	}
+}
+
 func TestMarkerRestore(t *testing.T) {
 	initTest(t)
 	var (
@@ -265,7 +419,8 @@ func TestMarkerRestore(t *testing.T) {
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
 	// start the server
-	peer := newPeer(t, "A", certs)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
 	require.Nil(t, err, "Failed to start a new server %v", err)
 	// create the command & control data channel
 	cdc, err := client.CreateDataChannel("%", nil)
@@ -322,9 +477,9 @@ func TestMarkerRestore(t *testing.T) {
 		t.Error("Timeout waiting for marker ack")
 	case <-gotSetMarkerAck:
 	}
-	client2, certs, err := NewClient(true)
+	client2, _, err := NewClient(true)
 	require.Nil(t, err, "Failed to create the second client %v", err)
-	peer2 := newPeer(t, "A", certs)
+	peer2 := newPeer(t, server, "A")
 	require.Nil(t, err, "Failed to start a new server %v", err)
 	// create the command & control data channel
 	SignalPair(client2, peer2)
@@ -373,7 +528,8 @@ func TestAddPaneMessage(t *testing.T) {
 	wg.Add(3)
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
-	peer := newPeer(t, "A", certs)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
 	done := make(chan bool)
 	client.OnDataChannel(func(d *webrtc.DataChannel) {
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
@@ -400,8 +556,8 @@ func TestAddPaneMessage(t *testing.T) {
 		})
 		addPaneArgs := peers.AddPaneArgs{Rows: 12, Cols: 34,
 			Command: []string{"echo", "BADWOLF"}} //, "&&", "sleep", "5"}}
-		m := peers.CTRLMessage{time.Now().UnixNano(), 456, "add_pane",
-			&addPaneArgs}
+		m := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 456, Type: "add_pane",
+			Args: &addPaneArgs}
 		msg, err := json.Marshal(m)
 		require.Nil(t, err, "failed marshilng ctrl msg: %v", msg)
 		time.Sleep(time.Second / 10)
@@ -418,6 +574,98 @@ func TestAddPaneMessage(t *testing.T) {
 	case <-done:
 	}
 }
+func TestMux(t *testing.T) {
+	initTest(t)
+	client, certs, err := NewClient(true)
+	require.Nil(t, err, "Failed to create a new client %v", err)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
+	frame := func(paneID int, typ byte, payload string) []byte {
+		f := make([]byte, peers.MuxHeaderSize)
+		binary.BigEndian.PutUint32(f, uint32(paneID))
+		f[4] = typ
+		return append(f, payload...)
+	}
+	// the pane is streamed on the mux channel, with no data channel
+	client.OnDataChannel(func(d *webrtc.DataChannel) {
+		t.Errorf("Got an unexpected data channel: %q", d.Label())
+	})
+	muxOpened := make(chan bool)
+	paneIDs := make(chan int, 1)
+	var output strings.Builder
+	gotOutput := make(chan bool, 1)
+	gotClose := make(chan bool)
+	gotError := make(chan string, 1)
+	mux, err := client.CreateDataChannel(peers.MuxLabel, nil)
+	require.Nil(t, err, "Failed to create the mux data channel: %v", err)
+	mux.OnOpen(func() { close(muxOpened) })
+	mux.OnMessage(func(msg webrtc.DataChannelMessage) {
+		require.GreaterOrEqual(t, len(msg.Data), peers.MuxHeaderSize)
+		id := int(binary.BigEndian.Uint32(msg.Data))
+		payload := string(msg.Data[peers.MuxHeaderSize:])
+		switch msg.Data[4] {
+		case peers.FrameData:
+			output.WriteString(payload)
+			if strings.Contains(output.String(), "got BADWOLF") {
+				gotOutput <- true
+				output.Reset()
+			}
+		case peers.FrameClose:
+			close(gotClose)
+		case peers.FrameError:
+			require.Equal(t, 999, id)
+			gotError <- payload
+		}
+	})
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.Nil(t, err, "Failed to create the control data channel: %v", err)
+	cdc.OnOpen(func() {
+		<-muxOpened
+		time.Sleep(time.Second / 10)
+		cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			ack := ParseAck(t, msg)
+			id, err := strconv.Atoi(string(ack.Body))
+			require.Nil(t, err, "Failed to parse the pane id: %v", err)
+			paneIDs <- id
+		})
+		args := peers.AddPaneArgs{Rows: 24, Cols: 80, Mux: true,
+			Command: []string{"sh", "-c", "read x; echo got $x"}}
+		m := peers.CTRLMessage{Ref: 1, Type: "add_pane", Args: &args}
+		b, err := json.Marshal(m)
+		require.Nil(t, err, "Failed to marshal a message: %v", err)
+		cdc.Send(b)
+	})
+	SignalPair(client, peer)
+	var paneID int
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the add_pane ack")
+	case paneID = <-paneIDs:
+	}
+	mux.Send(frame(999, peers.FrameData, "BADWOLF\n"))
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for an error frame")
+	case e := <-gotError:
+		require.Contains(t, e, "not attached")
+	}
+	mux.Send(frame(paneID, peers.FrameResize, "\x00\x12\x00\x34"))
+	mux.Send(frame(paneID, peers.FrameData, "BADWOLF\n"))
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the output")
+	case <-gotOutput:
+	}
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the stream to close")
+	case <-gotClose:
+	}
+	pane := server.Panes.Get(paneID)
+	require.Equal(t, uint16(0x12), pane.Ws.Rows)
+	require.Equal(t, uint16(0x34), pane.Ws.Cols)
+}
+
 func TestReconnectPane(t *testing.T) {
 	initTest(t)
 	var (
@@ -427,7 +675,8 @@ func TestReconnectPane(t *testing.T) {
 	)
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
-	peer := newPeer(t, "A", certs)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
 	client.OnDataChannel(func(d *webrtc.DataChannel) {
 		l := d.Label()
 		//fs := strings.Split(d.Label(), ",")
@@ -459,8 +708,8 @@ func TestReconnectPane(t *testing.T) {
 		time.Sleep(time.Second / 100)
 		addPaneArgs := peers.AddPaneArgs{Rows: 12, Cols: 34,
 			Command: []string{"bash", "-c", "sleep 1; echo BADWOLF"}}
-		m := peers.CTRLMessage{time.Now().UnixNano(), 456, "add_pane",
-			&addPaneArgs}
+		m := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 456, Type: "add_pane",
+			Args: &addPaneArgs}
 		msg, err := json.Marshal(m)
 		require.Nil(t, err, "failed marshilng ctrl msg: %v", msg)
 		cdc.Send(msg)
@@ -472,8 +721,8 @@ func TestReconnectPane(t *testing.T) {
 	Logger.Infof("After first wait")
 	wg.Add(1)
 	a := peers.ReconnectPaneArgs{ID: ci}
-	m := peers.CTRLMessage{time.Now().UnixNano(), 457, "reconnect_pane",
-		&a}
+	m := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 457, Type: "reconnect_pane",
+		Args: &a}
 	msg, err := json.Marshal(m)
 	require.Nil(t, err, "failed marshilng ctrl msg: %v", msg)
 	cdc.Send(msg)
@@ -482,7 +731,7 @@ func TestReconnectPane(t *testing.T) {
 func TestExecCommand(t *testing.T) {
 	initTest(t)
 	c := []string{"bash", "-c", "echo hello"}
-	_, tty, err := peers.ExecCommand(c, nil, nil, 0, "")
+	_, tty, err := peers.ExecCommand(c, nil, "", nil, 0, "")
 	b := make([]byte, 64)
 	l, err := tty.Read(b)
 	require.Nil(t, err)
@@ -492,14 +741,14 @@ func TestExecCommand(t *testing.T) {
 func TestExecCommandWithParent(t *testing.T) {
 	initTest(t)
 	c := []string{"sh"}
-	cmd, tty, err := peers.ExecCommand(c, nil, nil, 0, "")
+	cmd, tty, err := peers.ExecCommand(c, nil, "", nil, 0, "")
 	time.Sleep(time.Second / 100)
 	_, err = tty.Write([]byte("cd /tmp\n"))
 	require.Nil(t, err)
 	_, err = tty.Write([]byte("pwd\n"))
 	require.Nil(t, err)
 	time.Sleep(time.Second / 10)
-	_, tty2, err := peers.ExecCommand([]string{"pwd"}, nil, nil, cmd.Process.Pid, "")
+	_, tty2, err := peers.ExecCommand([]string{"pwd"}, nil, "", nil, cmd.Process.Pid, "")
 	require.Nil(t, err)
 	b := make([]byte, 64)
 	l, err := tty2.Read(b)
@@ -509,3 +758,67 @@ func TestExecCommandWithParent(t *testing.T) {
 	cwd := string(b[:l])
 	require.True(t, strings.HasSuffix(cwd, "/tmp\r\n"), "Expected ouput to end with /tmp, got %s", cwd)
 }
+func TestPaneExited(t *testing.T) {
+	initTest(t)
+	done := make(chan peers.PaneStatus)
+	client, certs, err := NewClient(true)
+	require.Nil(t, err, "Failed to create a new client %v", err)
+	server := newServer(t, certs)
+	peer := newPeer(t, server, "A")
+	client.OnDataChannel(func(d *webrtc.DataChannel) {
+		Logger.Infof("Got a new datachannel: %s", d.Label())
+	})
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.Nil(t, err, "failed to create the control data channel: %v", err)
+	cdc.OnOpen(func() {
+		cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var status peers.PaneStatus
+			cm := peers.CTRLMessage{Args: &status}
+			err := json.Unmarshal(msg.Data, &cm)
+			require.Nil(t, err, "Failed to unmarshal the server msg: %v", err)
+			if cm.Type == "pane_exited" {
+				done <- status
+			}
+		})
+		addPaneArgs := peers.AddPaneArgs{Rows: 12, Cols: 34,
+			Command: []string{"bash", "-c", "exit 3"}}
+		m := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 456, Type: "add_pane",
+			Args: &addPaneArgs}
+		msg, err := json.Marshal(m)
+		require.Nil(t, err, "failed marshilng ctrl msg: %v", msg)
+		time.Sleep(time.Second / 10)
+		cdc.Send(msg)
+	})
+	SignalPair(client, peer)
+	select {
+	case <-time.After(3 * time.Second):
+		t.Error("Timeout waiting for pane_exited")
+	case status := <-done:
+		require.False(t, status.IsRunning)
+		require.Equal(t, 3, status.ExitCode)
+		require.NotZero(t, status.EndTime)
+		// the exited pane should still be in the panes db
+		pane := server.Panes.Get(status.PaneID)
+		require.NotNil(t, pane)
+		require.Equal(t, 3, pane.ExitCode)
+	}
+}
+func TestExecPipeCommand(t *testing.T) {
+	initTest(t)
+	c := []string{"sh", "-c", "echo out; echo err >&2; cat; exit 7"}
+	cmd, rwc, err := peers.ExecPipeCommand(c, nil, "", nil, 0, "")
+	require.NoError(t, err)
+	pipes, ok := rwc.(*peers.Pipes)
+	require.True(t, ok, "Expected *peers.Pipes and got %T", rwc)
+	_, err = pipes.Write([]byte("in\n"))
+	require.NoError(t, err)
+	require.NoError(t, pipes.CloseWrite())
+	stdout, err := ioutil.ReadAll(pipes)
+	require.NoError(t, err)
+	require.Equal(t, "out\nin\n", string(stdout))
+	stderr, err := ioutil.ReadAll(pipes.Stderr)
+	require.NoError(t, err)
+	require.Equal(t, "err\n", string(stderr))
+	cmd.Wait()
+	require.Equal(t, 7, cmd.ProcessState.ExitCode())
+}
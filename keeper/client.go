@@ -0,0 +1,206 @@
+package keeper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dialTimeout is how long Dial waits for the keeper's greeting
+const dialTimeout = 2 * time.Second
+
+// Client is the agent's side of a keeper connection. Reading returns the
+// command's output and writing sends it input.
+type Client struct {
+	// Info is the keeper's greeting
+	Info Info
+	// Scrollback holds the output the keeper kept before we connected
+	Scrollback []byte
+	conn       net.Conn
+	r          *bufio.Reader
+	wm         sync.Mutex
+	pending    []byte
+	exited     chan struct{}
+	exitOnce   sync.Once
+	status     ExitStatus
+}
+
+// Start starts a keeper process by executing argv, i.e. `webexec keeper`,
+// and connects to it. The keeper runs in its own session so it
+// survives the agent.
+func Start(argv []string, spec Spec) (*Client, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start keeper: %s", err)
+	}
+	// reap the keeper when it's done
+	go cmd.Wait()
+	err = json.NewEncoder(in).Encode(spec)
+	in.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send spec to keeper: %s", err)
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read keeper's reply: %s", err)
+	}
+	line = strings.TrimSpace(line)
+	if line != "ok" {
+		return nil, fmt.Errorf("Keeper failed: %s", line)
+	}
+	return Dial(spec.Socket)
+}
+
+// Dial connects to a running keeper and reads its greeting
+func Dial(socket string) (*Client, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		exited: make(chan struct{}),
+	}
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	typ, payload, err := ReadFrame(c.r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to read keeper info: %s", err)
+	}
+	if typ != FrameInfo {
+		conn.Close()
+		return nil, fmt.Errorf("Expected keeper info and got frame %q", typ)
+	}
+	err = json.Unmarshal(payload, &c.Info)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to decode keeper info: %s", err)
+	}
+	typ, payload, err = ReadFrame(c.r)
+	if err != nil || typ != FrameScrollback {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to read keeper scrollback: %v", err)
+	}
+	c.Scrollback = payload
+	conn.SetReadDeadline(time.Time{})
+	return c, nil
+}
+
+// List returns the sockets of the keepers in a directory
+func List(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "*.sock"))
+}
+
+// SocketPath returns the path of a keeper's socket
+func SocketPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.sock", id))
+}
+
+// Read reads the command's output. When the command exits, the exit
+// status is recorded and Exited is closed.
+func (c *Client) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		typ, payload, err := ReadFrame(c.r)
+		if err != nil {
+			c.setExited(nil)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		switch typ {
+		case FrameOutput:
+			c.pending = payload
+		case FrameExit:
+			var status ExitStatus
+			err = json.Unmarshal(payload, &status)
+			if err != nil {
+				c.setExited(nil)
+			} else {
+				c.setExited(&status)
+			}
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// setExited records the exit status, nil when it's unknown
+func (c *Client) setExited(status *ExitStatus) {
+	c.exitOnce.Do(func() {
+		if status != nil {
+			c.status = *status
+		} else {
+			c.status = ExitStatus{
+				ExitCode: -1,
+				EndTime:  time.Now().UnixNano() / 1000000,
+			}
+		}
+		close(c.exited)
+	})
+}
+
+// Exited returns a channel that's closed when the command exits or the
+// connection to the keeper is lost
+func (c *Client) Exited() <-chan struct{} {
+	return c.exited
+}
+
+// ExitStatus returns the command's exit status, valid after Exited is closed
+func (c *Client) ExitStatus() ExitStatus {
+	return c.status
+}
+
+func (c *Client) send(typ byte, payload []byte) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	return WriteFrame(c.conn, typ, payload)
+}
+
+// Write sends input to the command
+func (c *Client) Write(b []byte) (int, error) {
+	err := c.send(FrameInput, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Resize changes the dimensions of the keeper's tty
+func (c *Client) Resize(rows uint16, cols uint16) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:2], rows)
+	binary.BigEndian.PutUint16(b[2:4], cols)
+	return c.send(FrameResize, b)
+}
+
+// Kill asks the keeper to kill the command
+func (c *Client) Kill() error {
+	return c.send(FrameKill, nil)
+}
+
+// Close disconnects from the keeper, leaving the command running
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
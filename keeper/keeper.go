@@ -0,0 +1,288 @@
+package keeper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// keeper holds the state of a keeper process
+type keeper struct {
+	spec    Spec
+	cmd     *exec.Cmd
+	tty     *os.File
+	l       net.Listener
+	m       sync.Mutex
+	conn    net.Conn
+	history *history
+	written int64
+	ws      pty.Winsize
+	exit    *ExitStatus
+	// collected is closed once an agent got the exit status
+	collected   chan struct{}
+	collectOnce sync.Once
+}
+
+// Run is the main function of a keeper process. It reads the Spec from in,
+// starts the command and listens on the socket. Once listening it writes
+// "ok" to out or an error message if it failed.
+// Run returns after the command exited and an agent collected its exit
+// status or the linger timeout passed.
+func Run(in io.Reader, out io.Writer) error {
+	var spec Spec
+	err := json.NewDecoder(in).Decode(&spec)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to decode keeper spec: %s\n", err)
+		return err
+	}
+	k, err := start(spec)
+	if err != nil {
+		fmt.Fprintf(out, "%s\n", err)
+		return err
+	}
+	fmt.Fprintln(out, "ok")
+	// the agent can go away, we stay
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT, syscall.SIGPIPE)
+	k.serve()
+	return nil
+}
+
+// start starts the command and listens on the socket
+func start(spec Spec) (*keeper, error) {
+	if len(spec.Command) == 0 {
+		return nil, fmt.Errorf("keeper got an empty command")
+	}
+	if spec.ScrollbackSize <= 0 {
+		spec.ScrollbackSize = DefaultScrollbackSize
+	}
+	if spec.Linger <= 0 {
+		spec.Linger = DefaultLinger
+	}
+	if spec.Rows == 0 || spec.Cols == 0 {
+		spec.Rows, spec.Cols = 24, 80
+	}
+	k := &keeper{
+		spec:      spec,
+		history:   newHistory(spec.ScrollbackSize),
+		ws:        pty.Winsize{Rows: spec.Rows, Cols: spec.Cols},
+		collected: make(chan struct{}),
+	}
+	os.Remove(spec.Socket)
+	l, err := net.Listen("unix", spec.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on %q: %s", spec.Socket, err)
+	}
+	os.Chmod(spec.Socket, 0600)
+	k.l = l
+	cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+	cmd.Dir = spec.Dir
+	cmd.Env = spec.Env
+	tty, err := pty.StartWithSize(cmd, &k.ws)
+	if err != nil {
+		l.Close()
+		os.Remove(spec.Socket)
+		return nil, fmt.Errorf("Failed launching %q: %s", spec.Command, err)
+	}
+	k.cmd = cmd
+	k.tty = tty
+	return k, nil
+}
+
+// serve relays the tty to connected agents until the command exits
+func (k *keeper) serve() {
+	readDone := make(chan struct{})
+	go k.readLoop(readDone)
+	go k.acceptLoop()
+	k.cmd.Wait()
+	// give the read loop a chance to read the last of the output
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+	}
+	status := &ExitStatus{EndTime: time.Now().UnixNano() / 1000000}
+	state := k.cmd.ProcessState
+	if state != nil {
+		status.ExitCode = state.ExitCode()
+		ws, ok := state.Sys().(syscall.WaitStatus)
+		if ok && ws.Signaled() {
+			status.Signal = ws.Signal().String()
+		}
+	}
+	k.m.Lock()
+	k.exit = status
+	if k.conn != nil && writeJSONFrame(k.conn, FrameExit, status) == nil {
+		k.markCollected()
+	}
+	k.m.Unlock()
+	select {
+	case <-k.collected:
+	case <-time.After(k.spec.Linger):
+	}
+	k.l.Close()
+	os.Remove(k.spec.Socket)
+	k.tty.Close()
+	k.m.Lock()
+	if k.conn != nil {
+		k.conn.Close()
+	}
+	k.m.Unlock()
+}
+
+// markCollected is called once an agent got the exit status
+func (k *keeper) markCollected() {
+	k.collectOnce.Do(func() { close(k.collected) })
+}
+
+// readLoop reads the tty, keeps the history and forwards the output to the
+// connected agent
+func (k *keeper) readLoop(done chan struct{}) {
+	defer close(done)
+	b := make([]byte, 4096)
+	for {
+		l, err := k.tty.Read(b)
+		if l > 0 {
+			k.m.Lock()
+			k.history.Write(b[:l])
+			k.written += int64(l)
+			if k.conn != nil {
+				if WriteFrame(k.conn, FrameOutput, b[:l]) != nil {
+					k.conn.Close()
+					k.conn = nil
+				}
+			}
+			k.m.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// acceptLoop accepts agents' connections. A new agent replaces the old one.
+func (k *keeper) acceptLoop() {
+	for {
+		conn, err := k.l.Accept()
+		if err != nil {
+			return
+		}
+		k.m.Lock()
+		if k.conn != nil {
+			k.conn.Close()
+		}
+		k.conn = nil
+		info := Info{
+			ID:      k.spec.ID,
+			PID:     k.cmd.Process.Pid,
+			Command: k.spec.Command,
+			Rows:    k.ws.Rows,
+			Cols:    k.ws.Cols,
+			Running: k.exit == nil,
+			Written: k.written,
+		}
+		err = writeJSONFrame(conn, FrameInfo, info)
+		if err == nil {
+			err = WriteFrame(conn, FrameScrollback, k.history.Bytes())
+		}
+		if err == nil && k.exit != nil {
+			err = writeJSONFrame(conn, FrameExit, k.exit)
+			if err == nil {
+				k.markCollected()
+			}
+		}
+		if err != nil {
+			conn.Close()
+		} else {
+			k.conn = conn
+			go k.connReader(conn)
+		}
+		k.m.Unlock()
+	}
+}
+
+// connReader handles the frames an agent sends
+func (k *keeper) connReader(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		typ, payload, err := ReadFrame(r)
+		if err != nil {
+			break
+		}
+		switch typ {
+		case FrameInput:
+			k.tty.Write(payload)
+		case FrameResize:
+			if len(payload) != 4 {
+				continue
+			}
+			ws := pty.Winsize{
+				Rows: binary.BigEndian.Uint16(payload[0:2]),
+				Cols: binary.BigEndian.Uint16(payload[2:4]),
+			}
+			if pty.Setsize(k.tty, &ws) == nil {
+				k.m.Lock()
+				k.ws = ws
+				k.m.Unlock()
+			}
+		case FrameKill:
+			k.cmd.Process.Kill()
+		}
+	}
+	k.m.Lock()
+	if k.conn == conn {
+		k.conn = nil
+	}
+	k.m.Unlock()
+	conn.Close()
+}
+
+// history is a fixed size ring of the latest output
+type history struct {
+	data []byte
+	end  int
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{data: make([]byte, size)}
+}
+
+// Write adds b to the history, overwriting the oldest data
+func (h *history) Write(b []byte) {
+	size := len(h.data)
+	if len(b) >= size {
+		copy(h.data, b[len(b)-size:])
+		h.end = 0
+		h.full = true
+		return
+	}
+	n := copy(h.data[h.end:], b)
+	if n < len(b) {
+		copy(h.data, b[n:])
+		h.full = true
+	}
+	h.end = (h.end + len(b)) % size
+	if h.end == 0 {
+		h.full = true
+	}
+}
+
+// Bytes returns a copy of the history, oldest byte first
+func (h *history) Bytes() []byte {
+	if !h.full {
+		return append([]byte{}, h.data[:h.end]...)
+	}
+	r := make([]byte, 0, len(h.data))
+	r = append(r, h.data[h.end:]...)
+	return append(r, h.data[:h.end]...)
+}
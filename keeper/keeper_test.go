@@ -0,0 +1,108 @@
+package keeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readUntil reads from the client until the scrollback & output contain s
+func readUntil(t *testing.T, c *Client, s string) string {
+	out := string(c.Scrollback)
+	done := make(chan bool)
+	go func() {
+		b := make([]byte, 1024)
+		for !strings.Contains(out, s) {
+			l, err := c.Read(b)
+			if err != nil {
+				break
+			}
+			out += string(b[:l])
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Timeout waiting for %q, got %q", s, out)
+	}
+	require.Contains(t, out, s)
+	return out
+}
+
+func startKeeper(t *testing.T, command ...string) Spec {
+	dir, err := ioutil.TempDir("", "keeper")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	spec := Spec{
+		ID:      7,
+		Socket:  filepath.Join(dir, "7.sock"),
+		Command: command,
+		Rows:    24,
+		Cols:    80,
+		Linger:  time.Second,
+	}
+	k, err := start(spec)
+	require.NoError(t, err)
+	go k.serve()
+	return spec
+}
+
+func TestKeeperReconnect(t *testing.T) {
+	spec := startKeeper(t, "sh", "-c", "echo BADWOLF; read line; echo got $line; exit 3")
+	c, err := Dial(spec.Socket)
+	require.NoError(t, err)
+	require.Equal(t, 7, c.Info.ID)
+	require.True(t, c.Info.Running)
+	readUntil(t, c, "BADWOLF")
+	// disconnect & reconnect, the scrollback should have the output
+	c.Close()
+	c, err = Dial(spec.Socket)
+	require.NoError(t, err)
+	require.Contains(t, string(c.Scrollback), "BADWOLF")
+	require.Equal(t, int64(len(c.Scrollback)), c.Info.Written)
+	require.NoError(t, c.Resize(30, 100))
+	_, err = c.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	readUntil(t, c, "got hello")
+	go ioutil.ReadAll(c)
+	select {
+	case <-c.Exited():
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the command to exit")
+	}
+	require.Equal(t, 3, c.ExitStatus().ExitCode)
+}
+
+func TestKeeperKill(t *testing.T) {
+	spec := startKeeper(t, "sleep", "10")
+	c, err := Dial(spec.Socket)
+	require.NoError(t, err)
+	require.NoError(t, c.Kill())
+	go ioutil.ReadAll(c)
+	select {
+	case <-c.Exited():
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the command to exit")
+	}
+	require.Equal(t, "killed", c.ExitStatus().Signal)
+	// once the status is collected the keeper removes its socket
+	time.Sleep(100 * time.Millisecond)
+	_, err = os.Stat(spec.Socket)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(5)
+	h.Write([]byte("abc"))
+	require.Equal(t, "abc", string(h.Bytes()))
+	h.Write([]byte("def"))
+	require.Equal(t, "bcdef", string(h.Bytes()))
+	h.Write([]byte("0123456789"))
+	require.Equal(t, "56789", string(h.Bytes()))
+}
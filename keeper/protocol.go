@@ -0,0 +1,127 @@
+// Package keeper runs a command in a pseudo tty held by a small, detached
+// process - the keeper. The keeper listens on a unix socket and relays the
+// tty to the agent connected to it, so panes survive agent restarts,
+// crashes & upgrades. It works much like dtach or abduco.
+//
+// Keeper and agent exchange frames made of a one byte type, a four bytes
+// big endian length and a payload.
+package keeper
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Frame types
+const (
+	// FrameInfo is sent by the keeper when an agent connects, payload is
+	// a json encoded Info
+	FrameInfo byte = 'h'
+	// FrameScrollback follows FrameInfo and holds the kept history
+	FrameScrollback byte = 's'
+	// FrameOutput holds data read from the tty
+	FrameOutput byte = 'o'
+	// FrameExit is sent when the command exits, payload is a json encoded
+	// ExitStatus
+	FrameExit byte = 'x'
+	// FrameInput holds data to write to the tty
+	FrameInput byte = 'i'
+	// FrameResize holds the new rows & cols as two big endian uint16
+	FrameResize byte = 'r'
+	// FrameKill asks the keeper to kill the command
+	FrameKill byte = 'k'
+)
+
+// MaxFrameSize is the maximum size of a frame's payload
+const MaxFrameSize = 1 << 22
+
+// DefaultScrollbackSize is the history size used when Spec doesn't set one
+const DefaultScrollbackSize = 100000
+
+// DefaultLinger is how long a keeper waits for an agent to collect the
+// exit status when Spec doesn't set it
+const DefaultLinger = time.Minute
+
+// Spec is sent by the agent to a starting keeper and holds the command and
+// its tty settings
+type Spec struct {
+	ID      int      `json:"id"`
+	Socket  string   `json:"socket"`
+	Command []string `json:"command"`
+	Dir     string   `json:"dir"`
+	// Env is the command's environment, nil to inherit the keeper's
+	Env  []string `json:"env"`
+	Rows uint16   `json:"rows"`
+	Cols uint16   `json:"cols"`
+	// ScrollbackSize is the number of bytes of history the keeper keeps
+	ScrollbackSize int `json:"scrollback_size"`
+	// Linger is how long the keeper waits for an agent to collect the
+	// command's exit status
+	Linger time.Duration `json:"linger"`
+}
+
+// Info is sent by the keeper to every agent that connects
+type Info struct {
+	ID int `json:"id"`
+	// PID is the command's process id
+	PID     int      `json:"pid"`
+	Command []string `json:"command"`
+	Rows    uint16   `json:"rows"`
+	Cols    uint16   `json:"cols"`
+	// Running is false when the command exited and the keeper is lingering
+	Running bool `json:"running"`
+	// Written is the number of bytes read from the tty since it started
+	Written int64 `json:"written"`
+}
+
+// ExitStatus holds how the command exited
+type ExitStatus struct {
+	// ExitCode is -1 when the command was terminated by a signal
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+	EndTime  int64  `json:"end_time"`
+}
+
+// WriteFrame writes a frame of a given type
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("frame too big: %d bytes", len(payload))
+	}
+	b := make([]byte, 5+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(payload)))
+	copy(b[5:], payload)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadFrame reads a frame and returns its type and payload
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var h [5]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	l := binary.BigEndian.Uint32(h[1:5])
+	if l > MaxFrameSize {
+		return 0, nil, fmt.Errorf("frame too big: %d bytes", l)
+	}
+	payload := make([]byte, l)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return h[0], payload, nil
+}
+
+// writeJSONFrame marshals v and writes it as a frame of the given type
+func writeJSONFrame(w io.Writer, typ byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, typ, b)
+}
@@ -27,16 +27,16 @@ var wsWriteM sync.Mutex
 
 // outChan is used to send messages to peerbook
 type PeerbookClient struct {
-	outChan  chan []byte
-	ws       *websocket.Conn
-	peerConf *peers.Conf
-	host     string
+	outChan chan []byte
+	ws      *websocket.Conn
+	server  *peers.Server
+	host    string
 }
 
-func NewPeerbookClient(peerConf *peers.Conf) *PeerbookClient {
+func NewPeerbookClient(server *peers.Server) *PeerbookClient {
 	return &PeerbookClient{
-		outChan:  make(chan []byte),
-		peerConf: peerConf,
+		outChan: make(chan []byte),
+		server:  server,
 	}
 }
 func StartPeerbookClient(lc fx.Lifecycle, client *PeerbookClient) {
@@ -283,10 +283,10 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 	v, found := m["peer_update"]
 	if found {
 		pu := v.(map[string]interface{})
-		peer, found := peers.Peers[fp]
-		if found && peer.PC != nil && !pu["verified"].(bool) {
-			peer.PC.Close()
-			peer.PC = nil
+		if !pu["verified"].(bool) {
+			for _, peer := range pb.server.Peers.All4FP(fp) {
+				peer.Close()
+			}
 		}
 	}
 	o, found := m["offer"].(string)
@@ -302,17 +302,22 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 			return fmt.Errorf("Failed to get offer's fingerprint: %w", err)
 		}
 		if offerFP != fp {
-			peers.Peers[fp].PC.Close()
-			peers.Peers[fp].PC = nil
+			for _, peer := range pb.server.Peers.All4FP(fp) {
+				peer.Close()
+			}
 			Logger.Warnf("Refusing connection because fp mismatch: %s", fp)
 			return fmt.Errorf("Mismatched fingerprint: %s", fp)
 		}
 		Logger.Info("Authenticated!")
-		peer, err := peers.NewPeer(offerFP, pb.peerConf)
+		peer, err := pb.server.NewPeer(offerFP)
 		if err != nil {
 			return fmt.Errorf("Failed to create a new peer: %w", err)
 		}
-		peer.PC.OnICECandidate(func(can *webrtc.ICECandidate) {
+		pc := peer.GetPC()
+		if pc == nil {
+			return fmt.Errorf("Peer %d was closed", peer.ID)
+		}
+		pc.OnICECandidate(func(can *webrtc.ICECandidate) {
 			if can != nil {
 				m := map[string]interface{}{
 					"target": fp, "candidate": can.ToJSON()}
@@ -325,15 +330,15 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 				pb.outChan <- j
 			}
 		})
-		err = peer.PC.SetRemoteDescription(offer)
+		err = pc.SetRemoteDescription(offer)
 		if err != nil {
 			return fmt.Errorf("Peer failed to listen : %w", err)
 		}
-		answer, err := peer.PC.CreateAnswer(nil)
+		answer, err := pc.CreateAnswer(nil)
 		if err != nil {
 			return fmt.Errorf("Failed to create an answer: %w", err)
 		}
-		err = peer.PC.SetLocalDescription(answer)
+		err = pc.SetLocalDescription(answer)
 		payload := make([]byte, 4096)
 		l, err := peers.EncodeOffer(payload, answer)
 		if err != nil {
@@ -351,14 +356,13 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 	_, found = m["candidate"]
 	if found {
 		var can struct {
-			sourceFP   string                  `json:"source_fp"`
-			sourceName string                  `json:"source_name"`
-			Candidate  webrtc.ICECandidateInit `json:"candidate"`
+			Candidate webrtc.ICECandidateInit `json:"candidate"`
 		}
 		r.Seek(0, 0)
 		err = dec.Decode(&can)
-		peer, found := peers.Peers[fp]
-		if found {
+		// candidates are for the connection being negotiated, the newest
+		peer := pb.server.Peers.Latest4FP(fp)
+		if peer != nil {
 			err := peer.AddCandidate(can.Candidate)
 			if err != nil {
 				return fmt.Errorf("Failed to add ice candidate: %w", err)
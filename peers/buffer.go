@@ -1,82 +1,332 @@
 package peers
 
 import (
+	"sort"
 	"sync"
 )
 
-// Buffer is a used to represet a fixed size buffer with markers
+// DefaultScrollbackSize is the size of a pane's buffer when the
+// configuration doesn't set ScrollbackSize
+const DefaultScrollbackSize = 100000
+
+// Buffer is a used to represet a fixed size ring buffer with markers.
+// When spilling, the history overwritten in the ring is kept on disk.
 type Buffer struct {
-	markers map[int]int
-	data    []byte
-	end     int
-	m       sync.Mutex
-	size    int
+	m    sync.Mutex
+	data []byte
+	size int
+	// end is the position of the next byte in data and used is the number
+	// of bytes in data
+	end  int
+	used int
+	// total is the offset of the next byte, the number of bytes added since
+	// the buffer was created
+	total int64
+	// markers are sorted by offset
+	markers []marker
+	spill   *spill
+}
+
+// marker is an offset saved under an id
+type marker struct {
+	id     int
+	offset int64
+}
+
+// BufferState is a buffer's state, used to hand it off to a new agent
+type BufferState struct {
+	// Data holds the ring's bytes, oldest first
+	Data []byte `json:"data"`
+	// Offset is the offset of the next byte
+	Offset  int64         `json:"offset"`
+	Markers map[int]int64 `json:"markers"`
+	Spill   []*spillFile  `json:"spill,omitempty"`
 }
 
 // NewBuffer creates and returns a new buffer of a given size
 func NewBuffer(size int) *Buffer {
-	return &Buffer{markers: make(map[int]int),
-		data: make([]byte, size),
-		size: size}
+	if size <= 0 {
+		size = DefaultScrollbackSize
+	}
+	return &Buffer{data: make([]byte, size), size: size}
+}
+
+// SpillTo makes the buffer keep the history overwritten in the ring in
+// compressed files in dir, up to max bytes
+func (buffer *Buffer) SpillTo(dir string, max int64) {
+	buffer.m.Lock()
+	defer buffer.m.Unlock()
+	if buffer.spill == nil {
+		buffer.spill = newSpill(dir, max)
+	}
 }
 
 // Add adds a slice of bytes to the buffer
 func (buffer *Buffer) Add(b []byte) {
+	if len(b) == 0 {
+		return
+	}
 	buffer.m.Lock()
-	for i := range b {
-		buffer.data[buffer.end] = b[i]
-		buffer.end++
-		if buffer.end == buffer.size {
-			buffer.end = 0
+	defer buffer.m.Unlock()
+	overflow := buffer.used + len(b) - buffer.size
+	if overflow > 0 && buffer.spill != nil {
+		buffer.spillOverflow(b, overflow)
+	}
+	if len(b) >= buffer.size {
+		copy(buffer.data, b[len(b)-buffer.size:])
+		buffer.end = 0
+		buffer.used = buffer.size
+	} else {
+		n := copy(buffer.data[buffer.end:], b)
+		copy(buffer.data, b[n:])
+		buffer.end = (buffer.end + len(b)) % buffer.size
+		buffer.used += len(b)
+		if buffer.used > buffer.size {
+			buffer.used = buffer.size
 		}
-		for k, v := range buffer.markers {
-			if v == buffer.end {
-				buffer.markers[k] = -1
-			}
+	}
+	buffer.total += int64(len(b))
+	// drop the markers that are lost in history
+	oldest := buffer.oldestLocked()
+	i := sort.Search(len(buffer.markers), func(i int) bool {
+		return buffer.markers[i].offset >= oldest
+	})
+	if i > 0 {
+		buffer.markers = append(buffer.markers[:0], buffer.markers[i:]...)
+	}
+}
+
+// spillOverflow spills the bytes that adding b overwrites, oldest first
+func (buffer *Buffer) spillOverflow(b []byte, overflow int) {
+	offset := buffer.total - int64(buffer.used)
+	fromRing := overflow
+	if fromRing > buffer.used {
+		fromRing = buffer.used
+	}
+	var err error
+	buffer.ringRead(offset, offset+int64(fromRing), func(p []byte) {
+		if err == nil {
+			err = buffer.spill.write(p, offset)
+			offset += int64(len(p))
 		}
+	})
+	if err == nil && overflow > fromRing {
+		err = buffer.spill.write(b[:overflow-fromRing], offset)
+	}
+	if err != nil {
+		// history is lost, but the ring keeps working
+		buffer.spill.close()
+		buffer.spill = nil
 	}
-	buffer.m.Unlock()
+}
+
+// ringRead calls fn with the ring's bytes between two offsets, with no
+// copying. The offsets should be in the ring.
+func (buffer *Buffer) ringRead(from int64, to int64, fn func([]byte)) {
+	n := int(to - from)
+	if n <= 0 {
+		return
+	}
+	start := buffer.end - int(buffer.total-from)
+	if start < 0 {
+		start += buffer.size
+	}
+	if start+n <= buffer.size {
+		fn(buffer.data[start : start+n])
+		return
+	}
+	fn(buffer.data[start:])
+	fn(buffer.data[:n-(buffer.size-start)])
 }
 
 // Mark adds a new marker in the next buffer position
 func (buffer *Buffer) Mark(id int) {
 	buffer.m.Lock()
-	buffer.markers[id] = buffer.end
+	buffer.deleteMarker(id)
+	// offsets only grow so the markers stay sorted
+	buffer.markers = append(buffer.markers, marker{id, buffer.total})
 	buffer.m.Unlock()
 }
 
+// deleteMarker removes a marker and returns its offset
+func (buffer *Buffer) deleteMarker(id int) (int64, bool) {
+	for i, m := range buffer.markers {
+		if m.id == id {
+			buffer.markers = append(buffer.markers[:i], buffer.markers[i+1:]...)
+			return m.offset, true
+		}
+	}
+	return 0, false
+}
+
 // GetSinceMarker returns a byte slice with all the accumlated data
 // since a given marker id and deltes the marker. If the marker is too ancient
-// cycle or id is -1 then all the buffer's data is returned.
+// cycle or id is -1 then all the data in memory is returned.
 func (buffer *Buffer) GetSinceMarker(id int) []byte {
-	var (
-		r     []byte
-		end   int
-		start int
-	)
 	buffer.m.Lock()
-	if id == -1 || buffer.markers[id] == -1 {
-		// the case when the marker is lost in history, send all the buffer
-		start = buffer.end
-		if start == 0 {
-			end = buffer.size
-		} else {
-			end = start - 1
+	defer buffer.m.Unlock()
+	from := buffer.total - int64(buffer.used)
+	if id != -1 {
+		// markers are for one-use - delete it
+		offset, found := buffer.deleteMarker(id)
+		if found {
+			from = offset
+		}
+	}
+	r := make([]byte, 0, buffer.total-from)
+	buffer.readLocked(from, func(p []byte) error {
+		r = append(r, p...)
+		return nil
+	})
+	return r
+}
+
+// Offset returns the offset of the next byte, the number of bytes added to
+// the buffer since it was created
+func (buffer *Buffer) Offset() int64 {
+	buffer.m.Lock()
+	defer buffer.m.Unlock()
+	return buffer.total
+}
+
+// oldest returns the offset of the oldest byte in the buffer, in memory or
+// spilled
+func (buffer *Buffer) oldest() int64 {
+	buffer.m.Lock()
+	defer buffer.m.Unlock()
+	return buffer.oldestLocked()
+}
+
+func (buffer *Buffer) oldestLocked() int64 {
+	if buffer.spill != nil && buffer.spill.end() > buffer.spill.start() {
+		return buffer.spill.start()
+	}
+	return buffer.total - int64(buffer.used)
+}
+
+// GetSinceOffset returns the data added since a given offset. It returns
+// false when the data since the offset was overwritten or the offset is
+// in the future.
+func (buffer *Buffer) GetSinceOffset(offset int64) ([]byte, bool) {
+	var r []byte
+	ok := buffer.ReadSinceOffset(offset, func(p []byte) error {
+		r = append(r, p...)
+		return nil
+	})
+	if ok && r == nil {
+		r = []byte{}
+	}
+	return r, ok
+}
+
+// ReadSinceOffset calls fn with the data added since a given offset, in
+// chunks, so spilled history doesn't have to fit in memory. The chunks are
+// only valid during the call. It returns false when the data since the
+// offset was overwritten or the offset is in the future.
+func (buffer *Buffer) ReadSinceOffset(offset int64, fn func([]byte) error) bool {
+	buffer.m.Lock()
+	defer buffer.m.Unlock()
+	if offset < buffer.oldestLocked() || offset > buffer.total {
+		return false
+	}
+	buffer.readLocked(offset, fn)
+	return true
+}
+
+// readLocked calls fn with the data from an offset, spilled and in memory.
+// Stops on the first error.
+func (buffer *Buffer) readLocked(from int64, fn func([]byte) error) {
+	ringStart := buffer.total - int64(buffer.used)
+	if from < ringStart && buffer.spill != nil {
+		err := buffer.spill.read(from, fn)
+		if err != nil {
+			return
 		}
-	} else {
-		start = buffer.markers[id]
-		end = buffer.end
 	}
-	for i := start; i != end; i++ {
-		if i == buffer.size {
-			i = 0
+	if from < ringStart {
+		from = ringStart
+	}
+	var err error
+	buffer.ringRead(from, buffer.total, func(p []byte) {
+		if err == nil {
+			err = fn(p)
 		}
-		r = append(r, buffer.data[i])
+	})
+}
+
+// setOffset sets the offset of the next byte, used when restoring a buffer
+func (buffer *Buffer) setOffset(offset int64) {
+	buffer.m.Lock()
+	delta := offset - buffer.total
+	buffer.total = offset
+	for i := range buffer.markers {
+		buffer.markers[i].offset += delta
 	}
-	// markers are for one-use - delete it
-	if id != -1 {
-		delete(buffer.markers, id)
+	if buffer.spill != nil {
+		buffer.spill.shift(delta)
 	}
 	buffer.m.Unlock()
-	return r
+}
+
+// state returns the buffer's state, flushing the spilled history to disk
+func (buffer *Buffer) state() BufferState {
+	buffer.m.Lock()
+	defer buffer.m.Unlock()
+	s := BufferState{
+		Data:    make([]byte, 0, buffer.used),
+		Offset:  buffer.total,
+		Markers: make(map[int]int64, len(buffer.markers)),
+	}
+	buffer.ringRead(buffer.total-int64(buffer.used), buffer.total, func(p []byte) {
+		s.Data = append(s.Data, p...)
+	})
+	for _, m := range buffer.markers {
+		s.Markers[m.id] = m.offset
+	}
+	if buffer.spill != nil {
+		files, err := buffer.spill.state()
+		if err == nil {
+			s.Spill = files
+		}
+	}
+	return s
+}
+
+// restore sets the buffer to a state returned by state(). If the buffer is
+// smaller than the state's data, the oldest data is lost.
+func (buffer *Buffer) restore(s BufferState) {
+	buffer.Add(s.Data)
+	buffer.setOffset(s.Offset)
+	buffer.m.Lock()
+	defer buffer.m.Unlock()
+	buffer.markers = buffer.markers[:0]
+	oldest := buffer.total - int64(buffer.used)
+	if buffer.spill != nil && len(s.Spill) > 0 && len(s.Data) <= buffer.size {
+		buffer.spill.close()
+		if buffer.spill.restore(s.Spill) == nil {
+			oldest = buffer.oldestLocked()
+		}
+	} else {
+		for _, f := range s.Spill {
+			f.remove()
+		}
+	}
+	for id, offset := range s.Markers {
+		if offset >= oldest && offset <= buffer.total {
+			buffer.markers = append(buffer.markers, marker{id, offset})
+		}
+	}
+	sort.Slice(buffer.markers, func(i, j int) bool {
+		return buffer.markers[i].offset < buffer.markers[j].offset
+	})
+}
+
+// Close removes the buffer's spill files
+func (buffer *Buffer) Close() {
+	buffer.m.Lock()
+	defer buffer.m.Unlock()
+	if buffer.spill != nil {
+		buffer.spill.close()
+		buffer.spill = nil
+	}
 }
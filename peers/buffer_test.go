@@ -1,6 +1,11 @@
 package peers
 
 import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -23,3 +28,144 @@ func TestAddMarkRestore(t *testing.T) {
 	require.Equal(t, len(ret), 10)
 	require.Equal(t, ret[0], byte(11))
 }
+
+func TestGetSinceOffset(t *testing.T) {
+	buf := NewBuffer(10)
+	buf.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	require.Equal(t, int64(8), buf.Offset())
+	ret, ok := buf.GetSinceOffset(5)
+	require.True(t, ok)
+	require.Equal(t, []byte{6, 7, 8}, ret)
+	ret, ok = buf.GetSinceOffset(8)
+	require.True(t, ok)
+	require.Empty(t, ret)
+	_, ok = buf.GetSinceOffset(9)
+	require.False(t, ok)
+	// wrap around the ring
+	buf.Add([]byte{9, 10, 11, 12, 13})
+	require.Equal(t, int64(13), buf.Offset())
+	ret, ok = buf.GetSinceOffset(6)
+	require.True(t, ok)
+	require.Equal(t, []byte{7, 8, 9, 10, 11, 12, 13}, ret)
+	ret, ok = buf.GetSinceOffset(3)
+	require.True(t, ok)
+	require.Equal(t, []byte{4, 5, 6, 7, 8, 9, 10, 11, 12, 13}, ret)
+	// overwritten
+	_, ok = buf.GetSinceOffset(2)
+	require.False(t, ok)
+	require.Equal(t, int64(3), buf.oldest())
+}
+
+func TestRestoreOffset(t *testing.T) {
+	buf := NewBuffer(10)
+	buf.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+	other := NewBuffer(10)
+	other.restore(buf.state())
+	require.Equal(t, int64(12), other.Offset())
+	ret, ok := other.GetSinceOffset(9)
+	require.True(t, ok)
+	require.Equal(t, []byte{10, 11, 12}, ret)
+}
+
+func TestMarkerLost(t *testing.T) {
+	buf := NewBuffer(10)
+	buf.Add([]byte{1, 2, 3})
+	buf.Mark(1)
+	buf.Add([]byte{4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14})
+	require.Empty(t, buf.markers)
+	// a lost marker gets all the buffer
+	require.Equal(t, []byte{5, 6, 7, 8, 9, 10, 11, 12, 13, 14},
+		buf.GetSinceMarker(1))
+}
+
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	buf := NewBuffer(1000)
+	buf.SpillTo(dir, 0)
+	var all []byte
+	for i := 0; i < 500; i++ {
+		line := bytes.Repeat([]byte{byte('a' + i%26)}, 300+i)
+		all = append(all, line...)
+		buf.Add(line)
+	}
+	require.Equal(t, int64(len(all)), buf.Offset())
+	require.Equal(t, int64(0), buf.oldest())
+	for _, offset := range []int{0, 12345, len(all) - 1500, len(all) - 10} {
+		ret, ok := buf.GetSinceOffset(int64(offset))
+		require.True(t, ok)
+		require.Equal(t, all[offset:], ret)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "pane-*.z"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	// hand the buffer off
+	other := NewBuffer(1000)
+	other.SpillTo(dir, 0)
+	other.restore(buf.state())
+	ret, ok := other.GetSinceOffset(777)
+	require.True(t, ok)
+	require.Equal(t, all[777:], ret)
+	other.Add([]byte("more"))
+	ret, ok = other.GetSinceOffset(777)
+	require.True(t, ok)
+	require.Equal(t, append(all[777:], "more"...), ret)
+	other.Close()
+	files, err = filepath.Glob(filepath.Join(dir, "pane-*.z"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestSpillRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	buf := NewBuffer(1000)
+	buf.SpillTo(dir, 64*1024)
+	// random data doesn't compress, so the files rotate
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(42)).Read(data)
+	buf.Add(data)
+	require.True(t, buf.oldest() > 0)
+	ret, ok := buf.GetSinceOffset(buf.oldest())
+	require.True(t, ok)
+	require.Equal(t, data[buf.oldest():], ret)
+	_, ok = buf.GetSinceOffset(0)
+	require.False(t, ok)
+	files, err := filepath.Glob(filepath.Join(dir, "pane-*.z"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+}
+
+// benchmarkAdd adds chunks of output to a buffer with a few markers
+func benchmarkAdd(b *testing.B, chunk int) {
+	buf := NewBuffer(DefaultScrollbackSize)
+	for i := 0; i < 10; i++ {
+		buf.Mark(i)
+	}
+	data := bytes.Repeat([]byte("webexec "), chunk/8)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Add(data)
+	}
+}
+
+func BenchmarkAdd64(b *testing.B)   { benchmarkAdd(b, 64) }
+func BenchmarkAdd4096(b *testing.B) { benchmarkAdd(b, 4096) }
+
+func BenchmarkAddSpill(b *testing.B) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	buf := NewBuffer(DefaultScrollbackSize)
+	buf.SpillTo(dir, 0)
+	defer buf.Close()
+	data := bytes.Repeat([]byte("webexec "), 512)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Add(data)
+	}
+}
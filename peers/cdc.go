@@ -4,7 +4,6 @@
 package peers
 
 import (
-	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
@@ -14,6 +13,8 @@ import (
 
 // NAckArgs is a type that holds the args for an error message
 type NAckArgs struct {
+	// Code is the machine readable error code, one of the Code constants
+	Code string `json:"code"`
 	// Desc hold the textual desciption of the error
 	Desc string `json:"desc"`
 	// Ref holds the message id the error refers to or 0 for system errors
@@ -28,14 +29,21 @@ type RestoreArgs struct {
 // AckArgs is a type to hold the args for an Ack message
 type AckArgs struct {
 	// Ref holds the message id the error refers to or 0 for system errors
-	Ref  int             `json:"ref"`
-	Body json.RawMessage `json:"body"`
+	Ref  int     `json:"ref"`
+	Body RawJSON `json:"body"`
+}
+
+// ackReply holds the args of the acks webexec sends. The body is any value
+// the peer's encoding can marshal.
+type ackReply struct {
+	Ref  int         `json:"ref"`
+	Body interface{} `json:"body"`
 }
 
 // SetPayloadArgs is a type to hold the args for a set_payload type of a message
 type SetPayloadArgs struct {
 	// Ref holds the message id the error refers to or 0 for system errors
-	Payload json.RawMessage `json:"payload"`
+	Payload RawJSON `json:"payload"`
 }
 
 // ResizeArgs is a type that holds the argumnet to the resize pty command
@@ -46,17 +54,158 @@ type ResizeArgs struct {
 	Sy     uint16 `json:"sy"`
 }
 
+func (a *ResizeArgs) Validate() error {
+	if a.PaneID <= 0 {
+		return fmt.Errorf("pane_id is required")
+	}
+	if a.Sx == 0 || a.Sy == 0 {
+		return fmt.Errorf("sx & sy should be positive")
+	}
+	return nil
+}
+
 type AddPaneArgs struct {
 	Command []string `json:"command"`
-	Rows    uint16   `json:"rows, omitempty"`
-	Cols    uint16   `json:"cols, omitempty"`
-	X       uint16   `json:"x, omitempty"`
-	Y       uint16   `json:"y, omitempty"`
+	Rows    uint16   `json:"rows,omitempty"`
+	Cols    uint16   `json:"cols,omitempty"`
+	X       uint16   `json:"x,omitempty"`
+	Y       uint16   `json:"y,omitempty"`
 	Parent  int      `json:"parent,omitempty"`
+	// Pipe runs the command with no pty, connecting its stdin, stdout &
+	// stderr to pipes
+	Pipe bool `json:"pipe,omitempty"`
+	// Offsets asks to prefix each message with the pane's output offset
+	Offsets bool `json:"offsets,omitempty"`
+	// Mux streams the pane on the mux channel instead of a data channel
+	Mux bool `json:"mux,omitempty"`
+	// Compression is the compression of the pane's output, one of
+	// Compressions or empty for none
+	Compression string `json:"compression,omitempty"`
+	// Mode is ModeScreen to sync the pane's screen instead of streaming its
+	// output, ModeRaw or empty for the output
+	Mode string `json:"mode,omitempty"`
+	// Cwd is the command's working directory, an absolute path or one
+	// starting with ~. It defaults to the parent pane's or the user's home.
+	Cwd string `json:"cwd,omitempty"`
+	// Env overrides the command's environment, i.e. the client's LANG, TZ
+	// & TERM
+	Env map[string]string `json:"env,omitempty"`
+	// InheritEnv is the environment the command starts with before Env is
+	// applied, one of InheritAll, InheritConf or InheritNone
+	InheritEnv string `json:"inherit_env,omitempty"`
+	// Profile is the name of a profile to launch instead of a command
+	Profile string `json:"profile,omitempty"`
+	// Exclusive locks the pane's input to one peer at a time, starting
+	// with the peer that added it
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+func (a *AddPaneArgs) Validate() error {
+	if a.Profile != "" {
+		if len(a.Command) > 0 {
+			return fmt.Errorf("command & profile can not be used together")
+		}
+	} else if len(a.Command) == 0 || a.Command[0] == "" {
+		return fmt.Errorf("command or profile is required")
+	}
+	if a.Parent < 0 {
+		return fmt.Errorf("parent should be a pane id")
+	}
+	if a.Mode == ModeScreen && a.Pipe {
+		return fmt.Errorf("pipe panes have no screen")
+	}
+	err := validateMode(a.Mode, a.Offsets, a.Compression)
+	if err != nil {
+		return err
+	}
+	err = validateEnv(a.Env)
+	if err != nil {
+		return err
+	}
+	err = validateInheritEnv(a.InheritEnv)
+	if err != nil {
+		return err
+	}
+	return validateCompression(a.Compression)
+}
+
+// CloseStdinArgs is a type that holds the args for a close_stdin message
+type CloseStdinArgs struct {
+	PaneID int `json:"pane_id"`
+}
+
+func (a *CloseStdinArgs) Validate() error {
+	return validatePaneID(a.PaneID, "pane_id")
 }
 
 type ReconnectPaneArgs struct {
 	ID int `json:"id"`
+	// Offset, when set, is the offset of the first byte the client is
+	// missing
+	Offset *int64 `json:"offset,omitempty"`
+	// Offsets asks to prefix each message with the pane's output offset
+	Offsets bool `json:"offsets,omitempty"`
+	// Mux streams the pane on the mux channel instead of a data channel
+	Mux bool `json:"mux,omitempty"`
+	// Compression is the compression of the pane's output, one of
+	// Compressions or empty for none
+	Compression string `json:"compression,omitempty"`
+	// Mode is ModeScreen to sync the pane's screen instead of streaming its
+	// output, ModeRaw or empty for the output
+	Mode string `json:"mode,omitempty"`
+	// ReadOnly attaches the client as a viewer, its input is dropped
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+func (a *ReconnectPaneArgs) Validate() error {
+	if a.Offset != nil && *a.Offset < 0 {
+		return fmt.Errorf("offset should not be negative")
+	}
+	if a.Mode == ModeScreen && a.Offset != nil {
+		return fmt.Errorf("screen mode can not resume from an offset")
+	}
+	err := validateMode(a.Mode, a.Offsets, a.Compression)
+	if err != nil {
+		return err
+	}
+	err = validateCompression(a.Compression)
+	if err != nil {
+		return err
+	}
+	return validatePaneID(a.ID, "id")
+}
+
+// GetPaneArgs is a type that holds the args for a get_pane message
+type GetPaneArgs struct {
+	ID int `json:"id"`
+}
+
+func (a *GetPaneArgs) Validate() error {
+	return validatePaneID(a.ID, "id")
+}
+
+func validatePaneID(id int, field string) error {
+	if id <= 0 {
+		return fmt.Errorf("%s is required", field)
+	}
+	return nil
+}
+
+// PaneStatus holds the state of a pane. It is used as the args of a
+// pane_exited message and as the body of a get_pane ack
+type PaneStatus struct {
+	PaneID    int  `json:"pane_id"`
+	IsRunning bool `json:"is_running"`
+	// ExitCode is -1 when the command was terminated by a signal
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+	// EndTime is in msec since EPOCH, 0 while the command is running
+	EndTime int64 `json:"end_time,omitempty"`
+	// Offset is the number of bytes the pane sent since it started
+	Offset int64 `json:"offset"`
+	// Compression holds the stats of the pane's compressed output, nil
+	// when none of its clients use compression
+	Compression *CompressionStats `json:"compression,omitempty"`
 }
 
 // CTRLMessage type holds control messages passed over the control channel
@@ -71,19 +220,25 @@ type CTRLMessage struct {
 var msgIDM sync.Mutex
 
 // SendCTRLMsg sends a control message to a peer.
-// The message is compose from a type and args
+// The message is compose from a type and args and encoded with the peer's
+// encoding
 func SendCTRLMsg(peer *Peer, typ string, args interface{}) error {
+	cdc := peer.controlChannel()
+	if cdc == nil {
+		return fmt.Errorf("peer %d has no control channel", peer.ID)
+	}
 	msgIDM.Lock()
 	peer.LastRef++
 	msg := CTRLMessage{time.Now().UnixNano() / 1000000, peer.LastRef,
 		typ, args}
 	msgIDM.Unlock()
-	msgJ, err := json.Marshal(msg)
+	enc := peer.encoding()
+	b, err := enc.marshal(msg)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal the ack msg: %e\n   msg == %q", err, msg)
 	}
-	peer.logger.Infof("Sending ctrl message: %s", msgJ)
-	return peer.cdc.Send(msgJ)
+	peer.logger.Infof("Sending ctrl message: %s", enc.format(b))
+	return cdc.Send(b)
 }
 
 // ParseWinsize gets a string in the format of "24x80" and returns a Winsize
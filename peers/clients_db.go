@@ -4,16 +4,59 @@ package peers
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
 
+// MaxBufferedAmount is how much output a data channel can buffer before its
+// client's messages are queued
+const MaxBufferedAmount = 1024 * 1024
+
+// MaxQueued is how much output a client can fall behind before its queue is
+// dropped and replaced with a screen snapshot
+const MaxQueued = 4 * 1024 * 1024
+
+// lowBufferedAmount is when a data channel is ready for more messages
+const lowBufferedAmount = 256 * 1024
+
+// Channel carries a pane's output to a client and the client's input to
+// the pane. It's either a data channel of its own or a stream on the peer's
+// mux channel.
+type Channel interface {
+	Send(data []byte) error
+	ReadyState() webrtc.DataChannelState
+	BufferedAmount() uint64
+	SetBufferedAmountLowThreshold(th uint64)
+	OnBufferedAmountLow(f func())
+	OnMessage(f func(msg webrtc.DataChannelMessage))
+	OnClose(f func())
+	Close() error
+}
+
 // Client ties together the dta channel, its peer and the pane
 type Client struct {
-	dc   *webrtc.DataChannel
+	dc   Channel
 	pane *Pane
 	peer *Peer
 	id   int
+	// offsets is true when each message is prefixed with the pane's offset
+	offsets bool
+	// sync, when set, sends the pane's screen instead of its output
+	sync *syncClient
+	// readOnly is true when the client's input is dropped
+	readOnly       bool
+	lastDropReport time.Time
+	// queue holds the messages waiting for the data channel to drain
+	queue  [][]byte
+	queued int
+	qm     sync.Mutex
+	// sm keeps the messages in order when flushing
+	sm sync.Mutex
+	// wake is signaled when there's a message or the data channel drained
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // ClientsDB represents a data channels data base
@@ -28,14 +71,48 @@ func NewClientsDB() *ClientsDB {
 	return &ClientsDB{clients: make(map[int]*Client)}
 }
 
-// Add adds a Client to the db
-func (db *ClientsDB) Add(dc *webrtc.DataChannel, pane *Pane, peer *Peer) *Client {
+// Add adds a Client to the db. A read only client's input is dropped, it's
+// also read only when its peer's policy is.
+func (db *ClientsDB) Add(dc Channel, pane *Pane, peer *Peer, offsets bool, readOnly bool) *Client {
+	return db.add(dc, pane, peer, offsets, false, readOnly)
+}
+
+// AddSync adds a Client in screen sync mode to the db
+func (db *ClientsDB) AddSync(dc Channel, pane *Pane, peer *Peer, readOnly bool) *Client {
+	return db.add(dc, pane, peer, false, true, readOnly)
+}
+
+func (db *ClientsDB) add(dc Channel, pane *Pane, peer *Peer, offsets bool, screen bool, readOnly bool) *Client {
+	readOnly = peer.clientReadOnly(readOnly)
 	db.m.Lock()
-	defer db.m.Unlock()
 	id := db.lastID
 	db.lastID++
-	c := &Client{dc, pane, peer, id}
+	c := &Client{
+		dc:       dc,
+		pane:     pane,
+		peer:     peer,
+		id:       id,
+		offsets:  offsets,
+		readOnly: readOnly,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if screen {
+		c.sync = newSyncClient(c)
+	}
 	db.clients[id] = c
+	db.m.Unlock()
+	if c.sync != nil {
+		go c.sync.run()
+	} else {
+		dc.SetBufferedAmountLowThreshold(lowBufferedAmount)
+		dc.OnBufferedAmountLow(c.signal)
+		go c.writer()
+	}
+	pane.server.emit(ClientAttachedEvent{Pane: pane, Peer: peer})
+	if pane.driver != nil {
+		pane.driver.attached(peer)
+	}
 	return c
 }
 
@@ -75,13 +152,129 @@ func (db *ClientsDB) All4Pane(pane *Pane) []*Client {
 // Delete removes a client from the database
 func (db *ClientsDB) Delete(c *Client) error {
 	db.m.Lock()
-	defer db.m.Unlock()
-
 	for k, v := range db.clients {
-		if v.dc.ID() == c.dc.ID() && v.pane.ID == c.pane.ID {
+		if v.dc == c.dc && v.pane.ID == c.pane.ID {
 			delete(db.clients, k)
+			db.m.Unlock()
+			v.stop()
+			v.pane.server.emit(ClientDetachedEvent{Pane: v.pane, Peer: v.peer})
+			if v.pane.driver != nil {
+				v.pane.driver.detached(v.peer)
+			}
 			return nil
 		}
 	}
+	db.m.Unlock()
 	return fmt.Errorf("Failed to delete as data channel not found: %v", c)
 }
+
+// enqueue adds a message to the client's queue. It returns false when the
+// client is too far behind.
+func (c *Client) enqueue(m []byte) bool {
+	c.qm.Lock()
+	defer c.qm.Unlock()
+	if c.queued+len(m) > MaxQueued {
+		return false
+	}
+	c.queue = append(c.queue, m)
+	c.queued += len(m)
+	c.signal()
+	return true
+}
+
+// reset drops the client's queue and queues m instead, if it's not nil
+func (c *Client) reset(m []byte) {
+	c.qm.Lock()
+	defer c.qm.Unlock()
+	c.queue = nil
+	c.queued = 0
+	if m != nil {
+		c.queue = append(c.queue, m)
+		c.queued = len(m)
+		c.signal()
+	}
+}
+
+// pop removes and returns the first message in the queue
+func (c *Client) pop() []byte {
+	c.qm.Lock()
+	defer c.qm.Unlock()
+	if len(c.queue) == 0 {
+		return nil
+	}
+	m := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	c.queued -= len(m)
+	return m
+}
+
+// report sends an error to the client, in an error frame on a mux stream or
+// in a nack on the control channel
+func (c *Client) report(code string, desc string) {
+	d := c.dc
+	if cc, ok := d.(*compressedChannel); ok {
+		d = cc.Channel
+	}
+	if s, ok := d.(*muxStream); ok {
+		s.mux.sendError(s.paneID, ctrlErrorf(code, "%s", desc))
+		return
+	}
+	err := SendCTRLMsg(c.peer, "nack", &NAckArgs{Code: code, Desc: desc})
+	if err != nil {
+		c.peer.logger.Warnf("@%d: failed to report an error: %s", c.pane.ID, err)
+	}
+}
+
+// signal wakes the writer, if it's not awake
+func (c *Client) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops the client's writer
+func (c *Client) stop() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// writer sends the queued messages as long as the data channel doesn't
+// buffer too much, waiting for it to drain when it does
+func (c *Client) writer() {
+	for {
+		select {
+		case <-c.wake:
+		case <-c.done:
+			return
+		}
+		c.sm.Lock()
+		for c.dc.BufferedAmount() <= MaxBufferedAmount && c.sendNext() {
+		}
+		c.sm.Unlock()
+	}
+}
+
+// sendNext sends the next message in the queue, returning false when the
+// queue is empty
+func (c *Client) sendNext() bool {
+	m := c.pop()
+	if m == nil {
+		return false
+	}
+	err := c.dc.Send(m)
+	if err != nil && c.peer != nil {
+		c.peer.logger.Errorf("got an error when sending message: %v", err)
+	}
+	return true
+}
+
+// flush stops the writer and sends all the queued messages, used before
+// closing the data channel
+func (c *Client) flush() {
+	c.stop()
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	for c.sendNext() {
+	}
+}
@@ -10,3 +10,41 @@ func TestClientsDB(t *testing.T) {
 	db := NewClientsDB()
 	require.NotNil(t, db)
 }
+
+func TestClientQueue(t *testing.T) {
+	c := &Client{wake: make(chan struct{}, 1), done: make(chan struct{})}
+	require.True(t, c.enqueue([]byte("hello")))
+	require.True(t, c.enqueue(make([]byte, MaxQueued-5)))
+	// the client is too far behind
+	require.False(t, c.enqueue([]byte("!")))
+	c.reset([]byte("screen"))
+	require.Equal(t, 6, c.queued)
+	require.True(t, c.enqueue([]byte("!")))
+	require.Equal(t, []byte("screen"), c.pop())
+	require.Equal(t, []byte("!"), c.pop())
+	require.Nil(t, c.pop())
+	require.Equal(t, 0, c.queued)
+}
+
+// stalledChannel is a data channel that never drains
+type stalledChannel struct {
+	fakeChannel
+}
+
+func (s *stalledChannel) BufferedAmount() uint64 { return MaxBufferedAmount + 1 }
+
+func TestSlowPipeClient(t *testing.T) {
+	peer := newTestPeer(t, nil)
+	pane := newPane(peer, nil)
+	pane.pipe = true
+	c := pane.server.cdb.Add(&stalledChannel{}, pane, peer, false, false)
+	defer c.stop()
+	m := make([]byte, MaxQueued/2)
+	m[0] = StdoutTag
+	pane.send(m)
+	pane.send(m)
+	require.Len(t, pane.server.cdb.All4Pane(pane), 1)
+	// with no screen to redraw, the client is disconnected
+	pane.send(m)
+	require.Empty(t, pane.server.cdb.All4Pane(pane))
+}
@@ -0,0 +1,90 @@
+// This file holds the coalescing of the panes' output. Programs that print
+// a character at a time would otherwise send a tiny message for each.
+package peers
+
+import (
+	"time"
+)
+
+// DefaultCoalesceWindow is how long a pane's output is collected into one
+// message when the configuration doesn't set CoalesceWindow
+const DefaultCoalesceWindow = 5 * time.Millisecond
+
+// DefaultMaxMessageSize is the size of the largest coalesced message when the
+// configuration doesn't set MaxMessageSize
+const DefaultMaxMessageSize = 16384
+
+// coalescer merges a pane's output that comes in bursts. Output that comes
+// after the pane was quiet for a window, i.e. a keystroke's echo, is sent
+// right away. Output that follows it within the window is collected and
+// sent when the window ends or the message reaches its maximum size.
+type coalescer struct {
+	window time.Duration
+	max    int
+	// pipe is true when each message starts with a stream tag. Messages
+	// are merged only with messages of the same stream.
+	pipe    bool
+	send    func([]byte)
+	pending []byte
+	// last is when the last message was sent
+	last time.Time
+}
+
+// newCoalescer returns a coalescer for the pane's output, with the window
+// & max size from the configuration. A negative window disables coalescing.
+func (pane *Pane) newCoalescer() *coalescer {
+	c := &coalescer{
+		window: pane.peer.Conf.CoalesceWindow,
+		max:    pane.peer.Conf.MaxMessageSize,
+		pipe:   pane.pipe,
+		send:   pane.send,
+	}
+	if c.window == 0 {
+		c.window = DefaultCoalesceWindow
+	}
+	if c.max == 0 {
+		c.max = DefaultMaxMessageSize
+	}
+	return c
+}
+
+// add sends a message or adds it to the pending output. It returns true
+// when there's pending output that should be flushed once the window ends.
+func (c *coalescer) add(m []byte, now time.Time) bool {
+	if c.window <= 0 {
+		c.send(m)
+		return false
+	}
+	if c.pending == nil && now.Sub(c.last) >= c.window {
+		c.send(m)
+		c.last = now
+		return false
+	}
+	if c.pending != nil && (len(c.pending)+len(m) > c.max ||
+		(c.pipe && c.pending[0] != m[0])) {
+		c.flush(now)
+	}
+	if c.pending == nil {
+		c.pending = make([]byte, 0, c.max)
+		c.pending = append(c.pending, m...)
+	} else if c.pipe {
+		c.pending = append(c.pending, m[1:]...)
+	} else {
+		c.pending = append(c.pending, m...)
+	}
+	if len(c.pending) >= c.max {
+		c.flush(now)
+		return false
+	}
+	return true
+}
+
+// flush sends the pending output
+func (c *coalescer) flush(now time.Time) {
+	if c.pending == nil {
+		return
+	}
+	c.send(c.pending)
+	c.pending = nil
+	c.last = now
+}
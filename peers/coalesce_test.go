@@ -0,0 +1,84 @@
+package peers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCoalescer returns a coalescer that records the messages it sends
+func newTestCoalescer(window time.Duration, pipe bool) (*coalescer, *[]string) {
+	var sent []string
+	c := &coalescer{window: window, max: 16, pipe: pipe,
+		send: func(m []byte) { sent = append(sent, string(m)) }}
+	return c, &sent
+}
+
+func TestCoalescer(t *testing.T) {
+	c, sent := newTestCoalescer(5*time.Millisecond, false)
+	now := time.Now()
+	// the first message after a quiet period is sent right away
+	require.False(t, c.add([]byte("l"), now))
+	require.Equal(t, []string{"l"}, *sent)
+	// the rest of the burst waits for the window to end
+	require.True(t, c.add([]byte("s"), now.Add(time.Millisecond)))
+	require.True(t, c.add([]byte(" -l"), now.Add(2*time.Millisecond)))
+	require.Len(t, *sent, 1)
+	c.flush(now.Add(6 * time.Millisecond))
+	require.Equal(t, []string{"l", "s -l"}, *sent)
+	// or until the message is full
+	later := now.Add(7 * time.Millisecond)
+	require.True(t, c.add([]byte("0123456789"), later))
+	require.False(t, c.add([]byte("abcdef"), later))
+	require.Equal(t, "0123456789abcdef", (*sent)[2])
+	// keystrokes after a quiet period are sent right away
+	require.False(t, c.add([]byte("x"), later.Add(time.Second)))
+	require.Equal(t, "x", (*sent)[3])
+}
+
+func TestCoalescerPipe(t *testing.T) {
+	c, sent := newTestCoalescer(5*time.Millisecond, true)
+	now := time.Now()
+	c.add([]byte{StdoutTag, 'a'}, now)
+	c.add([]byte{StdoutTag, 'b'}, now)
+	c.add([]byte{StdoutTag, 'c'}, now)
+	// a different stream isn't merged
+	c.add([]byte{StderrTag, 'd'}, now)
+	c.flush(now)
+	require.Equal(t, []string{"\x01a", "\x01bc", "\x02d"}, *sent)
+}
+
+func TestCoalescerOff(t *testing.T) {
+	c, sent := newTestCoalescer(-1, false)
+	now := time.Now()
+	for _, m := range []string{"a", "b", "c"} {
+		require.False(t, c.add([]byte(m), now))
+	}
+	require.Equal(t, []string{"a", "b", "c"}, *sent)
+}
+
+// benchmarkCoalescer feeds the coalescer a program that prints a character
+// every 100µs, reporting the messages sent for each 1000 characters
+func benchmarkCoalescer(b *testing.B, window time.Duration) {
+	messages := 0
+	c := &coalescer{window: window, max: DefaultMaxMessageSize,
+		send: func([]byte) { messages++ }}
+	now := time.Now()
+	var flushAt time.Time
+	for i := 0; i < b.N; i++ {
+		now = now.Add(100 * time.Microsecond)
+		if !flushAt.IsZero() && !now.Before(flushAt) {
+			c.flush(now)
+			flushAt = time.Time{}
+		}
+		if c.add([]byte{'x'}, now) && flushAt.IsZero() {
+			flushAt = now.Add(c.window)
+		}
+	}
+	c.flush(now)
+	b.ReportMetric(float64(messages)*1000/float64(b.N), "msgs/1000chars")
+}
+
+func BenchmarkCoalesceOff(b *testing.B) { benchmarkCoalescer(b, -1) }
+func BenchmarkCoalesce(b *testing.B)    { benchmarkCoalescer(b, DefaultCoalesceWindow) }
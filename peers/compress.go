@@ -0,0 +1,140 @@
+// This file holds the compression of the panes' output. Each client asks
+// for its own compression when it attaches to a pane and keeps its own
+// compression state, so a pane's clients can use different compressions.
+package peers
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions is the list of output compressions clients can ask for
+var Compressions = []string{"deflate", "zstd"}
+
+// validateCompression returns an error for unsupported compressions
+func validateCompression(name string) error {
+	if name != "" && !Contains(Compressions, name) {
+		return fmt.Errorf("unsupported compression %q", name)
+	}
+	return nil
+}
+
+// CompressionStats holds how much of a pane's output was compressed and to
+// how many bytes, summed over the pane's clients that use compression
+type CompressionStats struct {
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+	// Ratio is Out / In
+	Ratio float64 `json:"ratio"`
+}
+
+// PaneAck is the body of the add_pane & reconnect_pane acks of clients that
+// ask for compression
+type PaneAck struct {
+	ID int `json:"id"`
+	// Compression holds the stats of the pane's compressed output, nil
+	// when none was sent yet
+	Compression *CompressionStats `json:"compression,omitempty"`
+}
+
+// paneAck returns the body of an add_pane or reconnect_pane ack, the pane's
+// id or a PaneAck when the client asked for compression
+func paneAck(pane *Pane, compression string) interface{} {
+	if compression == "" {
+		return pane.ID
+	}
+	return &PaneAck{ID: pane.ID, Compression: pane.compression.stats()}
+}
+
+// compressionCounters count a pane's compressed bytes
+type compressionCounters struct {
+	in  int64
+	out int64
+}
+
+func (c *compressionCounters) add(in int, out int) {
+	atomic.AddInt64(&c.in, int64(in))
+	atomic.AddInt64(&c.out, int64(out))
+}
+
+// stats returns the counters' stats, nil when nothing was compressed
+func (c *compressionCounters) stats() *CompressionStats {
+	in := atomic.LoadInt64(&c.in)
+	if in == 0 {
+		return nil
+	}
+	out := atomic.LoadInt64(&c.out)
+	return &CompressionStats{In: in, Out: out, Ratio: float64(out) / float64(in)}
+}
+
+// compressor is a streaming compressor, both flate & zstd writers are
+type compressor interface {
+	io.Writer
+	Flush() error
+}
+
+// compressedChannel compresses the messages sent on a channel. The
+// messages are parts of a single deflate or zstd stream, each ending with a
+// flush, so the client can decompress each message as it arrives.
+type compressedChannel struct {
+	Channel
+	m        sync.Mutex
+	buf      bytes.Buffer
+	w        compressor
+	counters *compressionCounters
+}
+
+// compress returns a channel that compresses the messages it sends to d, or
+// d when no compression is asked for
+func (pane *Pane) compress(d Channel, compression string) (Channel, error) {
+	if compression == "" {
+		return d, nil
+	}
+	c := &compressedChannel{Channel: d, counters: &pane.compression}
+	// terminal output compresses well even at the fastest level
+	switch compression {
+	case "deflate":
+		w, err := flate.NewWriter(&c.buf, flate.BestSpeed)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create a deflate writer: %s", err)
+		}
+		c.w = w
+	case "zstd":
+		// with no concurrency the messages are compressed as they're sent
+		w, err := zstd.NewWriter(&c.buf,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create a zstd writer: %s", err)
+		}
+		c.w = w
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %q", compression)
+	}
+	return c, nil
+}
+
+// Send compresses a message and sends it
+func (c *compressedChannel) Send(data []byte) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.buf.Reset()
+	_, err := c.w.Write(data)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to compress a message: %s", err)
+	}
+	m := append([]byte{}, c.buf.Bytes()...)
+	c.counters.add(len(data), len(m))
+	// sent under the lock so the messages are sent in the order they were
+	// compressed
+	return c.Channel.Send(m)
+}
@@ -0,0 +1,64 @@
+package peers
+
+import (
+	"compress/flate"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedChannel(t *testing.T) {
+	line := strings.Repeat("drwxr-xr-x  2 user user 4096 Jan  1 00:00 dir\r\n", 20)
+	for _, compression := range Compressions {
+		pane := &Pane{ID: 1}
+		f := &fakeChannel{}
+		d, err := pane.compress(f, compression)
+		require.NoError(t, err)
+		require.Equal(t, 1, paneAck(pane, compression).(*PaneAck).ID)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, d.Send([]byte(line)))
+		}
+		require.Len(t, f.sent, 3)
+		// each message decompresses as it arrives
+		pr, pw := io.Pipe()
+		var r io.Reader
+		if compression == "zstd" {
+			r, err = zstd.NewReader(pr)
+			require.NoError(t, err)
+		} else {
+			r = flate.NewReader(pr)
+		}
+		for _, m := range f.sent {
+			go pw.Write(m)
+			b := make([]byte, len(line))
+			_, err := io.ReadFull(r, b)
+			require.NoError(t, err, compression)
+			require.Equal(t, line, string(b), compression)
+		}
+		stats := paneAck(pane, compression).(*PaneAck).Compression
+		require.NotNil(t, stats)
+		require.Equal(t, int64(3*len(line)), stats.In)
+		require.Less(t, stats.Ratio, 0.1, compression)
+	}
+	// no compression, no wrapping
+	pane := &Pane{ID: 1}
+	f := &fakeChannel{}
+	d, err := pane.compress(f, "")
+	require.NoError(t, err)
+	require.Equal(t, Channel(f), d)
+	require.Equal(t, 1, paneAck(pane, ""))
+	_, err = pane.compress(f, "lz4")
+	require.Error(t, err)
+}
+
+func TestValidateCompression(t *testing.T) {
+	a := AddPaneArgs{Command: []string{"bash"}, Compression: "deflate"}
+	require.NoError(t, a.Validate())
+	a.Compression = "zip"
+	require.Error(t, a.Validate())
+	r := ReconnectPaneArgs{ID: 1, Compression: "zip"}
+	require.Error(t, r.Validate())
+}
@@ -0,0 +1,502 @@
+// This file holds the handlers of the control messages. Each message's args
+// are parsed & validated before its handler runs and each message gets
+// exactly one ack or nack.
+package peers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/creack/pty"
+	"github.com/pion/webrtc/v3"
+	"github.com/riywo/loginshell"
+)
+
+// The codes of the errors sent in nacks
+const (
+	CodeInvalidMessage     = "invalid_message"
+	CodeUnknownType        = "unknown_type"
+	CodeInvalidArgs        = "invalid_args"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodePaneNotFound       = "pane_not_found"
+	CodePaneNotRunning     = "pane_not_running"
+	CodeNoTTY              = "no_tty"
+	CodeNoPipe             = "no_pipe"
+	CodeNoMux              = "no_mux"
+	CodeInvalidCwd         = "invalid_cwd"
+	CodeProfileNotFound    = "profile_not_found"
+	CodeSpawnFailed        = "spawn_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeReadOnly           = "read_only"
+	CodeNotDriver          = "not_driver"
+	CodeControlTimeout     = "control_timeout"
+	CodeTooSlow            = "too_slow"
+	CodeInternal           = "internal"
+)
+
+// CTRLError is an error sent to the client in a nack
+type CTRLError struct {
+	Code string
+	Desc string
+}
+
+func (e *CTRLError) Error() string {
+	return e.Desc
+}
+
+// ctrlErrorf returns a CTRLError with a formatted description
+func ctrlErrorf(code string, format string, a ...interface{}) error {
+	return &CTRLError{Code: code, Desc: fmt.Sprintf(format, a...)}
+}
+
+// validator is implemented by args that have constraints beyond their types
+type validator interface {
+	Validate() error
+}
+
+// errNoReply is returned by handlers that reply themselves, i.e. once a
+// data channel opens
+var errNoReply = errors.New("the handler replies")
+
+// ctrlReply sends the reply to a control message, ensuring there's only one
+type ctrlReply struct {
+	peer *Peer
+	m    CTRLMessage
+	once sync.Once
+}
+
+// send sends an ack with the body or, if err is not nil, a nack
+func (r *ctrlReply) send(body interface{}, err error) {
+	r.once.Do(func() {
+		var sendErr error
+		if err == nil {
+			sendErr = r.peer.SendAck(r.m, body)
+		} else {
+			code := CodeInternal
+			var ce *CTRLError
+			if errors.As(err, &ce) {
+				code = ce.Code
+			}
+			r.peer.logger.Warnf("Nacking %q message %d: %s", r.m.Type, r.m.Ref, err)
+			sendErr = r.peer.SendNack(r.m, code, err.Error())
+		}
+		if sendErr != nil {
+			r.peer.logger.Errorf("#%s: Failed to send [n]ack: %v", r.peer.FP, sendErr)
+		}
+	})
+}
+
+// ctrlHandler is the declaration of a control message: its args and the
+// function that handles it
+type ctrlHandler struct {
+	// args returns the value to parse the args to, nil when the message
+	// has no args
+	args func() interface{}
+	// handle returns the body of the ack or an error for the nack.
+	// Handlers that reply later return errNoReply and use r.
+	handle func(peer *Peer, args interface{}, r *ctrlReply) (interface{}, error)
+}
+
+// ctrlHandlers holds the control messages by type. It's set in init as the
+// handlers refer to it.
+var ctrlHandlers map[string]ctrlHandler
+
+func init() {
+	ctrlHandlers = map[string]ctrlHandler{
+		"hello": {
+			args: func() interface{} { return &HelloArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onHello(a.(*HelloArgs), r)
+			},
+		},
+		"resize": {
+			args: func() interface{} { return &ResizeArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onResize(a.(*ResizeArgs))
+			},
+		},
+		"restore": {
+			args: func() interface{} { return &RestoreArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				peer.Marker = a.(*RestoreArgs).Marker
+				return RawJSON(peer.server.GetPayload()), nil
+			},
+		},
+		"get_payload": {
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return RawJSON(peer.server.GetPayload()), nil
+			},
+		},
+		"set_payload": {
+			args: func() interface{} { return &SetPayloadArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				payload := a.(*SetPayloadArgs).Payload
+				peer.logger.Infof("Setting payload to: %s", payload)
+				peer.server.SetPayload(payload)
+				return payload, nil
+			},
+		},
+		"mark": {
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onMark()
+			},
+		},
+		"get_pane": {
+			args: func() interface{} { return &GetPaneArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onGetPane(a.(*GetPaneArgs))
+			},
+		},
+		"close_stdin": {
+			args: func() interface{} { return &CloseStdinArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onCloseStdin(a.(*CloseStdinArgs))
+			},
+		},
+		"reconnect_pane": {
+			args: func() interface{} { return &ReconnectPaneArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onReconnectPane(a.(*ReconnectPaneArgs), r)
+			},
+		},
+		"add_pane": {
+			args: func() interface{} { return &AddPaneArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onAddPane(a.(*AddPaneArgs), r)
+			},
+		},
+		"request_control": {
+			args: func() interface{} { return &ControlArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onRequestControl(a.(*ControlArgs), r)
+			},
+		},
+		"grant_control": {
+			args: func() interface{} { return &GrantControlArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onGrantControl(a.(*GrantControlArgs))
+			},
+		},
+		"release_control": {
+			args: func() interface{} { return &ControlArgs{} },
+			handle: func(peer *Peer, a interface{}, r *ctrlReply) (interface{}, error) {
+				return peer.onReleaseControl(a.(*ControlArgs))
+			},
+		},
+	}
+}
+
+// handleCTRLMsg validates a control message's args, runs its handler and
+// replies. raw holds the args, encoded with enc.
+func (peer *Peer) handleCTRLMsg(m CTRLMessage, enc *encoding, raw []byte) {
+	r := &ctrlReply{peer: peer, m: m}
+	h, found := ctrlHandlers[m.Type]
+	if !found {
+		r.send(nil, ctrlErrorf(CodeUnknownType, "Unknown message type: %q", m.Type))
+		return
+	}
+	err := peer.authorize(m.Type)
+	if err != nil {
+		r.send(nil, err)
+		return
+	}
+	var args interface{}
+	if h.args != nil {
+		args = h.args()
+		err = parseArgs(enc, raw, args)
+		if err != nil {
+			r.send(nil, err)
+			return
+		}
+	}
+	body, err := h.handle(peer, args, r)
+	if err != errNoReply {
+		r.send(body, err)
+	}
+}
+
+// parseArgs parses and validates a message's args
+func parseArgs(enc *encoding, raw []byte, args interface{}) error {
+	if enc.isNull(raw) {
+		return ctrlErrorf(CodeInvalidArgs, "Missing args")
+	}
+	err := enc.unmarshal(raw, args)
+	if err != nil {
+		return ctrlErrorf(CodeInvalidArgs, "Failed to parse args: %s", err)
+	}
+	if v, ok := args.(validator); ok {
+		err = v.Validate()
+		if err != nil {
+			return ctrlErrorf(CodeInvalidArgs, "Invalid args: %s", err)
+		}
+	}
+	return nil
+}
+
+// getPane returns a pane or a pane_not_found error
+func (peer *Peer) getPane(id int) (*Pane, error) {
+	pane := peer.server.Panes.Get(id)
+	if pane == nil {
+		return nil, ctrlErrorf(CodePaneNotFound, "Unknown pane: %d", id)
+	}
+	return pane, nil
+}
+
+func (peer *Peer) onResize(a *ResizeArgs) (interface{}, error) {
+	pane, err := peer.getPane(a.PaneID)
+	if err != nil {
+		return nil, err
+	}
+	if pane.TTY == nil || pane.Ws == nil {
+		return nil, ctrlErrorf(CodeNoTTY, "Pane %d has no tty", a.PaneID)
+	}
+	err = peer.checkWritable(pane)
+	if err != nil {
+		return nil, err
+	}
+	pane.Resize(&pty.Winsize{Cols: a.Sx, Rows: a.Sy})
+	return nil, nil
+}
+
+// onMark adds a marker and stores it in each pane
+func (peer *Peer) onMark() (interface{}, error) {
+	peer.Marker = peer.server.nextMarker()
+	for _, client := range peer.server.cdb.All4Peer(peer) {
+		client.pane.Buffer.Mark(peer.Marker)
+		client.dc.Close()
+		// will be removed on close
+	}
+	return peer.Marker, nil
+}
+
+func (peer *Peer) onGetPane(a *GetPaneArgs) (interface{}, error) {
+	pane, err := peer.getPane(a.ID)
+	if err != nil {
+		return nil, err
+	}
+	return pane.Status(), nil
+}
+
+func (peer *Peer) onCloseStdin(a *CloseStdinArgs) (interface{}, error) {
+	pane, err := peer.getPane(a.PaneID)
+	if err != nil {
+		return nil, err
+	}
+	if !pane.pipe {
+		return nil, ctrlErrorf(CodeNoPipe, "Pane %d has no stdin pipe", a.PaneID)
+	}
+	err = peer.checkWritable(pane)
+	if err != nil {
+		return nil, err
+	}
+	err = pane.CloseStdin()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to close stdin: %s", err)
+	}
+	return nil, nil
+}
+
+// newDataChannel opens a data channel for a message's pane. If the channel
+// closes before it opens, the message is nacked. Channels in screen sync mode
+// are unordered with no retransmits, as a lost frame is replaced by the next.
+func (peer *Peer) newDataChannel(r *ctrlReply, paneID int, mode string) (*webrtc.DataChannel, error) {
+	ordered := mode != ModeScreen
+	init := &webrtc.DataChannelInit{Ordered: &ordered}
+	if !ordered {
+		var retransmits uint16
+		init.MaxRetransmits = &retransmits
+	}
+	pc := peer.GetPC()
+	if pc == nil {
+		return nil, ctrlErrorf(CodeInternal, "Peer %d is closed", peer.ID)
+	}
+	l := fmt.Sprintf("%d:%d", r.m.Ref, paneID)
+	d, err := pc.CreateDataChannel(l, init)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create data channel %q: %s", l, err)
+	}
+	d.OnClose(func() {
+		r.send(nil, ctrlErrorf(CodeInternal, "Data channel %q closed", l))
+	})
+	return d, nil
+}
+
+func (peer *Peer) onReconnectPane(a *ReconnectPaneArgs, r *ctrlReply) (interface{}, error) {
+	peer.logger.Infof("@%d: got reconnect_pane", a.ID)
+	pane, err := peer.getPane(a.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !pane.running() {
+		return nil, ctrlErrorf(CodePaneNotRunning, "Pane %d is not running", a.ID)
+	}
+	if a.Mode == ModeScreen && pane.vt == nil {
+		return nil, ctrlErrorf(CodeNoTTY, "Pane %d has no screen", a.ID)
+	}
+	if a.Mux {
+		pane, err := peer.attachStream(*a)
+		if err != nil {
+			return nil, err
+		}
+		return paneAck(pane, a.Compression), nil
+	}
+	d, err := peer.newDataChannel(r, a.ID, a.Mode)
+	if err != nil {
+		return nil, err
+	}
+	d.OnOpen(func() {
+		pane, err := peer.Reconnect(d, *a)
+		if err != nil {
+			peer.logger.Warnf("Failed to reconnect to pane %d: %s", a.ID, err)
+			r.send(nil, err)
+			return
+		}
+		r.send(paneAck(pane, a.Compression), nil)
+	})
+	return nil, errNoReply
+}
+
+func (peer *Peer) onAddPane(a *AddPaneArgs, r *ctrlReply) (interface{}, error) {
+	var (
+		ws      *pty.Winsize
+		profile *Profile
+		err     error
+	)
+	peer.logger.Infof("got add_pane: %v", a)
+	if a.Profile != "" {
+		profile, err = peer.applyProfile(a)
+		if err != nil {
+			return nil, err
+		}
+	} else if peer.Conf.ProfilesOnly {
+		return nil, ctrlErrorf(CodeUnauthorized,
+			"Only profiles can be launched, got a command")
+	}
+	if a.Command[0] == "*" {
+		shell, err := loginshell.Shell()
+		if err != nil {
+			peer.logger.Warnf("Failed to determine user's shell: %v", err)
+			a.Command[0] = "/bin/bash"
+		} else {
+			peer.logger.Infof("Using %s for shell", shell)
+			a.Command[0] = shell
+		}
+	}
+	// the hooks can change the args so the policy checks what they return
+	err = peer.server.allowAddPane(peer, a)
+	if err != nil {
+		return nil, ctrlErrorf(CodeUnauthorized, "add_pane rejected: %s", err)
+	}
+	if len(a.Command) == 0 {
+		return nil, ctrlErrorf(CodeInvalidArgs, "add_pane has no command")
+	}
+	err = peer.authorizePane("add_pane", a.Command, a.Profile, !a.Pipe)
+	if err != nil {
+		return nil, err
+	}
+	if a.Pipe {
+		ws = nil
+	} else if a.Rows > 0 && a.Cols > 0 {
+		ws = &pty.Winsize{Rows: a.Rows, Cols: a.Cols, X: a.X, Y: a.Y}
+	} else {
+		ws = &pty.Winsize{Rows: 24, Cols: 80}
+		peer.logger.Warn("Got an add_pane commenad with no rows or cols")
+	}
+	if a.Parent != 0 && peer.server.Panes.Get(a.Parent) == nil {
+		return nil, ctrlErrorf(CodePaneNotFound, "Unknown parent pane: %d", a.Parent)
+	}
+	x := peer.getMux()
+	if a.Mux && x == nil {
+		return nil, ctrlErrorf(CodeNoMux, "Peer has no mux channel")
+	}
+	var cwd string
+	if a.Cwd != "" {
+		cwd, err = checkCwd(a.Cwd)
+		if err != nil {
+			return nil, ctrlErrorf(CodeInvalidCwd, "%s", err)
+		}
+	}
+	pane, err := NewPane(peer, ws, a.Parent)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add a new pane: %s", err)
+	}
+	pane.pipe = a.Pipe
+	if a.Exclusive {
+		pane.driver = newDriverLock(pane, peer)
+	}
+	pane.cwd = cwd
+	pane.env = buildEnv(peer.Conf.Env, a.Env, a.InheritEnv)
+	if profile != nil {
+		if profile.ScrollbackSize > 0 {
+			pane.Buffer.Close()
+			pane.Buffer = peer.newBuffer(profile.ScrollbackSize)
+		}
+		pane.preLaunchScript = profile.PreLaunch
+		pane.profile = profile.Name
+	}
+	if a.Mux {
+		s, err := x.open(pane.ID)
+		if err != nil {
+			pane.discard()
+			return nil, err
+		}
+		go peer.startPane(pane, s, a, r)
+		return nil, errNoReply
+	}
+	d, err := peer.newDataChannel(r, pane.ID, a.Mode)
+	if err != nil {
+		pane.discard()
+		return nil, err
+	}
+	d.OnOpen(func() {
+		peer.logger.Infof("opened data channel for pane %d", pane.ID)
+		go peer.startPane(pane, d, a, r)
+	})
+	return nil, errNoReply
+}
+
+// startPane runs the pane and acks the add_pane once it runs. It has a
+// goroutine of its own as a profile's pre launch script can take a while.
+func (peer *Peer) startPane(pane *Pane, d Channel, a *AddPaneArgs, r *ctrlReply) {
+	err := peer.runPane(pane, d, a)
+	if err != nil {
+		r.send(nil, err)
+		d.Close()
+		return
+	}
+	r.send(paneAck(pane, a.Compression), nil)
+}
+
+// runPane adds a channel as the pane's client and runs its command. If the
+// command fails to start the pane is discarded and the caller should close the
+// channel.
+func (peer *Peer) runPane(pane *Pane, d Channel, a *AddPaneArgs) error {
+	d, err := pane.compress(d, a.Compression)
+	if err != nil {
+		pane.discard()
+		return err
+	}
+	var c *Client
+	if a.Mode == ModeScreen {
+		c = peer.server.cdb.AddSync(d, pane, peer, false)
+	} else {
+		c = peer.server.cdb.Add(d, pane, peer, a.Offsets, false)
+	}
+	err = pane.run(a.Command)
+	if err != nil {
+		peer.server.cdb.Delete(c)
+		pane.discard()
+		return ctrlErrorf(CodeSpawnFailed, "Failed to run %q: %s",
+			a.Command[0], err)
+	}
+	if c.sync != nil {
+		d.OnMessage(c.sync.onMessage)
+	} else {
+		d.OnMessage(c.input)
+	}
+	d.OnClose(func() {
+		peer.server.cdb.Delete(c)
+	})
+	return nil
+}
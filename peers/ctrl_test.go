@@ -0,0 +1,49 @@
+package peers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		raw   string
+		args  interface{}
+		valid bool
+	}{
+		{`{"command": ["bash"], "rows": 24, "cols": 80}`, &AddPaneArgs{}, true},
+		{`{"command": []}`, &AddPaneArgs{}, false},
+		{`{"command": "bash"}`, &AddPaneArgs{}, false},
+		{`{"pane_id": 1, "sx": 80, "sy": 24}`, &ResizeArgs{}, true},
+		{`{"pane_id": 1, "sx": 0, "sy": 24}`, &ResizeArgs{}, false},
+		{`{"sx": 80, "sy": 24}`, &ResizeArgs{}, false},
+		{`{"id": 3, "offset": 100}`, &ReconnectPaneArgs{}, true},
+		{`{"id": 3, "offset": -1}`, &ReconnectPaneArgs{}, false},
+		{`{"id": 3}`, &GetPaneArgs{}, true},
+		{`{}`, &CloseStdinArgs{}, false},
+		{`null`, &RestoreArgs{}, false},
+		{`{"api_version": 2}`, &HelloArgs{}, true},
+	}
+	for _, tc := range tests {
+		// the args are parsed the same way in both encodings
+		c, err := cbor.Marshal(RawJSON(tc.raw))
+		require.NoError(t, err)
+		for enc, raw := range map[*encoding][]byte{
+			jsonEncoding: []byte(tc.raw), cborEncoding: c} {
+
+			args := reflect.New(reflect.TypeOf(tc.args).Elem()).Interface()
+			err := parseArgs(enc, raw, args)
+			if tc.valid {
+				require.NoError(t, err, tc.raw)
+				continue
+			}
+			require.Error(t, err, tc.raw)
+			ce, ok := err.(*CTRLError)
+			require.True(t, ok)
+			require.Equal(t, CodeInvalidArgs, ce.Code, tc.raw)
+		}
+	}
+}
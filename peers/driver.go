@@ -0,0 +1,337 @@
+// This file holds the driver lock of exclusive panes. Only the peer driving
+// an exclusive pane can write to it or resize it, the other peers attached
+// to it request control and the driver grants it or the request times out.
+package peers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ControlRequestTimeout is how long a request to drive a pane waits for the
+// driver to grant it
+var ControlRequestTimeout = 30 * time.Second
+
+// ControlArgs holds the args of the request_control & release_control
+// messages
+type ControlArgs struct {
+	PaneID int `json:"pane_id"`
+}
+
+func (a *ControlArgs) Validate() error {
+	return validatePaneID(a.PaneID, "pane_id")
+}
+
+// GrantControlArgs holds the args of the grant_control message
+type GrantControlArgs struct {
+	PaneID int `json:"pane_id"`
+	// PeerID is the id of the requesting peer, as sent in control_request
+	PeerID int `json:"peer_id"`
+}
+
+func (a *GrantControlArgs) Validate() error {
+	if a.PeerID <= 0 {
+		return fmt.Errorf("peer_id is required")
+	}
+	return validatePaneID(a.PaneID, "pane_id")
+}
+
+// DriverArgs are the args of the driver message, sent to the peers
+// attached to an exclusive pane when they attach and when its driver changes
+type DriverArgs struct {
+	PaneID int `json:"pane_id"`
+	// PeerID is the id of the driving peer, 0 when no peer drives
+	PeerID int `json:"peer_id"`
+	// FP is the fingerprint of the driving peer
+	FP string `json:"fp,omitempty"`
+	// You is true when the peer the message is sent to drives
+	You bool `json:"you"`
+}
+
+// ControlRequestArgs are the args of the control_request message, sent to
+// the driver when another peer requests control
+type ControlRequestArgs struct {
+	PaneID int    `json:"pane_id"`
+	PeerID int    `json:"peer_id"`
+	FP     string `json:"fp,omitempty"`
+}
+
+// controlRequest is a request to drive a pane, waiting for a grant
+type controlRequest struct {
+	peer  *Peer
+	r     *ctrlReply
+	timer *time.Timer
+}
+
+// driverLock holds the driver of an exclusive pane and the pending requests
+// to drive it, oldest first
+type driverLock struct {
+	pane     *Pane
+	m        sync.Mutex
+	driver   *Peer
+	requests []*controlRequest
+}
+
+func newDriverLock(pane *Pane, driver *Peer) *driverLock {
+	return &driverLock{pane: pane, driver: driver}
+}
+
+// check returns an error when the peer doesn't drive the pane. Panes with
+// no lock are driven by all.
+func (l *driverLock) check(peer *Peer) error {
+	if l == nil {
+		return nil
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.driver == nil {
+		return ctrlErrorf(CodeNotDriver,
+			"Pane %d has no driver, request control first", l.pane.ID)
+	}
+	if l.driver != peer {
+		return ctrlErrorf(CodeNotDriver, "Pane %d is driven by peer %d",
+			l.pane.ID, l.driver.ID)
+	}
+	return nil
+}
+
+// request adds a request to drive the pane, granting it when there's no
+// driver. The request is acked when granted.
+func (l *driverLock) request(peer *Peer, r *ctrlReply) error {
+	l.m.Lock()
+	if l.driver == nil || l.driver == peer {
+		l.driver = peer
+		l.m.Unlock()
+		r.send(l.pane.ID, nil)
+		l.notify()
+		return nil
+	}
+	for _, req := range l.requests {
+		if req.peer == peer {
+			l.m.Unlock()
+			return ctrlErrorf(CodeInvalidArgs,
+				"Peer %d already requested control of pane %d", peer.ID, l.pane.ID)
+		}
+	}
+	req := &controlRequest{peer: peer, r: r}
+	req.timer = time.AfterFunc(ControlRequestTimeout, func() { l.expire(req) })
+	l.requests = append(l.requests, req)
+	driver := l.driver
+	l.m.Unlock()
+	err := SendCTRLMsg(driver, "control_request", &ControlRequestArgs{
+		PaneID: l.pane.ID, PeerID: peer.ID, FP: peer.FP})
+	if err != nil {
+		peer.logger.Warnf("@%d: failed to send control_request: %s",
+			l.pane.ID, err)
+	}
+	return nil
+}
+
+// grant passes the lock from the driver to a requesting peer
+func (l *driverLock) grant(driver *Peer, peerID int) error {
+	l.m.Lock()
+	if l.driver != driver {
+		l.m.Unlock()
+		return ctrlErrorf(CodeNotDriver,
+			"Only the driver can grant control of pane %d", l.pane.ID)
+	}
+	for i, req := range l.requests {
+		if req.peer.ID == peerID {
+			l.take(i)
+			l.m.Unlock()
+			req.r.send(l.pane.ID, nil)
+			l.notify()
+			return nil
+		}
+	}
+	l.m.Unlock()
+	return ctrlErrorf(CodeInvalidArgs, "Peer %d didn't request control of pane %d",
+		peerID, l.pane.ID)
+}
+
+// release releases the driver's lock, granting it to the oldest request
+func (l *driverLock) release(driver *Peer) error {
+	l.m.Lock()
+	if l.driver != driver {
+		l.m.Unlock()
+		return ctrlErrorf(CodeNotDriver, "Pane %d is not driven by peer %d",
+			l.pane.ID, driver.ID)
+	}
+	l.driver = nil
+	var granted *controlRequest
+	if len(l.requests) > 0 {
+		granted = l.requests[0]
+		l.take(0)
+	}
+	l.m.Unlock()
+	if granted != nil {
+		granted.r.send(l.pane.ID, nil)
+	}
+	l.notify()
+	return nil
+}
+
+// take removes a request and makes its peer the driver. The caller must
+// hold the mutex.
+func (l *driverLock) take(i int) {
+	req := l.requests[i]
+	req.timer.Stop()
+	l.requests = append(l.requests[:i], l.requests[i+1:]...)
+	l.driver = req.peer
+}
+
+// expire nacks a request the driver didn't grant in time
+func (l *driverLock) expire(req *controlRequest) {
+	l.m.Lock()
+	for i, r := range l.requests {
+		if r == req {
+			l.requests = append(l.requests[:i], l.requests[i+1:]...)
+			l.m.Unlock()
+			req.r.send(nil, ctrlErrorf(CodeControlTimeout,
+				"Control of pane %d was not granted in time", l.pane.ID))
+			return
+		}
+	}
+	l.m.Unlock()
+}
+
+// attached tells a peer that attached to the pane who drives it
+func (l *driverLock) attached(peer *Peer) {
+	l.m.Lock()
+	args := l.args(peer)
+	l.m.Unlock()
+	l.send(peer, args)
+}
+
+// detached drops the requests of a peer that's no longer attached to the
+// pane and, when it drove the pane, grants the lock to the oldest request
+func (l *driverLock) detached(peer *Peer) {
+	if len(peer.clients(l.pane)) > 0 {
+		return
+	}
+	var dropped []*controlRequest
+	l.m.Lock()
+	requests := l.requests[:0]
+	for _, req := range l.requests {
+		if req.peer == peer {
+			req.timer.Stop()
+			dropped = append(dropped, req)
+		} else {
+			requests = append(requests, req)
+		}
+	}
+	l.requests = requests
+	var granted *controlRequest
+	changed := l.driver == peer
+	if changed {
+		l.driver = nil
+		if len(l.requests) > 0 {
+			granted = l.requests[0]
+			l.take(0)
+		}
+	}
+	l.m.Unlock()
+	for _, req := range dropped {
+		req.r.send(nil, ctrlErrorf(CodePaneNotFound,
+			"Pane %d was detached", l.pane.ID))
+	}
+	if granted != nil {
+		granted.r.send(l.pane.ID, nil)
+	}
+	if changed {
+		l.notify()
+	}
+}
+
+// notify tells all the peers attached to the pane who drives it
+func (l *driverLock) notify() {
+	sent := make(map[*Peer]bool)
+	for _, c := range l.pane.server.cdb.All4Pane(l.pane) {
+		if sent[c.peer] {
+			continue
+		}
+		sent[c.peer] = true
+		l.m.Lock()
+		args := l.args(c.peer)
+		l.m.Unlock()
+		l.send(c.peer, args)
+	}
+}
+
+// args returns the driver message's args for a peer. The caller must hold
+// the mutex.
+func (l *driverLock) args(peer *Peer) *DriverArgs {
+	args := &DriverArgs{PaneID: l.pane.ID}
+	if l.driver != nil {
+		args.PeerID = l.driver.ID
+		args.FP = l.driver.FP
+		args.You = l.driver == peer
+	}
+	return args
+}
+
+func (l *driverLock) send(peer *Peer, args *DriverArgs) {
+	err := SendCTRLMsg(peer, "driver", args)
+	if err != nil {
+		peer.logger.Warnf("@%d: failed to send the driver: %s", l.pane.ID, err)
+	}
+}
+
+// clients returns the peer's clients of a pane
+func (peer *Peer) clients(pane *Pane) []*Client {
+	var r []*Client
+	for _, c := range peer.server.cdb.All4Pane(pane) {
+		if c.peer == peer {
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+// exclusivePane returns a pane the peer is attached to with a driver lock
+func (peer *Peer) exclusivePane(id int) (*Pane, error) {
+	pane, err := peer.getPane(id)
+	if err != nil {
+		return nil, err
+	}
+	if pane.driver == nil {
+		return nil, ctrlErrorf(CodeInvalidArgs, "Pane %d is not exclusive", id)
+	}
+	if len(peer.clients(pane)) == 0 {
+		return nil, ctrlErrorf(CodeInvalidArgs, "Pane %d is not attached", id)
+	}
+	return pane, nil
+}
+
+func (peer *Peer) onRequestControl(a *ControlArgs, r *ctrlReply) (interface{}, error) {
+	pane, err := peer.exclusivePane(a.PaneID)
+	if err != nil {
+		return nil, err
+	}
+	err = peer.checkReadOnly(pane)
+	if err != nil {
+		return nil, err
+	}
+	err = pane.driver.request(peer, r)
+	if err != nil {
+		return nil, err
+	}
+	return nil, errNoReply
+}
+
+func (peer *Peer) onGrantControl(a *GrantControlArgs) (interface{}, error) {
+	pane, err := peer.exclusivePane(a.PaneID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, pane.driver.grant(peer, a.PeerID)
+}
+
+func (peer *Peer) onReleaseControl(a *ControlArgs) (interface{}, error) {
+	pane, err := peer.exclusivePane(a.PaneID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, pane.driver.release(peer)
+}
@@ -0,0 +1,93 @@
+package peers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func requireDriver(t *testing.T, pane *Pane, driver *Peer) {
+	require.NoError(t, pane.driver.check(driver))
+	require.NoError(t, driver.checkWritable(pane))
+	for _, c := range pane.server.cdb.All4Pane(pane) {
+		if c.peer != driver {
+			err := c.peer.checkWritable(pane)
+			require.Equal(t, CodeNotDriver, err.(*CTRLError).Code)
+		}
+	}
+}
+
+func TestDriverGrant(t *testing.T) {
+	pane, clients := newTestPane(t, 3, true)
+	a, b, c := clients[0].peer, clients[1].peer, clients[2].peer
+	requireDriver(t, pane, a)
+	l := pane.driver
+	require.NoError(t, l.request(b, &ctrlReply{peer: b}))
+	require.NoError(t, l.request(c, &ctrlReply{peer: c}))
+	require.Error(t, l.request(c, &ctrlReply{peer: c}))
+	require.Len(t, l.requests, 2)
+	// only the driver grants
+	err := l.grant(b, c.ID)
+	require.Equal(t, CodeNotDriver, err.(*CTRLError).Code)
+	require.NoError(t, l.grant(a, c.ID))
+	requireDriver(t, pane, c)
+	require.Error(t, l.grant(c, a.ID))
+	// releasing grants the oldest request
+	require.NoError(t, l.release(c))
+	requireDriver(t, pane, b)
+	require.Empty(t, l.requests)
+	require.NoError(t, l.release(b))
+	err = l.check(b)
+	require.Equal(t, CodeNotDriver, err.(*CTRLError).Code)
+	// with no driver the request is granted right away
+	require.NoError(t, l.request(a, &ctrlReply{peer: a}))
+	requireDriver(t, pane, a)
+}
+
+func TestDriverRequestTimeout(t *testing.T) {
+	defer func(d time.Duration) { ControlRequestTimeout = d }(ControlRequestTimeout)
+	ControlRequestTimeout = 10 * time.Millisecond
+	pane, clients := newTestPane(t, 2, true)
+	require.NoError(t, pane.driver.request(clients[1].peer, &ctrlReply{peer: clients[1].peer}))
+	require.Eventually(t, func() bool {
+		pane.driver.m.Lock()
+		defer pane.driver.m.Unlock()
+		return len(pane.driver.requests) == 0
+	}, time.Second, 5*time.Millisecond)
+	requireDriver(t, pane, clients[0].peer)
+}
+
+func TestDriverDetached(t *testing.T) {
+	pane, clients := newTestPane(t, 3, true)
+	l := pane.driver
+	b, c := clients[1].peer, clients[2].peer
+	require.NoError(t, l.request(b, &ctrlReply{peer: b}))
+	require.NoError(t, l.request(c, &ctrlReply{peer: c}))
+	// the request of a peer that detached is dropped
+	require.NoError(t, pane.server.cdb.Delete(clients[1]))
+	require.Len(t, l.requests, 1)
+	// when the driver detaches the oldest request is granted
+	require.NoError(t, pane.server.cdb.Delete(clients[0]))
+	requireDriver(t, pane, c)
+	require.Empty(t, l.requests)
+}
+
+func TestDriverInput(t *testing.T) {
+	pane, clients := newTestPane(t, 2, true)
+	var written []byte
+	pane.TTY = writerFunc(func(b []byte) (int, error) {
+		written = append(written, b...)
+		return len(b), nil
+	})
+	driver, passenger := clients[0], clients[1]
+	passenger.input(webrtc.DataChannelMessage{Data: []byte("rm -rf /\n")})
+	require.Empty(t, written)
+	require.False(t, passenger.lastDropReport.IsZero())
+	driver.input(webrtc.DataChannelMessage{Data: []byte("ls\n")})
+	require.Equal(t, "ls\n", string(written))
+	require.NoError(t, pane.driver.release(driver.peer))
+	driver.input(webrtc.DataChannelMessage{Data: []byte("ls\n")})
+	require.Equal(t, "ls\n", string(written))
+}
@@ -0,0 +1,203 @@
+// This file holds the encodings of the control messages. Clients use JSON
+// by default and can switch to CBOR, a binary encoding, by opening the
+// control channel with the "%cbor" label or in their hello. Both encodings
+// use the same Go types, CBOR follows their json tags.
+package peers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// The CBOR simple values of missing args
+const (
+	cborNull      = 0xf6
+	cborUndefined = 0xf7
+)
+
+// encoding marshals & unmarshals the control messages
+type encoding struct {
+	name      string
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+var (
+	jsonEncoding = &encoding{"json", json.Marshal, json.Unmarshal}
+	cborEncoding = &encoding{"cbor", cbor.Marshal, cborUnmarshal}
+	// encodings holds the encodings by name
+	encodings = map[string]*encoding{
+		"json": jsonEncoding,
+		"cbor": cborEncoding,
+	}
+	// cborDec decodes integers as int64 & maps with string keys, so the
+	// decoded values can be converted to JSON
+	cborDec = func() cbor.DecMode {
+		dm, err := cbor.DecOptions{
+			MaxNestedLevels: 64,
+			IntDec:          cbor.IntDecConvertSigned,
+			DefaultMapType:  reflect.TypeOf(map[string]interface{}(nil)),
+		}.DecMode()
+		if err != nil {
+			panic(err)
+		}
+		return dm
+	}()
+)
+
+// RawJSON is a raw encoded JSON value, like json.RawMessage. It's sent as
+// a CBOR item to the peers that use CBOR.
+type RawJSON []byte
+
+// MarshalJSON returns the raw JSON
+func (r RawJSON) MarshalJSON() ([]byte, error) {
+	return json.RawMessage(r).MarshalJSON()
+}
+
+// UnmarshalJSON sets r to a copy of the JSON
+func (r *RawJSON) UnmarshalJSON(data []byte) error {
+	return (*json.RawMessage)(r).UnmarshalJSON(data)
+}
+
+// MarshalCBOR converts the JSON to a CBOR item
+func (r RawJSON) MarshalCBOR() ([]byte, error) {
+	if len(r) == 0 {
+		return []byte{cborNull}, nil
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(r))
+	d.UseNumber()
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(fromJSON(v))
+}
+
+// UnmarshalCBOR converts a CBOR item to JSON
+func (r *RawJSON) UnmarshalCBOR(data []byte) error {
+	var v interface{}
+	err := cborDec.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*r, err = json.Marshal(v)
+	return err
+}
+
+// fromJSON replaces the numbers in a decoded JSON value with integers,
+// when they are whole, or floats
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = fromJSON(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = fromJSON(v[k])
+		}
+	}
+	return v
+}
+
+// cborUnmarshal decodes CBOR data into the value v points to
+func cborUnmarshal(data []byte, v interface{}) error {
+	return cborDec.Unmarshal(data, v)
+}
+
+// cborMessage is a control message with its args left encoded. The args
+// are a field of their own as the CBOR decoder replaces the value of an
+// interface.
+type cborMessage struct {
+	CTRLMessage
+	Args cbor.RawMessage `json:"args"`
+}
+
+// decodeMsg decodes a control message, returning its args still encoded
+func (e *encoding) decodeMsg(data []byte) (CTRLMessage, []byte, error) {
+	var (
+		m   CTRLMessage
+		raw []byte
+		err error
+	)
+	if e == cborEncoding {
+		var c cborMessage
+		err = cborUnmarshal(data, &c)
+		m, raw = c.CTRLMessage, c.Args
+	} else {
+		var r json.RawMessage
+		m.Args = &r
+		err = json.Unmarshal(data, &m)
+		raw = r
+	}
+	return m, raw, err
+}
+
+// isNull returns true when encoded args are missing or null
+func (e *encoding) isNull(raw []byte) bool {
+	if e == cborEncoding {
+		return len(raw) == 0 || raw[0] == cborNull || raw[0] == cborUndefined
+	}
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// toJSON converts encoded args to JSON, for the hooks
+func (e *encoding) toJSON(raw []byte) json.RawMessage {
+	if e == jsonEncoding || len(raw) == 0 {
+		return raw
+	}
+	var j RawJSON
+	err := j.UnmarshalCBOR(raw)
+	if err != nil {
+		return nil
+	}
+	return json.RawMessage(j)
+}
+
+// format returns a printable form of an encoded message, for the log
+func (e *encoding) format(data []byte) string {
+	if e == jsonEncoding {
+		return string(data)
+	}
+	return fmt.Sprintf("%x", data)
+}
+
+// labelEncoding returns the encoding a control channel's label asks for,
+// "%" for JSON or "%" followed by the encoding's name
+func labelEncoding(l string) (*encoding, error) {
+	if l == "%" {
+		return jsonEncoding, nil
+	}
+	e, found := encodings[l[1:]]
+	if !found {
+		return nil, fmt.Errorf("Unsupported control channel encoding: %q", l[1:])
+	}
+	return e, nil
+}
+
+// encoding returns the encoding of the peer's control messages
+func (peer *Peer) encoding() *encoding {
+	peer.helloM.Lock()
+	defer peer.helloM.Unlock()
+	if peer.enc == nil {
+		return jsonEncoding
+	}
+	return peer.enc
+}
+
+func (peer *Peer) setEncoding(e *encoding) {
+	peer.helloM.Lock()
+	peer.enc = e
+	peer.helloM.Unlock()
+}
@@ -0,0 +1,74 @@
+package peers
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawJSON(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		hex  string
+	}{
+		{`null`, "f6"},
+		{`[1, -1000, 1.1, "IETF"]`, "84013903e7fb3ff199999999999a6449455446"},
+		{`{"a": true}`, "a16161f5"},
+	} {
+		b, err := cbor.Marshal(RawJSON(tc.json))
+		require.NoError(t, err)
+		require.Equal(t, tc.hex, hex.EncodeToString(b), tc.json)
+		// and back to JSON
+		var r RawJSON
+		require.NoError(t, cborUnmarshal(b, &r))
+		require.JSONEq(t, tc.json, string(r))
+	}
+	// indefinite lengths & tags are decoded too
+	b, err := hex.DecodeString("bf61610161629f0203ffff")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a": 1, "b": [2, 3]}`, string(cborEncoding.toJSON(b)))
+	for _, bad := range []string{"", "18", "62ff", "ff", "0000", "a1016161"} {
+		b, _ := hex.DecodeString(bad)
+		var v interface{}
+		require.Error(t, cborUnmarshal(b, &v), bad)
+	}
+}
+
+func TestCBORCTRLMessage(t *testing.T) {
+	offset := int64(42)
+	m := CTRLMessage{Time: 1234, Ref: 7, Type: "reconnect_pane",
+		Args: &ReconnectPaneArgs{ID: 3, Offset: &offset}}
+	b, err := cbor.Marshal(m)
+	require.NoError(t, err)
+	// decoded with the json tags, leaving the args encoded
+	got, raw, err := cborEncoding.decodeMsg(b)
+	require.NoError(t, err)
+	require.Equal(t, int64(1234), got.Time)
+	require.Equal(t, 7, got.Ref)
+	require.Equal(t, "reconnect_pane", got.Type)
+	var a ReconnectPaneArgs
+	require.NoError(t, parseArgs(cborEncoding, raw, &a))
+	require.Equal(t, 3, a.ID)
+	require.Equal(t, offset, *a.Offset)
+	require.False(t, a.Offsets)
+	require.JSONEq(t, `{"id": 3, "offset": 42}`, string(cborEncoding.toJSON(raw)))
+	// raw JSON bodies are sent as CBOR items
+	ack := ackReply{Ref: 7, Body: RawJSON(`{"a": [1, 2.5, "b"]}`)}
+	b, err = cbor.Marshal(ack)
+	require.NoError(t, err)
+	var body struct {
+		Body struct {
+			A []interface{} `json:"a"`
+		} `json:"body"`
+	}
+	require.NoError(t, cborUnmarshal(b, &body))
+	require.Equal(t, []interface{}{int64(1), 2.5, "b"}, body.Body.A)
+	// and the payload is converted to JSON
+	var payload SetPayloadArgs
+	p, err := cbor.Marshal(map[string]interface{}{"payload": map[string]int{"x": 1}})
+	require.NoError(t, err)
+	require.NoError(t, cborUnmarshal(p, &payload))
+	require.JSONEq(t, `{"x": 1}`, string(payload.Payload))
+}
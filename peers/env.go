@@ -0,0 +1,89 @@
+// This file holds the environment & working directory of the panes'
+// commands
+package peers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The policies of the environment a pane's command inherits
+const (
+	// InheritAll starts with the agent's environment, the default
+	InheritAll = "all"
+	// InheritConf starts with the [env] section of the configuration only
+	InheritConf = "conf"
+	// InheritNone starts with an empty environment
+	InheritNone = "none"
+)
+
+// validateEnv returns an error for an environment with bad names or values
+func validateEnv(env map[string]string) error {
+	for k, v := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("bad environment variable name %q", k)
+		}
+		if strings.ContainsRune(v, 0) {
+			return fmt.Errorf("environment variable %s has a NUL", k)
+		}
+	}
+	return nil
+}
+
+// validateInheritEnv returns an error for an unknown inherit_env policy
+func validateInheritEnv(policy string) error {
+	switch policy {
+	case "", InheritAll, InheritConf, InheritNone:
+		return nil
+	}
+	return fmt.Errorf("unknown inherit_env %q", policy)
+}
+
+// buildEnv returns the environment of a pane's command: the inherited
+// environment, overridden by the configuration's and then by the client's
+func buildEnv(conf map[string]string, env map[string]string, policy string) map[string]string {
+	r := make(map[string]string)
+	if policy == "" || policy == InheritAll {
+		for _, kv := range os.Environ() {
+			i := strings.IndexByte(kv, '=')
+			if i > 0 {
+				r[kv[:i]] = kv[i+1:]
+			}
+		}
+	}
+	if policy != InheritNone {
+		for k, v := range conf {
+			r[k] = v
+		}
+	}
+	for k, v := range env {
+		r[k] = v
+	}
+	return r
+}
+
+// checkCwd returns the absolute path of a pane's working directory, with a
+// leading ~ expanded to the user's home, or an error when it's not a
+// directory
+func checkCwd(cwd string) (string, error) {
+	if cwd == "~" || strings.HasPrefix(cwd, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("Failed to get the home directory: %s", err)
+		}
+		cwd = filepath.Join(home, cwd[1:])
+	}
+	if !filepath.IsAbs(cwd) {
+		return "", fmt.Errorf("cwd %q is not an absolute path", cwd)
+	}
+	fi, err := os.Stat(cwd)
+	if err != nil {
+		return "", fmt.Errorf("cwd %q: %s", cwd, err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("cwd %q is not a directory", cwd)
+	}
+	return cwd, nil
+}
@@ -0,0 +1,73 @@
+package peers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildEnv(t *testing.T) {
+	os.Setenv("WEBEXEC_TEST_AGENT", "agent")
+	defer os.Unsetenv("WEBEXEC_TEST_AGENT")
+	conf := map[string]string{"TERM": "xterm", "COLORTERM": "truecolor"}
+	client := map[string]string{"TERM": "xterm-256color", "LANG": "he_IL.UTF-8"}
+	env := buildEnv(conf, client, "")
+	require.Equal(t, "agent", env["WEBEXEC_TEST_AGENT"])
+	require.Equal(t, os.Getenv("PATH"), env["PATH"])
+	require.Equal(t, "xterm-256color", env["TERM"])
+	require.Equal(t, "truecolor", env["COLORTERM"])
+	require.Equal(t, "he_IL.UTF-8", env["LANG"])
+	env = buildEnv(conf, client, InheritConf)
+	require.NotContains(t, env, "WEBEXEC_TEST_AGENT")
+	require.Equal(t, "truecolor", env["COLORTERM"])
+	env = buildEnv(conf, client, InheritNone)
+	require.Equal(t, client, env)
+}
+
+func TestValidateEnv(t *testing.T) {
+	a := AddPaneArgs{Command: []string{"bash"},
+		Env: map[string]string{"TZ": "Asia/Jerusalem"}, InheritEnv: InheritConf}
+	require.NoError(t, a.Validate())
+	a.Env["A=B"] = "c"
+	require.Error(t, a.Validate())
+	a.Env = map[string]string{"A": "b\x00"}
+	require.Error(t, a.Validate())
+	a.Env = nil
+	a.InheritEnv = "some"
+	require.Error(t, a.Validate())
+}
+
+func TestCheckCwd(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := checkCwd(dir)
+	require.NoError(t, err)
+	require.Equal(t, dir, cwd)
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	cwd, err = checkCwd("~")
+	require.NoError(t, err)
+	require.Equal(t, home, cwd)
+	_, err = checkCwd("relative")
+	require.Error(t, err)
+	_, err = checkCwd(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+	f := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(f, nil, 0600))
+	_, err = checkCwd(f)
+	require.Error(t, err)
+}
+
+func TestNewCommandDirEnv(t *testing.T) {
+	dir := t.TempDir()
+	cmd, err := newCommand([]string{"pwd"}, map[string]string{}, dir, 0, "")
+	require.NoError(t, err)
+	require.Equal(t, dir, cmd.Dir)
+	// an empty environment is not the agent's
+	require.NotNil(t, cmd.Env)
+	require.Empty(t, cmd.Env)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, dir+"\n", string(out))
+}
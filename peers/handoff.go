@@ -0,0 +1,252 @@
+// This file holds the code to hand the panes off to a new agent, used to
+// upgrade the agent without killing the panes
+package peers
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// detachTimeout is how long to wait for a pane's read loop to stop
+const detachTimeout = time.Second
+
+// HandoffPane holds the state of a pane handed off to a new agent
+type HandoffPane struct {
+	ID int `json:"id"`
+	// PID is the process id of the pane's command
+	PID  int    `json:"pid"`
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+	Pipe bool   `json:"pipe"`
+	// Files holds the indexes of the pane's files in the files passed with
+	// the hand off - the pty or the stdin, stdout & stderr pipes.
+	// -1 is used for a closed stdin.
+	Files  []int       `json:"files"`
+	Buffer BufferState `json:"buffer"`
+	// Command & Profile are what the pane runs, for the policies
+	Command []string `json:"command,omitempty"`
+	Profile string   `json:"profile,omitempty"`
+}
+
+// Handoff holds the state an agent hands to the agent replacing it
+type Handoff struct {
+	Panes      []HandoffPane `json:"panes"`
+	Payload    []byte        `json:"payload"`
+	LastMarker int           `json:"last_marker"`
+}
+
+// Detach stops reading from the panes so they can be handed off to a new
+// agent. It returns the state to hand off and the files to pass with it.
+// Kept panes are left for the new agent to restore from their keepers.
+// If the hand off fails, Resume should be called.
+func (s *Server) Detach() (*Handoff, []*os.File, error) {
+	s.markerM.RLock()
+	h := &Handoff{Payload: s.GetPayload(), LastMarker: s.lastMarker}
+	s.markerM.RUnlock()
+	var files []*os.File
+	for _, pane := range s.Panes.All() {
+		pf := pane.files()
+		if !pane.running() || pane.keeper != nil || pf == nil {
+			continue
+		}
+		err := pane.stopReading()
+		if err != nil {
+			return nil, nil, err
+		}
+		hp := HandoffPane{ID: pane.ID, PID: pane.pid(), Pipe: pane.pipe,
+			Command: pane.command, Profile: pane.profile}
+		if pane.Ws != nil {
+			hp.Rows, hp.Cols = pane.Ws.Rows, pane.Ws.Cols
+		}
+		for _, f := range pf {
+			if f == nil {
+				hp.Files = append(hp.Files, -1)
+				continue
+			}
+			hp.Files = append(hp.Files, len(files))
+			files = append(files, f)
+		}
+		hp.Buffer = pane.Buffer.state()
+		h.Panes = append(h.Panes, hp)
+	}
+	return h, files, nil
+}
+
+// Resume restarts reading from the panes after a failed hand off
+func (s *Server) Resume() {
+	for _, pane := range s.Panes.All() {
+		if pane.detaching() {
+			pane.resume()
+		}
+	}
+}
+
+// Adopt restores the panes, payload & markers handed off by the previous
+// agent. files are the files passed with the hand off.
+func (s *Server) Adopt(h *Handoff, files []*os.File) {
+	s.SetPayload(h.Payload)
+	s.markerM.Lock()
+	s.lastMarker = h.LastMarker
+	s.markerM.Unlock()
+	peer := s.newOrphanPeer()
+	for _, hp := range h.Panes {
+		pane, err := adoptPane(peer, hp, files)
+		if err != nil {
+			s.Conf.Logger.Errorf("Failed to adopt pane %d: %s", hp.ID, err)
+			continue
+		}
+		s.Conf.Logger.Infof("Adopted pane %d running process %d", pane.ID,
+			hp.PID)
+	}
+}
+
+// adoptPane restores a pane handed off by the previous agent
+func adoptPane(peer *Peer, hp HandoffPane, files []*os.File) (*Pane, error) {
+	pf := make([]*os.File, len(hp.Files))
+	for i, fi := range hp.Files {
+		if fi >= len(files) {
+			return nil, fmt.Errorf("file index %d out of range", fi)
+		}
+		if fi >= 0 {
+			pf[i] = files[fi]
+		}
+	}
+	var ws *pty.Winsize
+	if !hp.Pipe {
+		ws = &pty.Winsize{Rows: hp.Rows, Cols: hp.Cols}
+	}
+	pane := newPane(peer, ws)
+	pane.ID = hp.ID
+	pane.pipe = hp.Pipe
+	pane.adoptedPID = hp.PID
+	pane.command = hp.Command
+	pane.profile = hp.Profile
+	if hp.Pipe {
+		if len(pf) != 3 || pf[1] == nil || pf[2] == nil {
+			return nil, fmt.Errorf("expected stdin, stdout & stderr pipes")
+		}
+		pane.TTY = &Pipes{stdin: pf[0], stdout: pf[1], Stderr: pf[2]}
+	} else {
+		if len(pf) != 1 || pf[0] == nil {
+			return nil, fmt.Errorf("expected a pty")
+		}
+		pane.TTY = pf[0]
+	}
+	err := pane.server.Panes.AddWithID(pane)
+	if err != nil {
+		pane.TTY.Close()
+		return nil, err
+	}
+	pane.Buffer.restore(hp.Buffer)
+	if pane.vt != nil {
+		pane.vt.Write(pane.Buffer.GetSinceMarker(-1))
+	}
+	pane.setRunning(true)
+	go pane.waitAdopted()
+	if p, ok := pane.TTY.(*Pipes); ok {
+		pane.stderrDone = make(chan struct{})
+		go pane.stderrLoop(p.Stderr)
+	}
+	go pane.ReadLoop()
+	return pane, nil
+}
+
+// files returns the files connecting the pane to its command
+func (pane *Pane) files() []*os.File {
+	switch tty := pane.TTY.(type) {
+	case *os.File:
+		return []*os.File{tty}
+	case *Pipes:
+		return []*os.File{tty.stdin, tty.stdout, tty.Stderr}
+	}
+	return nil
+}
+
+// detaching returns true when the pane is being handed off
+func (pane *Pane) detaching() bool {
+	pane.detachM.Lock()
+	defer pane.detachM.Unlock()
+	return isClosed(pane.detach)
+}
+
+// isClosed returns true when a channel is closed
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// stoppedReading is called by the read loop when it stops for a hand off
+func (pane *Pane) stoppedReading() {
+	pane.detachM.Lock()
+	close(pane.detached)
+	pane.detachM.Unlock()
+}
+
+// stopReading stops the pane's read loop, leaving the command running
+func (pane *Pane) stopReading() error {
+	pane.detachM.Lock()
+	if !isClosed(pane.detach) {
+		close(pane.detach)
+	}
+	detached := pane.detached
+	pane.detachM.Unlock()
+	now := time.Now()
+	for _, f := range pane.files() {
+		if f == nil {
+			continue
+		}
+		// interrupts the blocked read
+		err := f.SetReadDeadline(now)
+		if err != nil {
+			return fmt.Errorf("Failed to stop reading pane %d: %s", pane.ID, err)
+		}
+	}
+	select {
+	case <-detached:
+		return nil
+	case <-time.After(detachTimeout):
+		return fmt.Errorf("Failed to stop reading pane %d", pane.ID)
+	}
+}
+
+// resume restarts the pane's read loop after a failed hand off
+func (pane *Pane) resume() {
+	pane.detachM.Lock()
+	stopped := isClosed(pane.detached)
+	pane.detach = make(chan struct{})
+	if stopped {
+		pane.detached = make(chan struct{})
+	}
+	pane.detachM.Unlock()
+	for _, f := range pane.files() {
+		if f != nil {
+			f.SetReadDeadline(time.Time{})
+		}
+	}
+	if !stopped {
+		// the read loop never stopped
+		return
+	}
+	if p, ok := pane.TTY.(*Pipes); ok {
+		pane.stderrDone = make(chan struct{})
+		go pane.stderrLoop(p.Stderr)
+	}
+	go pane.ReadLoop()
+}
+
+// waitAdopted waits for a command started by the previous agent to exit.
+// As the command is not our child, its exit code is unknown.
+func (pane *Pane) waitAdopted() {
+	for syscall.Kill(pane.adoptedPID, 0) != syscall.ESRCH {
+		time.Sleep(time.Second)
+	}
+	pane.exit(-1, "", time.Now())
+}
@@ -0,0 +1,84 @@
+package peers
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// pass simulates passing files to another process
+func pass(t *testing.T, files []*os.File) []*os.File {
+	var r []*os.File
+	for _, f := range files {
+		rc, err := f.SyscallConn()
+		require.NoError(t, err)
+		var fd int
+		rc.Control(func(p uintptr) { fd, err = syscall.Dup(int(p)) })
+		require.NoError(t, err)
+		r = append(r, os.NewFile(uintptr(fd), f.Name()))
+		f.Close()
+	}
+	return r
+}
+
+func TestHandoff(t *testing.T) {
+	conf := &Conf{Logger: zaptest.NewLogger(t).Sugar()}
+	old := NewServer(conf)
+	pane, err := NewPane(old.newOrphanPeer(), &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, pane.run([]string{"cat"}))
+	contains := func(p *Pane, marker int, s string) func() bool {
+		return func() bool {
+			return bytes.Contains(p.Buffer.GetSinceMarker(marker), []byte(s))
+		}
+	}
+	_, err = pane.TTY.Write([]byte("BADWOLF\n"))
+	require.NoError(t, err)
+	require.Eventually(t, contains(pane, -1, "BADWOLF"), time.Second, 10*time.Millisecond)
+	pane.Buffer.Mark(5)
+	h, files, err := old.Detach()
+	require.NoError(t, err)
+	require.Len(t, h.Panes, 1)
+	require.Len(t, files, 1)
+	require.Contains(t, h.Panes[0].Buffer.Markers, 5)
+	// the new agent takes over
+	s := NewServer(conf)
+	s.Adopt(h, pass(t, files))
+	adopted := s.Panes.Get(pane.ID)
+	require.NotNil(t, adopted)
+	_, err = adopted.TTY.Write([]byte("again\n"))
+	require.NoError(t, err)
+	require.Eventually(t, contains(adopted, 5, "again"), time.Second, 10*time.Millisecond)
+	adopted.Kill()
+	require.False(t, adopted.IsRunning)
+}
+
+func TestHandoffResume(t *testing.T) {
+	conf := &Conf{Logger: zaptest.NewLogger(t).Sugar()}
+	s := NewServer(conf)
+	pane, err := NewPane(s.newOrphanPeer(), &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, pane.run([]string{"cat"}))
+	defer pane.Kill()
+	// the hand off failed, the pane is read again
+	_, _, err = s.Detach()
+	require.NoError(t, err)
+	require.True(t, pane.detaching())
+	s.Resume()
+	require.False(t, pane.detaching())
+	_, err = pane.TTY.Write([]byte("BADWOLF\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return bytes.Contains(pane.Buffer.GetSinceMarker(-1), []byte("BADWOLF"))
+	}, time.Second, 10*time.Millisecond)
+	// and it can be detached again
+	_, files, err := s.Detach()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
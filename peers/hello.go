@@ -0,0 +1,150 @@
+// This file holds the hello handshake, where the client and webexec agree
+// on the API version and features the client uses
+package peers
+
+import (
+	"fmt"
+	"sort"
+)
+
+// APIVersion is the version of the API webexec speaks and MinAPIVersion is
+// the oldest version it still supports. Clients that don't send a hello
+// use version 1.
+const (
+	APIVersion    = 2
+	MinAPIVersion = 1
+)
+
+// Features is the list of optional features webexec supports
+var Features = []string{"mux", "offsets", "pipe", "resume", "screen"}
+
+// CTRLMessageTypes returns the sorted list of control messages webexec
+// handles
+func CTRLMessageTypes() []string {
+	types := make([]string, 0, len(ctrlHandlers))
+	for t := range ctrlHandlers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// LabelSyntaxes is the list of data channel labels webexec accepts
+var LabelSyntaxes = []string{"%", "%cbor", MuxLabel, "<command>,<arg>...",
+	"<rows>x<cols>,<command>,<arg>...", "[<rows>x<cols>,]><pane_id>[,read_only]"}
+
+// Encodings is the list of control message encodings webexec supports
+var Encodings = []string{"json", "cbor"}
+
+// HelloArgs is a type that holds the args of a hello message
+type HelloArgs struct {
+	APIVersion int      `json:"api_version"`
+	Features   []string `json:"features,omitempty"`
+	// Encoding, when set, switches the control messages to another
+	// encoding right after the hello's ack
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (a *HelloArgs) Validate() error {
+	if a.APIVersion == 0 {
+		return fmt.Errorf("api_version is required")
+	}
+	if _, found := encodings[a.Encoding]; a.Encoding != "" && !found {
+		return fmt.Errorf("unsupported encoding %q", a.Encoding)
+	}
+	return nil
+}
+
+// HelloReply is the body of a hello ack
+type HelloReply struct {
+	// Version is webexec's version
+	Version       string   `json:"version"`
+	APIVersion    int      `json:"api_version"`
+	MinAPIVersion int      `json:"min_api_version"`
+	MessageTypes  []string `json:"message_types"`
+	Labels        []string `json:"labels"`
+	Encodings     []string `json:"encodings"`
+	Compressions  []string `json:"compressions"`
+	// Features holds the client's features webexec supports
+	Features []string `json:"features"`
+	// Encoding is the encoding of the control messages after the ack
+	Encoding string `json:"encoding"`
+	// Profiles holds the names of the profiles add_pane can launch
+	Profiles []string `json:"profiles"`
+}
+
+// onHello handles a hello message. A client with an unsupported version
+// gets a nack and its control channel is closed. When the client asks for
+// an encoding, the ack is sent in the current encoding and the following
+// messages in the new one.
+func (peer *Peer) onHello(a *HelloArgs, r *ctrlReply) (interface{}, error) {
+	if a.APIVersion < MinAPIVersion || a.APIVersion > APIVersion {
+		peer.logger.Warnf("Rejecting a client with API version %d",
+			a.APIVersion)
+		r.send(nil, ctrlErrorf(CodeUnsupportedVersion,
+			"Unsupported API version %d, webexec supports versions %d to %d",
+			a.APIVersion, MinAPIVersion, APIVersion))
+		peer.connM.Lock()
+		cdc := peer.cdc
+		peer.cdc = nil
+		peer.connM.Unlock()
+		if cdc != nil {
+			cdc.Close()
+		}
+		return nil, errNoReply
+	}
+	features := make(map[string]bool)
+	enc := peer.encoding()
+	if a.Encoding != "" {
+		enc = encodings[a.Encoding]
+	}
+	reply := HelloReply{
+		Version:       peer.Conf.Version,
+		APIVersion:    APIVersion,
+		MinAPIVersion: MinAPIVersion,
+		MessageTypes:  CTRLMessageTypes(),
+		Labels:        LabelSyntaxes,
+		Encodings:     Encodings,
+		Compressions:  Compressions,
+		Features:      []string{},
+		Encoding:      enc.name,
+		Profiles:      []string{},
+	}
+	policy := peer.Policy()
+	for _, name := range peer.server.ProfileNames() {
+		if policy.allowProfile(name) {
+			reply.Profiles = append(reply.Profiles, name)
+		}
+	}
+	for _, f := range a.Features {
+		if Contains(Features, f) && !features[f] {
+			features[f] = true
+			reply.Features = append(reply.Features, f)
+		}
+	}
+	peer.helloM.Lock()
+	peer.APIVersion = a.APIVersion
+	peer.features = features
+	peer.helloM.Unlock()
+	r.send(reply, nil)
+	peer.setEncoding(enc)
+	return nil, errNoReply
+}
+
+// HasFeature returns true when the client said it uses a feature in its
+// hello
+func (peer *Peer) HasFeature(f string) bool {
+	peer.helloM.Lock()
+	defer peer.helloM.Unlock()
+	return peer.features[f]
+}
+
+// Contains returns true when the list has the string
+func Contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package peers
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeChannel records the messages sent on it
+type fakeChannel struct {
+	Channel
+	m    sync.Mutex
+	sent [][]byte
+}
+
+func (f *fakeChannel) Send(data []byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.sent = append(f.sent, data)
+	return nil
+}
+
+func (f *fakeChannel) ReadyState() webrtc.DataChannelState {
+	return webrtc.DataChannelStateOpen
+}
+
+func (f *fakeChannel) BufferedAmount() uint64                    { return 0 }
+func (f *fakeChannel) SetBufferedAmountLowThreshold(th uint64)   {}
+func (f *fakeChannel) OnBufferedAmountLow(func())                {}
+func (f *fakeChannel) OnMessage(func(webrtc.DataChannelMessage)) {}
+func (f *fakeChannel) OnClose(func())                            {}
+func (f *fakeChannel) Close() error                              { return nil }
+
+// newTestPeer returns a peer of a new server, logging to the test. conf can
+// be nil.
+func newTestPeer(t *testing.T, conf *Conf) *Peer {
+	if conf == nil {
+		conf = &Conf{}
+	}
+	conf.Logger = zaptest.NewLogger(t).Sugar()
+	return NewServer(conf).newOrphanPeer()
+}
+
+// attach adds a client of the peer to the pane through the clients db
+func attach(t *testing.T, pane *Pane, peer *Peer, readOnly bool) *Client {
+	c := pane.server.cdb.Add(&fakeChannel{}, pane, peer, false, readOnly)
+	t.Cleanup(c.stop)
+	return c
+}
+
+// newTestPane returns a pane with a client for each of its n peers. When
+// exclusive, the first peer drives the pane.
+func newTestPane(t *testing.T, n int, exclusive bool) (*Pane, []*Client) {
+	peer := newTestPeer(t, nil)
+	pane := newPane(peer, nil)
+	pane.ID = 1
+	if exclusive {
+		pane.driver = newDriverLock(pane, peer)
+	}
+	var clients []*Client
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			peer = pane.server.newOrphanPeer()
+		}
+		peer.ID = i + 1
+		clients = append(clients, attach(t, pane, peer, false))
+	}
+	return pane, clients
+}
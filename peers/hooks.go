@@ -0,0 +1,189 @@
+// This file holds the hooks embedders use to observe the server's peers,
+// panes & clients and to police the commands clients run
+package peers
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Hooks is implemented by applications embedding the server and set in
+// Conf.Hooks. The methods are called synchronously, from the goroutine
+// handling the event, so they should return quickly and not call back into
+// the server. Wrap the hooks with NewAsyncHooks to get the events from a
+// goroutine of their own. Embed NopHooks to implement only some of the
+// methods.
+type Hooks interface {
+	// OnEvent is called with each of the events below
+	OnEvent(e Event)
+	// AllowChannel is called with the label of a data channel a peer
+	// opens, before the label is parsed and its command runs. An error
+	// rejects the channel, it's sent to the client and the channel is
+	// closed.
+	AllowChannel(peer *Peer, label string) error
+	// AllowAddPane is called with the args of an add_pane control message
+	// before the pane is created. The hook can change the args, i.e. the
+	// command or its size, and the changed args are checked against the
+	// peer's policy. An error rejects the message and is sent to the client
+	// in a nack.
+	AllowAddPane(peer *Peer, args *AddPaneArgs) error
+}
+
+// Event is one of the event types below
+type Event interface {
+	event()
+}
+
+// PeerConnectedEvent is sent when a peer's connection is established
+type PeerConnectedEvent struct {
+	Peer *Peer
+}
+
+// PeerDisconnectedEvent is sent when a peer's connection is lost. The peer
+// can connect again until it's closed.
+type PeerDisconnectedEvent struct {
+	Peer *Peer
+}
+
+// PeerClosedEvent is sent when a peer is closed and freed
+type PeerClosedEvent struct {
+	Peer *Peer
+	// LastState is the state the peer was in when it was closed
+	LastState PeerState
+}
+
+// PaneCreatedEvent is sent when a pane's command starts
+type PaneCreatedEvent struct {
+	Pane    *Pane
+	Peer    *Peer
+	Command []string
+}
+
+// PaneExitedEvent is sent when a pane's command exits or is killed
+type PaneExitedEvent struct {
+	Pane   *Pane
+	Status PaneStatus
+}
+
+// ClientAttachedEvent is sent when a peer's data channel is attached to a
+// pane
+type ClientAttachedEvent struct {
+	Pane *Pane
+	Peer *Peer
+}
+
+// ClientDetachedEvent is sent when a peer's data channel is detached from
+// a pane
+type ClientDetachedEvent struct {
+	Pane *Pane
+	Peer *Peer
+}
+
+// CTRLMessageEvent is sent when a peer sends a control message, before
+// it's handled
+type CTRLMessageEvent struct {
+	Peer *Peer
+	Type string
+	Ref  int
+	// Args are JSON encoded, whatever the encoding the client uses
+	Args json.RawMessage
+}
+
+// PolicyDeniedEvent is sent when a peer's policy denies an action, i.e.
+// add_pane, for the audit log
+type PolicyDeniedEvent struct {
+	Peer   *Peer
+	Action string
+	Reason string
+}
+
+func (PeerConnectedEvent) event()    {}
+func (PeerDisconnectedEvent) event() {}
+func (PeerClosedEvent) event()       {}
+func (PaneCreatedEvent) event()      {}
+func (PaneExitedEvent) event()       {}
+func (ClientAttachedEvent) event()   {}
+func (ClientDetachedEvent) event()   {}
+func (CTRLMessageEvent) event()      {}
+func (PolicyDeniedEvent) event()     {}
+
+// NopHooks ignores all events and allows everything
+type NopHooks struct{}
+
+// OnEvent ignores the event
+func (NopHooks) OnEvent(e Event) {}
+
+// AllowChannel allows all channels
+func (NopHooks) AllowChannel(peer *Peer, label string) error { return nil }
+
+// AllowAddPane allows all panes
+func (NopHooks) AllowAddPane(peer *Peer, args *AddPaneArgs) error { return nil }
+
+// asyncHooks sends the events to the hooks from a goroutine, in order.
+// The veto points are still called synchronously.
+type asyncHooks struct {
+	Hooks
+	m      sync.Mutex
+	events []Event
+	wake   chan struct{}
+}
+
+// NewAsyncHooks returns hooks that queue the events and call h.OnEvent
+// from a goroutine of their own, in order, so slow hooks don't slow the
+// server down. AllowChannel & AllowAddPane are called synchronously.
+func NewAsyncHooks(h Hooks) Hooks {
+	a := &asyncHooks{Hooks: h, wake: make(chan struct{}, 1)}
+	go a.deliver()
+	return a
+}
+
+// OnEvent queues the event
+func (a *asyncHooks) OnEvent(e Event) {
+	a.m.Lock()
+	a.events = append(a.events, e)
+	a.m.Unlock()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *asyncHooks) deliver() {
+	for range a.wake {
+		for {
+			a.m.Lock()
+			events := a.events
+			a.events = nil
+			a.m.Unlock()
+			if len(events) == 0 {
+				break
+			}
+			for _, e := range events {
+				a.Hooks.OnEvent(e)
+			}
+		}
+	}
+}
+
+// emit calls the hooks with an event
+func (s *Server) emit(e Event) {
+	if s.Conf.Hooks != nil {
+		s.Conf.Hooks.OnEvent(e)
+	}
+}
+
+// allowChannel asks the hooks whether a peer can open a channel
+func (s *Server) allowChannel(peer *Peer, label string) error {
+	if s.Conf.Hooks == nil {
+		return nil
+	}
+	return s.Conf.Hooks.AllowChannel(peer, label)
+}
+
+// allowAddPane asks the hooks whether a peer can add a pane
+func (s *Server) allowAddPane(peer *Peer, args *AddPaneArgs) error {
+	if s.Conf.Hooks == nil {
+		return nil
+	}
+	return s.Conf.Hooks.AllowAddPane(peer, args)
+}
@@ -0,0 +1,86 @@
+package peers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder records the events it gets
+type recorder struct {
+	NopHooks
+	m      sync.Mutex
+	events []Event
+}
+
+func (r *recorder) OnEvent(e Event) {
+	r.m.Lock()
+	r.events = append(r.events, e)
+	r.m.Unlock()
+}
+
+func (r *recorder) get() []Event {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]Event{}, r.events...)
+}
+
+func TestPaneEvents(t *testing.T) {
+	r := &recorder{}
+	peer := newTestPeer(t, &Conf{Hooks: r})
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, pane.run([]string{"sh", "-c", "exit 3"}))
+	require.Eventually(t, func() bool { return len(r.get()) == 2 },
+		time.Second, 10*time.Millisecond)
+	events := r.get()
+	created, ok := events[0].(PaneCreatedEvent)
+	require.True(t, ok)
+	require.Equal(t, pane, created.Pane)
+	require.Equal(t, []string{"sh", "-c", "exit 3"}, created.Command)
+	exited, ok := events[1].(PaneExitedEvent)
+	require.True(t, ok)
+	require.Equal(t, 3, exited.Status.ExitCode)
+}
+
+func TestAsyncHooks(t *testing.T) {
+	r := &recorder{}
+	h := NewAsyncHooks(r)
+	for i := 0; i < 100; i++ {
+		h.OnEvent(CTRLMessageEvent{Ref: i})
+	}
+	require.Eventually(t, func() bool { return len(r.get()) == 100 },
+		time.Second, 10*time.Millisecond)
+	for i, e := range r.get() {
+		require.Equal(t, i, e.(CTRLMessageEvent).Ref)
+	}
+	require.NoError(t, h.AllowChannel(nil, "24x80,bash"))
+}
+
+// rewriter is a hook that changes the command of the panes
+type rewriter struct {
+	NopHooks
+	command []string
+}
+
+func (r *rewriter) AllowAddPane(peer *Peer, args *AddPaneArgs) error {
+	args.Command = r.command
+	return nil
+}
+
+func TestAllowAddPaneThenPolicy(t *testing.T) {
+	peer := newTestPeer(t, &Conf{
+		Hooks:     &rewriter{command: []string{"bash"}},
+		GetPolicy: staticPolicy(t, &Policy{Commands: []string{"htop"}}),
+	})
+	peer.FP = "FP"
+	// the policy checks the command the hook returns
+	_, err := peer.onAddPane(&AddPaneArgs{Command: []string{"htop"}, Pipe: true},
+		&ctrlReply{peer: peer})
+	requireDenied(t, err)
+	require.Contains(t, err.Error(), "bash")
+	require.Empty(t, peer.server.Panes.All())
+}
@@ -0,0 +1,105 @@
+// This file holds the code for panes whose pty is held by a keeper process
+package peers
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/tuzig/webexec/keeper"
+)
+
+// keepable returns true when the pane's command should run in a keeper
+func (pane *Pane) keepable() bool {
+	return len(pane.peer.Conf.KeeperCommand) > 0 && pane.Ws != nil && !pane.pipe
+}
+
+// runKept starts a keeper that runs the command
+func (pane *Pane) runKept(command []string) error {
+	logger := pane.peer.logger
+	conf := pane.peer.Conf
+	cmd, err := newCommand(command, pane.commandEnv(), pane.cwd, pane.parent,
+		pane.peer.FP)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(conf.KeeperDir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create keepers dir: %s", err)
+	}
+	spec := keeper.Spec{
+		ID:             pane.ID,
+		Socket:         keeper.SocketPath(conf.KeeperDir, pane.ID),
+		Command:        command,
+		Dir:            cmd.Dir,
+		Env:            cmd.Env,
+		Rows:           pane.Ws.Rows,
+		Cols:           pane.Ws.Cols,
+		ScrollbackSize: pane.Buffer.size,
+		Linger:         conf.ExitedPaneTimeout,
+	}
+	logger.Infof("Starting kept command: %v", command)
+	c, err := keeper.Start(conf.KeeperCommand, spec)
+	if err != nil {
+		logger.Warnf("keeper failed: %s", err)
+		return err
+	}
+	pane.keeper = c
+	pane.TTY = c
+	pane.setRunning(true)
+	go pane.waitKeeper()
+	go pane.ReadLoop()
+	return nil
+}
+
+// waitKeeper waits for the kept command to exit and records its exit status
+func (pane *Pane) waitKeeper() {
+	<-pane.keeper.Exited()
+	status := pane.keeper.ExitStatus()
+	pane.exit(status.ExitCode, status.Signal,
+		time.Unix(0, status.EndTime*int64(time.Millisecond)))
+}
+
+// RestoreKeptPanes connects to the keepers a previous agent left behind and
+// rebuilds their panes with the same ids, history & screen
+func (s *Server) RestoreKeptPanes() error {
+	conf := s.Conf
+	if conf.KeeperDir == "" {
+		return nil
+	}
+	sockets, err := keeper.List(conf.KeeperDir)
+	if err != nil {
+		return fmt.Errorf("Failed to list keepers: %s", err)
+	}
+	peer := s.newOrphanPeer()
+	for _, sock := range sockets {
+		c, err := keeper.Dial(sock)
+		if err != nil {
+			conf.Logger.Warnf("Removing stale keeper socket %q: %s", sock, err)
+			os.Remove(sock)
+			continue
+		}
+		ws := &pty.Winsize{Rows: c.Info.Rows, Cols: c.Info.Cols}
+		pane := newPane(peer, ws)
+		pane.ID = c.Info.ID
+		pane.keeper = c
+		pane.TTY = c
+		pane.command = c.Info.Command
+		pane.setRunning(c.Info.Running)
+		err = s.Panes.AddWithID(pane)
+		if err != nil {
+			conf.Logger.Errorf("Failed to restore kept pane: %s", err)
+			c.Close()
+			continue
+		}
+		pane.Buffer.Add(c.Scrollback)
+		pane.Buffer.setOffset(c.Info.Written)
+		pane.vt.Write(c.Scrollback)
+		go pane.waitKeeper()
+		go pane.ReadLoop()
+		conf.Logger.Infof("Restored kept pane %d running %v", pane.ID,
+			c.Info.Command)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// This file holds the peers' lifecycle. A peer moves from connecting to
+// connected and on to disconnected, failed & closed. Peers that fail, close
+// or stay connecting or disconnected for too long are freed.
+package peers
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultStalePeerTimeout is how long a peer can be connecting or
+// disconnected when the configuration doesn't set StalePeerTimeout
+const DefaultStalePeerTimeout = 30 * time.Second
+
+// PeerState is the state of a peer's connection
+type PeerState int
+
+// The states of a peer
+const (
+	PeerConnecting PeerState = iota
+	PeerConnected
+	PeerDisconnected
+	PeerFailed
+	PeerClosed
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerFailed:
+		return "failed"
+	case PeerClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("PeerState(%d)", int(s))
+}
+
+// State returns the peer's state
+func (peer *Peer) State() PeerState {
+	peer.stateM.Lock()
+	defer peer.stateM.Unlock()
+	return peer.state
+}
+
+// startLifecycle starts tracking a new peer's state
+func (peer *Peer) startLifecycle() {
+	peer.stateM.Lock()
+	defer peer.stateM.Unlock()
+	peer.created = time.Now()
+	peer.state = PeerConnecting
+	peer.armStaleTimer()
+}
+
+// onConnectionStateChange moves the peer to the state matching its
+// connection's state
+func (peer *Peer) onConnectionStateChange(state webrtc.PeerConnectionState) {
+	peer.logger.Infof("WebRTC Connection State change: %s", state.String())
+	switch state {
+	case webrtc.PeerConnectionStateNew, webrtc.PeerConnectionStateConnecting:
+		peer.setState(PeerConnecting)
+	case webrtc.PeerConnectionStateConnected:
+		peer.setState(PeerConnected)
+	case webrtc.PeerConnectionStateDisconnected:
+		peer.setState(PeerDisconnected)
+	case webrtc.PeerConnectionStateFailed:
+		peer.setState(PeerFailed)
+		peer.Close()
+	case webrtc.PeerConnectionStateClosed:
+		peer.Close()
+	}
+}
+
+// setState changes the peer's state, arming the stale timer when it's
+// connecting or disconnected
+func (peer *Peer) setState(s PeerState) {
+	peer.stateM.Lock()
+	if peer.state == PeerClosed || peer.state == s {
+		peer.stateM.Unlock()
+		return
+	}
+	peer.state = s
+	if s == PeerConnected && peer.connected.IsZero() {
+		peer.connected = time.Now()
+	}
+	if s == PeerConnecting || s == PeerDisconnected {
+		peer.armStaleTimer()
+	} else if peer.staleTimer != nil {
+		peer.staleTimer.Stop()
+	}
+	peer.stateM.Unlock()
+	switch s {
+	case PeerConnected:
+		peer.server.emit(PeerConnectedEvent{Peer: peer})
+	case PeerDisconnected:
+		peer.server.emit(PeerDisconnectedEvent{Peer: peer})
+	}
+}
+
+// armStaleTimer closes the peer if it stays in its state for too long.
+// It should be called while holding stateM.
+func (peer *Peer) armStaleTimer() {
+	timeout := peer.Conf.StalePeerTimeout
+	if timeout == 0 {
+		timeout = DefaultStalePeerTimeout
+	}
+	if peer.staleTimer != nil {
+		peer.staleTimer.Stop()
+	}
+	s := peer.state
+	peer.staleTimer = time.AfterFunc(timeout, func() {
+		if peer.State() == s {
+			peer.logger.Infof("Closing peer %d, %s for %s", peer.ID, s, timeout)
+			peer.Close()
+		}
+	})
+}
+
+// Close closes the peer's connection and frees its resources: its clients,
+// pending candidates and its place in the server's peers. The panes are left running.
+func (peer *Peer) Close() {
+	peer.stateM.Lock()
+	if peer.state == PeerClosed {
+		peer.stateM.Unlock()
+		return
+	}
+	last := peer.state
+	peer.state = PeerClosed
+	if peer.staleTimer != nil {
+		peer.staleTimer.Stop()
+		peer.staleTimer = nil
+	}
+	peer.stateM.Unlock()
+	for _, c := range peer.server.cdb.All4Peer(peer) {
+		peer.server.cdb.Delete(c)
+		c.dc.Close()
+	}
+	peer.connM.Lock()
+	pc := peer.PC
+	peer.PC = nil
+	peer.cdc = nil
+	x := peer.mux
+	peer.mux = nil
+	peer.connM.Unlock()
+	if x != nil {
+		x.close()
+	}
+	if pc != nil {
+		pc.Close()
+	}
+	// drop the candidates no one will add
+	for len(peer.pendingCandidates) > 0 {
+		<-peer.pendingCandidates
+	}
+	peer.server.Peers.Delete(peer.ID)
+	var up time.Duration
+	if !peer.connected.IsZero() {
+		up = time.Since(peer.connected).Round(time.Second)
+	}
+	peer.logger.Infof(
+		"Peer %d closed: fp %s, last state %s, age %s, connected %s, %d channels, %d control messages",
+		peer.ID, peer.FP, last, time.Since(peer.created).Round(time.Second), up,
+		atomic.LoadInt32(&peer.channels), atomic.LoadInt32(&peer.ctrlMsgs))
+	peer.server.emit(PeerClosedEvent{Peer: peer, LastState: last})
+}
@@ -0,0 +1,50 @@
+package peers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStalePeerIsClosed(t *testing.T) {
+	peer := newTestPeer(t, &Conf{StalePeerTimeout: 50 * time.Millisecond})
+	peer.FP = "stale"
+	peer.server.Peers.Add(peer)
+	peer.startLifecycle()
+	require.Equal(t, PeerConnecting, peer.State())
+	require.Eventually(t, func() bool { return peer.State() == PeerClosed },
+		time.Second, 10*time.Millisecond)
+	require.Nil(t, peer.server.Peers.Get(peer.ID))
+	require.Error(t, peer.AddCandidate(webrtc.ICECandidateInit{}))
+}
+
+func TestConnectedPeerIsKept(t *testing.T) {
+	peer := newTestPeer(t, &Conf{StalePeerTimeout: 50 * time.Millisecond})
+	peer.FP = "connected"
+	peer.server.Peers.Add(peer)
+	peer.startLifecycle()
+	peer.setState(PeerConnected)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, PeerConnected, peer.State())
+	require.Equal(t, peer, peer.server.Peers.Get(peer.ID))
+	// once disconnected for too long, it's closed
+	peer.setState(PeerDisconnected)
+	require.Eventually(t, func() bool { return peer.State() == PeerClosed },
+		time.Second, 10*time.Millisecond)
+	require.Nil(t, peer.server.Peers.Get(peer.ID))
+}
+
+func TestClosedPeerMux(t *testing.T) {
+	peer := newTestPeer(t, nil)
+	x := &mux{peer: peer, streams: make(map[int]*muxStream)}
+	peer.mux = x
+	s, err := x.open(1)
+	require.NoError(t, err)
+	peer.Close()
+	// the streams end with the peer and it can't open a new mux
+	require.Nil(t, peer.getMux())
+	require.Equal(t, webrtc.DataChannelStateClosed, s.ReadyState())
+	require.Error(t, peer.openMux(nil))
+}
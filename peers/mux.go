@@ -0,0 +1,398 @@
+// This file holds the mux channel, a data channel that carries the streams
+// of many panes in frames. Clients with lots of panes use it to avoid the
+// SCTP streams limit and the round trip of opening a channel for each pane.
+package peers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// MuxLabel is the label of the mux channel
+const MuxLabel = "%mux"
+
+// Each mux frame starts with a header: the pane id, 4 bytes in network
+// order, and the frame's type. The payload follows.
+const MuxHeaderSize = 5
+
+// The types of the mux frames
+const (
+	// FrameData carries a pane's output or a client's input
+	FrameData byte = iota
+	// FrameAttach attaches the client to a pane. Its optional payload is a
+	// flags byte followed by an 8 bytes offset to resume from.
+	FrameAttach
+	// FrameDetach detaches the client from a pane
+	FrameDetach
+	// FrameResize resizes a pane. Its payload is the rows & the columns, 2
+	// bytes each in network order.
+	FrameResize
+	// FrameClose is sent when a pane's stream ends. Clients send it to close
+	// the stdin of a pane with no pty.
+	FrameClose
+	// FrameError is sent when a client's frame fails, with the error's
+	// description as payload
+	FrameError
+)
+
+// The flags of an attach frame
+const (
+	// FlagOffsets prefixes the pane's output with its offset
+	FlagOffsets = 1 << iota
+	// FlagDeflate compresses the pane's output with deflate
+	FlagDeflate
+	// FlagScreen syncs the pane's screen instead of streaming its output
+	FlagScreen
+	// FlagReadOnly attaches the client as a viewer
+	FlagReadOnly
+	// FlagZstd compresses the pane's output with zstd
+	FlagZstd
+)
+
+// mux demultiplexes the frames the client sends on a mux channel to its
+// streams and multiplexes the panes' output on it
+type mux struct {
+	peer    *Peer
+	dc      *webrtc.DataChannel
+	m       sync.Mutex
+	streams map[int]*muxStream
+}
+
+// newMux returns a mux for a data channel, handling its frames
+func newMux(peer *Peer, dc *webrtc.DataChannel) *mux {
+	x := &mux{peer: peer, dc: dc, streams: make(map[int]*muxStream)}
+	dc.SetBufferedAmountLowThreshold(lowBufferedAmount)
+	dc.OnBufferedAmountLow(x.onBufferedAmountLow)
+	dc.OnMessage(x.onFrame)
+	dc.OnClose(x.onClose)
+	return x
+}
+
+// openMux makes a data channel the peer's mux channel. A peer has one mux
+// channel, a second one is refused while the first is open.
+func (peer *Peer) openMux(d *webrtc.DataChannel) error {
+	peer.connM.Lock()
+	defer peer.connM.Unlock()
+	if peer.PC == nil {
+		return fmt.Errorf("Peer %d is closed", peer.ID)
+	}
+	if peer.mux != nil {
+		return fmt.Errorf("Peer %d already has a mux channel", peer.ID)
+	}
+	peer.mux = newMux(peer, d)
+	return nil
+}
+
+// getMux returns the peer's mux, nil when it has none
+func (peer *Peer) getMux() *mux {
+	peer.connM.RLock()
+	defer peer.connM.RUnlock()
+	return peer.mux
+}
+
+// send sends a frame
+func (x *mux) send(paneID int, typ byte, payload []byte) error {
+	f := make([]byte, MuxHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(f, uint32(paneID))
+	f[4] = typ
+	copy(f[MuxHeaderSize:], payload)
+	return x.dc.Send(f)
+}
+
+// sendError sends an error frame
+func (x *mux) sendError(paneID int, err error) {
+	x.peer.logger.Warnf("@%d: mux frame failed: %s", paneID, err)
+	err = x.send(paneID, FrameError, []byte(err.Error()))
+	if err != nil {
+		x.peer.logger.Errorf("Failed to send a mux error frame: %s", err)
+	}
+}
+
+// open returns a new stream for a pane
+func (x *mux) open(paneID int) (*muxStream, error) {
+	x.m.Lock()
+	defer x.m.Unlock()
+	if _, found := x.streams[paneID]; found {
+		return nil, fmt.Errorf("Pane %d is already attached", paneID)
+	}
+	s := &muxStream{mux: x, paneID: paneID}
+	x.streams[paneID] = s
+	return s, nil
+}
+
+func (x *mux) get(paneID int) *muxStream {
+	x.m.Lock()
+	defer x.m.Unlock()
+	return x.streams[paneID]
+}
+
+func (x *mux) remove(s *muxStream) {
+	x.m.Lock()
+	if x.streams[s.paneID] == s {
+		delete(x.streams, s.paneID)
+	}
+	x.m.Unlock()
+}
+
+// all returns the mux's streams
+func (x *mux) all() []*muxStream {
+	x.m.Lock()
+	defer x.m.Unlock()
+	r := make([]*muxStream, 0, len(x.streams))
+	for _, s := range x.streams {
+		r = append(r, s)
+	}
+	return r
+}
+
+// onBufferedAmountLow wakes the writers of all the streams, they share the
+// channel's buffer
+func (x *mux) onBufferedAmountLow() {
+	for _, s := range x.all() {
+		s.m.Lock()
+		f := s.onLow
+		s.m.Unlock()
+		if f != nil {
+			f()
+		}
+	}
+}
+
+// onClose ends all the streams when the mux channel closes, so the client can
+// open a new one
+func (x *mux) onClose() {
+	x.peer.logger.Info("The mux channel closed")
+	x.peer.connM.Lock()
+	if x.peer.mux == x {
+		x.peer.mux = nil
+	}
+	x.peer.connM.Unlock()
+	x.close()
+}
+
+// close ends all the streams
+func (x *mux) close() {
+	for _, s := range x.all() {
+		x.remove(s)
+		s.end()
+	}
+}
+
+// onFrame handles a frame sent by the client
+func (x *mux) onFrame(msg webrtc.DataChannelMessage) {
+	if len(msg.Data) < MuxHeaderSize {
+		x.sendError(0, fmt.Errorf("Got a %d bytes frame, shorter than its header",
+			len(msg.Data)))
+		return
+	}
+	id := int(binary.BigEndian.Uint32(msg.Data))
+	payload := msg.Data[MuxHeaderSize:]
+	var err error
+	switch typ := msg.Data[4]; typ {
+	case FrameData:
+		s := x.get(id)
+		if s == nil {
+			err = ctrlErrorf(CodePaneNotFound, "Pane %d is not attached", id)
+			break
+		}
+		s.onData(payload)
+	case FrameAttach:
+		err = x.onAttach(id, payload)
+	case FrameDetach:
+		s := x.get(id)
+		if s == nil {
+			err = ctrlErrorf(CodePaneNotFound, "Pane %d is not attached", id)
+			break
+		}
+		err = s.Close()
+	case FrameResize:
+		if len(payload) != 4 {
+			err = fmt.Errorf("A resize frame's payload should be 4 bytes")
+			break
+		}
+		a := ResizeArgs{PaneID: id,
+			Sy: binary.BigEndian.Uint16(payload),
+			Sx: binary.BigEndian.Uint16(payload[2:])}
+		err = a.Validate()
+		if err == nil {
+			err = x.peer.authorize("resize")
+		}
+		if err == nil {
+			_, err = x.peer.onResize(&a)
+		}
+	case FrameClose:
+		a := CloseStdinArgs{PaneID: id}
+		err = a.Validate()
+		if err == nil {
+			err = x.peer.authorize("close_stdin")
+		}
+		if err == nil {
+			_, err = x.peer.onCloseStdin(&a)
+		}
+	default:
+		err = fmt.Errorf("Unknown frame type: %d", typ)
+	}
+	if err != nil {
+		x.sendError(id, err)
+	}
+}
+
+// onAttach attaches the client to a pane, resuming it from an offset when
+// the payload has one
+func (x *mux) onAttach(id int, payload []byte) error {
+	a := ReconnectPaneArgs{ID: id}
+	switch len(payload) {
+	case 9:
+		offset := int64(binary.BigEndian.Uint64(payload[1:]))
+		a.Offset = &offset
+		fallthrough
+	case 1:
+		a.Offsets = payload[0]&FlagOffsets != 0
+		switch payload[0] & (FlagDeflate | FlagZstd) {
+		case FlagDeflate:
+			a.Compression = "deflate"
+		case FlagZstd:
+			a.Compression = "zstd"
+		case FlagDeflate | FlagZstd:
+			return fmt.Errorf("An attach frame can ask for one compression")
+		}
+		if payload[0]&FlagScreen != 0 {
+			a.Mode = ModeScreen
+		}
+		a.ReadOnly = payload[0]&FlagReadOnly != 0
+	case 0:
+	default:
+		return fmt.Errorf("An attach frame's payload should be 0, 1 or 9 bytes")
+	}
+	err := a.Validate()
+	if err != nil {
+		return err
+	}
+	err = x.peer.authorize("reconnect_pane")
+	if err != nil {
+		return err
+	}
+	_, err = x.peer.attachStream(a)
+	return err
+}
+
+// attachStream attaches a pane to a new stream on the peer's mux channel
+func (peer *Peer) attachStream(a ReconnectPaneArgs) (*Pane, error) {
+	x := peer.getMux()
+	if x == nil {
+		return nil, ctrlErrorf(CodeNoMux, "Peer has no mux channel")
+	}
+	s, err := x.open(a.ID)
+	if err != nil {
+		return nil, err
+	}
+	pane, err := peer.Reconnect(s, a)
+	if err != nil {
+		x.remove(s)
+		return nil, err
+	}
+	return pane, nil
+}
+
+// muxStream is a pane's stream on a mux channel. It implements Channel so
+// it's used like a data channel.
+type muxStream struct {
+	mux    *mux
+	paneID int
+	m      sync.Mutex
+	closed bool
+	// the handlers, as set by OnMessage, OnClose & OnBufferedAmountLow
+	onMessage func(webrtc.DataChannelMessage)
+	onClose   func()
+	onLow     func()
+}
+
+// Send sends a data frame
+func (s *muxStream) Send(data []byte) error {
+	s.m.Lock()
+	closed := s.closed
+	s.m.Unlock()
+	if closed {
+		return fmt.Errorf("The stream of pane %d is closed", s.paneID)
+	}
+	return s.mux.send(s.paneID, FrameData, data)
+}
+
+// ReadyState returns the mux channel's state until the stream is closed
+func (s *muxStream) ReadyState() webrtc.DataChannelState {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return webrtc.DataChannelStateClosed
+	}
+	return s.mux.dc.ReadyState()
+}
+
+// BufferedAmount returns the mux channel's buffered amount
+func (s *muxStream) BufferedAmount() uint64 {
+	return s.mux.dc.BufferedAmount()
+}
+
+// SetBufferedAmountLowThreshold does nothing, the threshold is the mux
+// channel's
+func (s *muxStream) SetBufferedAmountLowThreshold(th uint64) {}
+
+func (s *muxStream) OnBufferedAmountLow(f func()) {
+	s.m.Lock()
+	s.onLow = f
+	s.m.Unlock()
+}
+
+func (s *muxStream) OnMessage(f func(msg webrtc.DataChannelMessage)) {
+	s.m.Lock()
+	s.onMessage = f
+	s.m.Unlock()
+}
+
+func (s *muxStream) OnClose(f func()) {
+	s.m.Lock()
+	s.onClose = f
+	s.m.Unlock()
+}
+
+// Close ends the stream and sends a close frame
+func (s *muxStream) Close() error {
+	s.mux.remove(s)
+	if !s.end() {
+		return nil
+	}
+	if s.mux.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	return s.mux.send(s.paneID, FrameClose, nil)
+}
+
+// end marks the stream as closed and calls its OnClose handler. It returns
+// false when the stream was already closed.
+func (s *muxStream) end() bool {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return false
+	}
+	s.closed = true
+	f := s.onClose
+	s.m.Unlock()
+	if f != nil {
+		f()
+	}
+	return true
+}
+
+// onData passes the client's input to the OnMessage handler
+func (s *muxStream) onData(data []byte) {
+	s.m.Lock()
+	f := s.onMessage
+	s.m.Unlock()
+	if f != nil {
+		f(webrtc.DataChannelMessage{Data: data})
+	}
+}
@@ -2,143 +2,362 @@
 package peers
 
 import (
-	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/creack/pty"
-	"github.com/hinshun/vt10x"
 	"github.com/pion/webrtc/v3"
 	"github.com/shirou/gopsutil/v3/process"
+	"github.com/tuzig/webexec/keeper"
 )
 
 const OutBufSize = 4096
 
-// Panes is an array that hol;ds all the panes
-var Panes = NewPanesDB()
+// OffsetSize is the size of the output offset prefixed to pane messages
+// when the client asks for offsets
+const OffsetSize = 8
+
+// DefaultExitedPaneTimeout is how long an exited pane is kept when the
+// configuration doesn't set ExitedPaneTimeout
+const DefaultExitedPaneTimeout = time.Minute
 
 // Pane type hold a command, a pseudo tty and the connected data channels
 type Pane struct {
 	ID     int
 	parent int
 	// C holds the exectuted command
-	C            *exec.Cmd
-	IsRunning    bool
+	C         *exec.Cmd
+	IsRunning bool
+	// ExitCode holds the command's exit code, -1 when killed by a signal
+	ExitCode int
+	// ExitSignal holds the name of the signal that terminated the command
+	ExitSignal string
+	// EndTime is the time the command exited
+	EndTime time.Time
+	// statusM guards IsRunning & the exit status, set by the goroutine
+	// waiting for the command
+	statusM      sync.RWMutex
 	TTY          io.ReadWriteCloser
 	Buffer       *Buffer
 	Ws           *pty.Winsize
-	vt           vt10x.VT
+	vt           *screen
 	outbuf       chan []byte
 	cancelRWLoop context.CancelFunc
 	ctx          context.Context
 	peer         *Peer
+	server       *Server
+	exited       chan struct{}
+	killOnce     sync.Once
+	// pipe is true when the command runs with no pty, connected through
+	// pipes and its output is tagged with StdoutTag or StderrTag
+	pipe       bool
+	stderrDone chan struct{}
+	// keeper is the connection to the process holding the pty, nil when
+	// the pty is held by us
+	keeper *keeper.Client
+	// adoptedPID is the pid of a command started by a previous agent
+	adoptedPID int
+	// detach is closed to stop the read loop when handing off the pane and
+	// detached is closed once it stopped. detachM guards both as they're
+	// replaced when the pane resumes.
+	detach   chan struct{}
+	detached chan struct{}
+	detachM  sync.Mutex
+	// sendM keeps the screen dump from interleaving with the output
+	sendM sync.Mutex
+	// compression counts the output compressed for the pane's clients
+	compression compressionCounters
+	// cwd & env, when set, are the command's working directory & environment
+	cwd string
+	env map[string]string
+	// preLaunchScript, when set, runs before the command
+	preLaunchScript string
+	// command is the pane's command and profile the profile it was
+	// launched from, checked against the policies of the clients attaching
+	command []string
+	profile string
+	// driver, when set, locks the pane's input to the peer driving it
+	driver *driverLock
 }
 
 // ExecCommand in ahelper function for executing a command
-func ExecCommand(command []string, env map[string]string, ws *pty.Winsize, pID int, fp string) (*exec.Cmd, io.ReadWriteCloser, error) {
+func ExecCommand(command []string, env map[string]string, dir string, ws *pty.Winsize, pID int, fp string) (*exec.Cmd, io.ReadWriteCloser, error) {
+	return execCommand(PtyMuxType{}, command, env, dir, ws, pID, fp)
+}
+
+// ExecCommand executes a command with a pty started by the server's PtyMux
+func (s *Server) ExecCommand(command []string, env map[string]string, dir string, ws *pty.Winsize, pID int, fp string) (*exec.Cmd, io.ReadWriteCloser, error) {
+	return execCommand(s.PtyMux, command, env, dir, ws, pID, fp)
+}
+
+func execCommand(mux PtyMuxInterface, command []string, env map[string]string, dir string, ws *pty.Winsize, pID int, fp string) (*exec.Cmd, io.ReadWriteCloser, error) {
 
 	var (
 		tty *os.File
-		dir string
+		err error
+	)
+	cmd, err := newCommand(command, env, dir, pID, fp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ws != nil {
+		tty, err = mux.StartWithSize(cmd, ws)
+	} else {
+		tty, err = mux.Start(cmd)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed launching %q: %q %s", command, err, fp)
+	}
+	tty, err = nonBlocking(tty)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to set pty as non blocking: %s", err)
+	}
+	return cmd, tty, nil
+}
+
+// newCommand returns a command ready to start in dir, when set, the parent
+// pane's working directory or the user's home. A nil env inherits the
+// agent's environment.
+func newCommand(command []string, env map[string]string, dir string, pID int, fp string) (*exec.Cmd, error) {
+	var (
 		err error
 		pwd string
 	)
 	cmd := exec.Command(command[0], command[1:]...)
-	if pID != 0 {
+	if dir == "" && pID != 0 {
 		p, err := process.NewProcess(int32(pID))
 		if err != nil {
-			return nil, nil, fmt.Errorf("Failed to find parent pane's process: %s %s", err, fp)
+			return nil, fmt.Errorf("Failed to find parent pane's process: %s %s", err, fp)
 		}
 		pwd, err = p.Cwd()
 		if err != nil {
-			return nil, nil, fmt.Errorf("Failed getting parent pane's cwd: %s %s", err, fp)
+			return nil, fmt.Errorf("Failed getting parent pane's cwd: %s %s", err, fp)
 		}
 		dir = pwd
-	} else {
+	} else if dir == "" {
 		dir, err = os.UserHomeDir()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
 	cmd.Dir = dir
 	if env != nil {
+		cmd.Env = make([]string, 0, len(env))
 		for k, v := range env {
 			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 		}
 	}
-	if ws != nil {
-		tty, err = PtyMux.StartWithSize(cmd, ws)
-	} else {
-		tty, err = PtyMux.Start(cmd)
-	}
-	if err != nil {
-		return nil, nil, fmt.Errorf("Failed launching %q: %q %s", command, err, fp)
-	}
-	return cmd, tty, nil
+	return cmd, nil
 }
 
 // NewPane opens a new pane
 func NewPane(peer *Peer, ws *pty.Winsize, parent int) (*Pane, error) {
 
-	var vt vt10x.VT
 	if parent != 0 {
-		parentPane := Panes.Get(parent)
+		parentPane := peer.server.Panes.Get(parent)
 		if parentPane == nil {
 			return nil, fmt.Errorf(
 				"Got a pane request with an illegal parrent pane id: %d", parent)
 		}
-		parent = parentPane.C.Process.Pid
+		parent = parentPane.pid()
 	}
+	pane := newPane(peer, ws)
+	pane.parent = parent
+	peer.server.Panes.Add(pane) // This will set pane.ID
+	return pane, nil
+}
+
+// newPane returns a pane that's not in the database and has no command
+func newPane(peer *Peer, ws *pty.Winsize) *Pane {
+	var vt *screen
 	if ws != nil {
-		vt = vt10x.New()
-		vt.Resize(int(ws.Cols), int(ws.Rows))
+		vt = newScreen(int(ws.Cols), int(ws.Rows))
 	}
+	buffer := peer.newBuffer(peer.Conf.ScrollbackSize)
 	ctx, cancel := context.WithCancel(context.Background())
-	pane := &Pane{
-		parent:       parent,
+	return &Pane{
 		IsRunning:    false,
-		Buffer:       NewBuffer(100000), //TODO: get the number from conf
+		Buffer:       buffer,
 		Ws:           ws,
 		vt:           vt,
 		outbuf:       make(chan []byte, OutBufSize),
 		ctx:          ctx,
 		cancelRWLoop: cancel,
 		peer:         peer,
+		server:       peer.server,
+		exited:       make(chan struct{}),
+		detach:       make(chan struct{}),
+		detached:     make(chan struct{}),
 	}
-	Panes.Add(pane) // This will set pane.ID
-	return pane, nil
+}
+
+// commandEnv returns the environment of the pane's command
+func (pane *Pane) commandEnv() map[string]string {
+	if pane.env != nil {
+		return pane.env
+	}
+	return buildEnv(pane.peer.Conf.Env, nil, InheritAll)
+}
+
+// newBuffer returns a pane's buffer of a given size, spilling to disk when
+// configured
+func (peer *Peer) newBuffer(size int) *Buffer {
+	buffer := NewBuffer(size)
+	if peer.Conf.SpillDir != "" {
+		buffer.SpillTo(peer.Conf.SpillDir, peer.Conf.SpillMax)
+	}
+	return buffer
 }
 
 // start starts the command and pty
 func (pane *Pane) run(command []string) error {
 	logger := pane.peer.logger
 	run := pane.peer.Conf.RunCommand
-	if run == nil {
-		run = ExecCommand
+	if pane.pipe {
+		run = ExecPipeCommand
+	} else if run == nil {
+		run = pane.server.ExecCommand
+	}
+	pane.command = command
+	if pane.preLaunchScript != "" {
+		err := pane.preLaunch(pane.preLaunchScript)
+		if err != nil {
+			logger.Warnf("@%d: %s", pane.ID, err)
+			return err
+		}
+	}
+	if pane.keepable() {
+		err := pane.runKept(command)
+		if err == nil {
+			pane.server.emit(PaneCreatedEvent{
+				Pane: pane, Peer: pane.peer, Command: command})
+		}
+		return err
 	}
 	logger.Infof("Starting command: %v", command)
-	cmd, tty, err := run(
-		command, pane.peer.Conf.Env, pane.Ws, pane.parent, pane.peer.FP)
+	cmd, tty, err := run(command, pane.commandEnv(), pane.cwd, pane.Ws,
+		pane.parent, pane.peer.FP)
 	if err != nil {
 		logger.Warnf("command failed: %s", err)
 		return err
 	}
 	pane.C = cmd
-	pane.IsRunning = true
+	pane.setRunning(true)
 	pane.TTY = tty
-	errbuf := new(bytes.Buffer)
 	if cmd != nil {
-		cmd.Stderr = errbuf
+		go pane.wait()
+	} else {
+		close(pane.exited)
+	}
+	if p, ok := tty.(*Pipes); ok {
+		pane.stderrDone = make(chan struct{})
+		go pane.stderrLoop(p.Stderr)
 	}
-	go pane.stderrLoop(errbuf)
 	go pane.ReadLoop()
+	pane.server.emit(PaneCreatedEvent{
+		Pane: pane, Peer: pane.peer, Command: command})
 	return nil
 }
 
+// wait waits for the command to exit, reaps it and records its exit status
+func (pane *Pane) wait() {
+	logger := pane.peer.logger
+	err := pane.C.Wait()
+	if err != nil {
+		logger.Infof("@%d: command exited: %s", pane.ID, err)
+	}
+	code := 0
+	signal := ""
+	state := pane.C.ProcessState
+	if state != nil {
+		code = state.ExitCode()
+		ws, ok := state.Sys().(syscall.WaitStatus)
+		if ok && ws.Signaled() {
+			signal = ws.Signal().String()
+		}
+	}
+	pane.exit(code, signal, time.Now())
+}
+
+// exit records the command's exit status and closes exited
+func (pane *Pane) exit(code int, signal string, end time.Time) {
+	pane.statusM.Lock()
+	pane.ExitCode = code
+	pane.ExitSignal = signal
+	pane.EndTime = end
+	pane.IsRunning = false
+	pane.statusM.Unlock()
+	close(pane.exited)
+}
+
+// running returns true while the pane's command runs
+func (pane *Pane) running() bool {
+	pane.statusM.RLock()
+	defer pane.statusM.RUnlock()
+	return pane.IsRunning
+}
+
+func (pane *Pane) setRunning(running bool) {
+	pane.statusM.Lock()
+	pane.IsRunning = running
+	pane.statusM.Unlock()
+}
+
+// pid returns the process id of the pane's command
+func (pane *Pane) pid() int {
+	if pane.keeper != nil {
+		return pane.keeper.Info.PID
+	}
+	if pane.C != nil && pane.C.Process != nil {
+		return pane.C.Process.Pid
+	}
+	return pane.adoptedPID
+}
+
+// Status returns the pane's current status
+func (pane *Pane) Status() PaneStatus {
+	pane.statusM.RLock()
+	defer pane.statusM.RUnlock()
+	s := PaneStatus{
+		PaneID:    pane.ID,
+		IsRunning: pane.IsRunning,
+		Offset:    pane.Buffer.Offset(),
+		// the stats of the clients using compression
+		Compression: pane.compression.stats(),
+	}
+	if !pane.EndTime.IsZero() {
+		s.ExitCode = pane.ExitCode
+		s.Signal = pane.ExitSignal
+		s.EndTime = pane.EndTime.UnixNano() / 1000000
+	}
+	return s
+}
+
+// notifyExit sends a pane_exited message to every peer attached to the pane
+func (pane *Pane) notifyExit() {
+	logger := pane.peer.logger
+	status := pane.Status()
+	notified := make(map[*Peer]bool)
+	for _, c := range pane.server.cdb.All4Pane(pane) {
+		if notified[c.peer] || c.peer.controlChannel() == nil {
+			continue
+		}
+		notified[c.peer] = true
+		err := SendCTRLMsg(c.peer, "pane_exited", &status)
+		if err != nil {
+			logger.Warnf("@%d: failed to send pane_exited: %s", pane.ID, err)
+		}
+	}
+	pane.server.emit(PaneExitedEvent{Pane: pane, Status: status})
+}
+
 // sendFirstMessage sends the pane id and dimensions
 func (pane *Pane) sendFirstMessage(dc *webrtc.DataChannel) {
 	var r string
@@ -156,7 +375,11 @@ func (pane *Pane) ReadLoop() {
 	conNull := 0
 	id := pane.ID
 	sctx, cancel := context.WithCancel(context.Background())
-	go pane.sender(sctx)
+	senderDone := make(chan struct{})
+	go func() {
+		pane.sender(sctx)
+		close(senderDone)
+	}()
 	logger.Infof("readding from tty: %v", pane.TTY)
 loop:
 	for {
@@ -165,8 +388,17 @@ loop:
 			break loop
 		default:
 		}
-		b := make([]byte, OutBufSize)
+		buf := make([]byte, OutBufSize)
+		b := buf
+		if pane.pipe {
+			// leave room for the stream tag
+			buf[0] = StdoutTag
+			b = buf[1:]
+		}
 		l, rerr := pane.TTY.Read(b)
+		if rerr != nil && pane.detaching() {
+			break loop
+		}
 		if rerr == io.EOF {
 			logger.Infof("@%d: got EOF in read loop", pane.ID)
 			break loop
@@ -187,77 +419,254 @@ loop:
 			}
 		}
 		conNull = 0
-		pane.outbuf <- b[:l]
+		if pane.pipe {
+			pane.outbuf <- buf[:l+1]
+		} else {
+			pane.outbuf <- b[:l]
+		}
+	}
+	if pane.stderrDone != nil {
+		// stderr may have a few more lines
+		<-pane.stderrDone
+	}
+	if pane.detaching() {
+		// the pane is handed off, flush the output & leave it running
+		cancel()
+		<-senderDone
+		pane.stoppedReading()
+		return
 	}
 
 	// TODO: find a better way to wait for all the messages to be sent
 	time.AfterFunc(time.Second/10, func() {
 		cancel()
-		pane = Panes.Get(id)
 		pane.Kill()
 	})
 }
 
+// sender sends the pane's output, coalescing bursts of output into larger
+// messages
 func (pane *Pane) sender(ctx context.Context) {
 	logger := pane.peer.logger
+	c := pane.newCoalescer()
+	// flushC fires when the pending output's window ends
+	var flushC <-chan time.Time
 loop:
 	for {
 		select {
 		case <-ctx.Done():
+			// flush what's left
+			for len(pane.outbuf) > 0 {
+				c.add(<-pane.outbuf, time.Now())
+			}
+			c.flush(time.Now())
 			break loop
 		case m, ok := <-pane.outbuf:
 			if !ok {
+				c.flush(time.Now())
 				break loop
 			}
-			// We need to get the dcs from Panes for an updated version
-			cs := cdb.All4Pane(pane)
-			logger.Infof("@%d: Sending %d bytes to %d dcs", pane.ID, len(m), len(cs))
-			for _, d := range cs {
-				s := d.dc.ReadyState()
-				if s == webrtc.DataChannelStateOpen {
-					err := d.dc.Send(m)
-					if err != nil {
-						logger.Errorf("got an error when sending message: %v", err)
-					}
-				} else {
-					logger.Infof("closing & removing dc because state: %q", s)
-					cdb.Delete(d)
-					d.dc.Close()
-				}
-			}
-			if pane.vt != nil {
-				pane.vt.Write(m)
+			if c.add(m, time.Now()) && flushC == nil {
+				flushC = time.After(c.window)
 			}
-			pane.Buffer.Add(m)
+		case <-flushC:
+			flushC = nil
+			c.flush(time.Now())
 		}
 	}
 	logger.Infof("Exiting the sender loop for pane %d ", pane.ID)
 }
 
-// Kill takes a pane to the sands of Rishon and buries it
-func (pane *Pane) Kill() {
+// send sends a message to the pane's data channels and adds it to the
+// buffer & virtual terminal
+func (pane *Pane) send(m []byte) {
 	logger := pane.peer.logger
-	logger.Infof("Killing a pane")
-	for _, d := range cdb.All4Pane(pane) {
-		if d.dc.ReadyState() == webrtc.DataChannelStateOpen {
+	pane.sendM.Lock()
+	defer pane.sendM.Unlock()
+	if pane.vt != nil {
+		pane.vt.Write(m)
+	}
+	if !pane.pipe {
+		pane.Buffer.Add(m)
+	} else if m[0] == StdoutTag {
+		// only stdout is kept in the history buffer
+		pane.Buffer.Add(m[1:])
+	}
+	var withOffset []byte
+	// We need to get the dcs from Panes for an updated version
+	cs := pane.server.cdb.All4Pane(pane)
+	logger.Infof("@%d: Sending %d bytes to %d dcs", pane.ID, len(m), len(cs))
+	for _, d := range cs {
+		s := d.dc.ReadyState()
+		if s != webrtc.DataChannelStateOpen {
+			logger.Infof("closing & removing dc because state: %q", s)
+			pane.server.cdb.Delete(d)
 			d.dc.Close()
+			continue
+		}
+		if d.sync != nil {
+			d.sync.signal()
+			continue
 		}
-		cdb.Delete(d)
+		msg := m
+		if d.offsets {
+			if withOffset == nil {
+				withOffset = prefixOffset(pane.Buffer.Offset(), m)
+			}
+			msg = withOffset
+		}
+		if d.enqueue(msg) {
+			continue
+		}
+		if pane.vt == nil {
+			// with no screen to redraw, the client has to resume from the
+			// offset it got to
+			logger.Infof("@%d: client %d is behind, disconnecting it", pane.ID, d.id)
+			d.report(CodeTooSlow, fmt.Sprintf(
+				"Pane %d's client fell behind and was disconnected", pane.ID))
+			pane.server.cdb.Delete(d)
+			d.dc.Close()
+			continue
+		}
+		// the client is too far behind, it's faster to send the screen
+		logger.Infof("@%d: client %d is behind, dropping its queue", pane.ID, d.id)
+		d.reset(pane.snapshot(d.offsets))
 	}
-	if pane.IsRunning {
-		pane.cancelRWLoop()
-		if pane.C != nil {
-			err := pane.C.Process.Kill()
+}
+
+// snapshot returns a rendering of the screen, nil for panes with no screen.
+// It should be called while holding sendM.
+func (pane *Pane) snapshot(offsets bool) []byte {
+	if pane.vt == nil {
+		return nil
+	}
+	b := pane.vt.Render()
+	if offsets {
+		b = prefixOffset(pane.Buffer.Offset(), b)
+	}
+	return b
+}
+
+// prefixOffset returns a message prefixed with the pane's output offset
+// after the message, 8 bytes in network order
+func prefixOffset(offset int64, m []byte) []byte {
+	r := make([]byte, OffsetSize+len(m))
+	binary.BigEndian.PutUint64(r, uint64(offset))
+	copy(r[OffsetSize:], m)
+	return r
+}
+
+// Resume adds a data channel as the pane's client after sending it the
+// output since an offset. When the offset was overwritten the client gets
+// a rendering of the screen instead. The pane's sender is held so no output
+// is lost or sent twice.
+func (pane *Pane) Resume(d Channel, peer *Peer, offset int64, offsets bool, readOnly bool) *Client {
+	logger := pane.peer.logger
+	pane.sendM.Lock()
+	defer pane.sendM.Unlock()
+	end := pane.Buffer.Offset()
+	if offset < pane.Buffer.oldest() || offset > end {
+		logger.Infof("@%d: offset %d is not in the buffer, sending the screen",
+			pane.ID, offset)
+		if pane.vt != nil {
+			err := d.Send(pane.snapshot(offsets))
 			if err != nil {
-				logger.Errorf("Failed to kill process: %v %v",
-					err, pane.C.ProcessState.String())
+				logger.Errorf("Failed to send the screen: %s", err)
 			}
+			return pane.server.cdb.Add(d, pane, peer, offsets, readOnly)
 		}
-		pane.IsRunning = false
+		// pipe panes have no screen, send what we have
+		offset = pane.Buffer.oldest()
+	}
+	// send in chunks, each ending at its offset
+	pane.Buffer.ReadSinceOffset(offset, func(b []byte) error {
+		for len(b) > 0 {
+			l := len(b)
+			if l > OutBufSize {
+				l = OutBufSize
+			}
+			chunk := b[:l]
+			if pane.pipe {
+				chunk = append([]byte{StdoutTag}, chunk...)
+			}
+			offset += int64(l)
+			if offsets {
+				chunk = prefixOffset(offset, chunk)
+			}
+			err := d.Send(chunk)
+			if err != nil {
+				logger.Errorf("Failed to send the missing output: %s", err)
+				return err
+			}
+			b = b[l:]
+		}
+		return nil
+	})
+	return pane.server.cdb.Add(d, pane, peer, offsets, readOnly)
+}
+
+// Kill takes a pane to the sands of Rishon and buries it.
+// The exited pane is kept in Panes for ExitedPaneTimeout so clients can
+// still query its exit status.
+func (pane *Pane) Kill() {
+	pane.killOnce.Do(pane.kill)
+}
+
+func (pane *Pane) kill() {
+	logger := pane.peer.logger
+	logger.Infof("Killing a pane")
+	pane.cancelRWLoop()
+	running := pane.running()
+	if running && pane.keeper != nil {
+		err := pane.keeper.Kill()
+		if err != nil {
+			logger.Errorf("Failed to kill kept process: %v", err)
+		}
+	} else if running && pane.C != nil {
+		err := pane.C.Process.Kill()
+		if err != nil {
+			logger.Errorf("Failed to kill process: %v", err)
+		}
+	} else if running && pane.adoptedPID != 0 {
+		err := syscall.Kill(pane.adoptedPID, syscall.SIGKILL)
+		if err != nil {
+			logger.Errorf("Failed to kill adopted process: %v", err)
+		}
+	}
+	if pane.C != nil || pane.keeper != nil || pane.adoptedPID != 0 {
+		select {
+		case <-pane.exited:
+		case <-time.After(time.Second):
+			logger.Warnf("@%d: timed out waiting for the command to exit", pane.ID)
+		}
+	}
+	pane.setRunning(false)
+	pane.notifyExit()
+	for _, d := range pane.server.cdb.All4Pane(pane) {
+		if d.dc.ReadyState() == webrtc.DataChannelStateOpen {
+			d.flush()
+			d.dc.Close()
+		}
+		pane.server.cdb.Delete(d)
 	}
 	if pane.TTY != nil {
 		pane.TTY.Close()
 	}
+	timeout := pane.peer.Conf.ExitedPaneTimeout
+	if timeout == 0 {
+		timeout = DefaultExitedPaneTimeout
+	}
+	time.AfterFunc(timeout, func() {
+		pane.server.Panes.Delete(pane.ID)
+		pane.Buffer.Close()
+	})
+}
+
+// discard removes a pane whose command didn't start and frees its buffer
+func (pane *Pane) discard() {
+	pane.cancelRWLoop()
+	pane.server.Panes.Delete(pane.ID)
+	pane.Buffer.Close()
 }
 
 // OnMessage is called when a new client message is recieved
@@ -287,61 +696,51 @@ func (pane *Pane) Resize(ws *pty.Winsize) {
 	if ws != nil && (ws.Rows != pane.Ws.Rows || ws.Cols != pane.Ws.Cols) {
 		logger.Infof("Changing pty size for pane %d: %v", pane.ID, ws)
 		pane.Ws = ws
-		pty.Setsize(pane.TTY.(*os.File), ws)
+		if pane.keeper != nil {
+			err := pane.keeper.Resize(ws.Rows, ws.Cols)
+			if err != nil {
+				logger.Warnf("Failed to resize kept pane %d: %s", pane.ID, err)
+			}
+		} else {
+			pty.Setsize(pane.TTY.(*os.File), ws)
+		}
 		if pane.vt != nil {
 			pane.vt.Resize(int(ws.Cols), int(ws.Rows))
 		}
+		for _, c := range pane.server.cdb.All4Pane(pane) {
+			if c.sync != nil {
+				c.sync.signal()
+			}
+		}
 	}
 }
 
-func (pane *Pane) dumpVT() {
+// dumpVT sends an ANSI rendering of the screen to a data channel in a single
+// message
+func (pane *Pane) dumpVT(d Channel) {
 	logger := pane.peer.logger
-	var (
-		view []byte
-		c    rune
-	)
-	t := pane.vt
-	t.Lock()
-	defer t.Unlock()
-	rows, cols := t.Size()
-	logger.Infof("dumping scree size %dx%d", rows, cols)
-	for y := 0; y < rows; y++ {
-		for x := 0; x < cols; x++ {
-			c, _, _ = t.Cell(x, y)
-			view = append(view, byte(c))
-		}
-		if y < rows-1 {
-			view = append(view, byte('\n'))
-			view = append(view, byte('\r'))
-		}
-		pane.outbuf <- view
-		view = nil
-	}
-	// position the cursor
-	x, y := t.Cursor()
-	logger.Infof("Got cursor at: %d, %d", x, y)
-	ps := fmt.Sprintf("\x1b[%d;%dH", y+1, x+1)
-	pane.outbuf <- []byte(ps)
+	pane.sendM.Lock()
+	defer pane.sendM.Unlock()
+	view := pane.vt.Render()
+	logger.Infof("@%d: sending a %d bytes screen dump", pane.ID, len(view))
+	err := d.Send(view)
+	if err != nil {
+		logger.Errorf("Failed to send the screen dump: %s", err)
+	}
 }
 
 // Restore restore the screen or buffer.
 // If the peer has a marker data will be read from the buffer and sent over.
 // If no marker, Restore uses our headless terminal emulator to restore the
 // screen.
-func (pane *Pane) Restore(d *webrtc.DataChannel, marker int) {
+func (pane *Pane) Restore(d Channel, marker int) {
 	logger := pane.peer.logger
 	if marker == -1 {
 		if pane.vt != nil {
-			id := d.ID()
-			if id == nil {
-				logger.Error(
-					"Failed restoring to a data channel that has no id")
-			}
-			logger.Infof(
-				"Sending scrren dump to pane: %d, dc: %d", pane.ID, *id)
+			logger.Infof("Sending scrren dump to pane: %d", pane.ID)
 			//TODO: this and the next afterfunc is silly
 			time.AfterFunc(time.Second/10, func() {
-				pane.dumpVT()
+				pane.dumpVT(d)
 			})
 		} else {
 			logger.Warn("not restoring as st is null")
@@ -349,27 +748,44 @@ func (pane *Pane) Restore(d *webrtc.DataChannel, marker int) {
 	} else {
 		logger.Infof("Sending history buffer since marker: %d", marker)
 		time.AfterFunc(time.Second/10, func() {
-			pane.outbuf <- pane.Buffer.GetSinceMarker(marker)
+			b := pane.Buffer.GetSinceMarker(marker)
+			if pane.pipe {
+				b = append([]byte{StdoutTag}, b...)
+			}
+			pane.outbuf <- b
 		})
 	}
 }
-func (pane *Pane) stderrLoop(errors *bytes.Buffer) {
+
+// stderrLoop reads the stderr pipe of a pane with no pty and sends it
+// tagged with StderrTag
+func (pane *Pane) stderrLoop(stderr io.Reader) {
 	logger := pane.peer.logger
-loop:
+	defer close(pane.stderrDone)
 	for {
-		select {
-		case <-pane.ctx.Done():
-			break loop
-		default:
+		b := make([]byte, OutBufSize)
+		b[0] = StderrTag
+		l, err := stderr.Read(b[1:])
+		if l > 0 {
+			pane.outbuf <- b[:l+1]
 		}
-		line, err := errors.ReadString('\n')
 		if err == io.EOF {
 			logger.Infof("@%d: got EOF in stderr loop", pane.ID)
-			break loop
+			return
 		}
 		if err != nil {
-			logger.Errorf("@%d: got an error reading stderr: %s", pane.ID, err)
+			logger.Infof("@%d: stopped reading stderr: %s", pane.ID, err)
+			return
 		}
-		logger.Errorf("@%d: stderr: %s", line)
 	}
 }
+
+// CloseStdin closes the stdin of a pane with no pty so the command reads
+// an EOF
+func (pane *Pane) CloseStdin() error {
+	w, ok := pane.TTY.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("pane %d has no stdin pipe", pane.ID)
+	}
+	return w.CloseWrite()
+}
@@ -27,6 +27,23 @@ func (pd *PanesDB) Add(p *Pane) {
 	pd.panes[p.ID] = p
 }
 
+// AddWithID adds a pane that already has an id, i.e. a pane restored from
+// its keeper, making sure new panes get higher ids
+func (pd *PanesDB) AddWithID(p *Pane) error {
+	pd.m.Lock()
+	defer pd.m.Unlock()
+
+	_, found := pd.panes[p.ID]
+	if found {
+		return fmt.Errorf("pane %d already exists", p.ID)
+	}
+	if p.ID > pd.nextID {
+		pd.nextID = p.ID
+	}
+	pd.panes[p.ID] = p
+	return nil
+}
+
 // All returns a slice with all the panes in the database
 func (pd *PanesDB) All() []*Pane {
 	pd.m.Lock()
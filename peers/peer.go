@@ -11,40 +11,28 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/creack/pty"
 	"github.com/pion/webrtc/v3"
-	"github.com/riywo/loginshell"
 	"go.uber.org/zap"
 )
 
 const keepAliveInterval = 2 * time.Second
 
-// RunCommandInterface is an interface for a function that runs a command
-type RunCommandInterface func([]string, map[string]string, *pty.Winsize, int, string) (*exec.Cmd, io.ReadWriteCloser, error)
-
-var (
-	// Peers holds all the peers (connected and disconnected)
-	Peers map[string]*Peer
-	// Payload holds the client's payload
-	Payload []byte
-	// WebRTCAPI is the gateway to webrtc calls
-	WebRTCAPI *webrtc.API
-	// the id of the last marker used
-	lastMarker = 0
-	markerM    sync.RWMutex
-	webrtcAPIM sync.Mutex
-	peersM     sync.Mutex
-	cdb        = NewClientsDB()
-)
+// RunCommandInterface is an interface for a function that runs a command. Its
+// args are the command, its environment, its working directory, the pty's
+// size, the parent pane's pid and the peer's fingerprint.
+type RunCommandInterface func([]string, map[string]string, string, *pty.Winsize, int, string) (*exec.Cmd, io.ReadWriteCloser, error)
 
 type Conf struct {
 	DisconnectTimeout time.Duration
 	FailedTimeout     time.Duration
 	KeepAliveInterval time.Duration
 	GatheringTimeout  time.Duration
+	ExitedPaneTimeout time.Duration
 	GetICEServers     func() ([]webrtc.ICEServer, error)
 	Env               map[string]string
 	PortMin           uint16
@@ -52,102 +40,121 @@ type Conf struct {
 	Logger            *zap.SugaredLogger
 	Certificate       *webrtc.Certificate
 	RunCommand        RunCommandInterface
+	// KeeperCommand is the command that starts a pane keeper process,
+	// i.e. `webexec keeper`. When set, panes with a pty are kept by a
+	// keeper and survive agent restarts
+	KeeperCommand []string
+	// KeeperDir is the directory of the keepers' sockets
+	KeeperDir string
+	// StalePeerTimeout is how long a peer can be connecting or disconnected
+	// before it's closed
+	StalePeerTimeout time.Duration
+	// ScrollbackSize is the number of bytes each pane keeps in memory
+	ScrollbackSize int
+	// SpillDir, when set, is where panes spill their older history, up
+	// to SpillMax compressed bytes per pane
+	SpillDir string
+	SpillMax int64
+	// Version is webexec's version, sent in the reply to hello
+	Version string
+	// Hooks, when set, is called with the server's events and can reject
+	// channels & panes
+	Hooks Hooks
+	// Profiles are the named commands clients can launch
+	Profiles []Profile
+	// ProfilesOnly restricts add_pane to the profiles
+	ProfilesOnly bool
+	// GetPolicy, when set, returns the policy of a client with a given
+	// fingerprint & token, nil to allow it everything
+	GetPolicy func(fp string, token string) (*Policy, error)
+	// CoalesceWindow is how long a burst of a pane's output is collected
+	// into one message, negative to send each read as is. MaxMessageSize
+	// is the size of the largest coalesced message.
+	CoalesceWindow time.Duration
+	MaxMessageSize int
 }
 
-// Peer is a type used to remember a client.
+// Peer is a type used to remember a client's connection.
 type Peer struct {
-	FP                string
-	Token             string
-	LastContact       *time.Time
-	LastRef           int
-	PC                *webrtc.PeerConnection
-	cdc               *webrtc.DataChannel
+	// ID is unique for each connection
+	ID          int
+	FP          string
+	Token       string
+	LastContact *time.Time
+	LastRef     int
+	PC          *webrtc.PeerConnection
+	cdc         *webrtc.DataChannel
+	// connM guards PC, cdc & mux, that are set to nil when the peer is
+	// closed
+	connM             sync.RWMutex
 	Marker            int
 	pendingCandidates chan *webrtc.ICECandidateInit
 	logger            *zap.SugaredLogger
 	Conf              *Conf
+	server            *Server
+	// mux is the peer's mux channel, nil until the client opens one
+	mux *mux
+	// APIVersion is the API version the client uses, set by hello,
+	// features are the optional features it uses and enc is the encoding
+	// of its control messages
+	APIVersion int
+	features   map[string]bool
+	enc        *encoding
+	helloM     sync.Mutex
+	// the peer's lifecycle, see lifecycle.go
+	state      PeerState
+	stateM     sync.Mutex
+	staleTimer *time.Timer
+	created    time.Time
+	connected  time.Time
+	// counters for the summary logged when the peer is closed
+	channels int32
+	ctrlMsgs int32
+	// policy limits what the client can do, see policy.go
+	policy     *Policy
+	policyOnce sync.Once
 }
 
-// NewPeer funcions starts listening to incoming peer connection from a remote
-func NewPeer(fp string, conf *Conf) (*Peer, error) {
-	webrtcAPIM.Lock()
-	if WebRTCAPI == nil {
-		s := webrtc.SettingEngine{}
-		if conf.PortMax > 0 {
-			s.SetEphemeralUDPPortRange(conf.PortMin, conf.PortMax)
-		}
-		s.SetICETimeouts(
-			conf.DisconnectTimeout, conf.FailedTimeout, conf.KeepAliveInterval)
-		WebRTCAPI = webrtc.NewAPI(webrtc.WithSettingEngine(s))
-	}
-	webrtcAPIM.Unlock()
-	iceservers, err := conf.GetICEServers()
-	if err != nil {
-		conf.Logger.Errorf("Failed to get ICE servers: %s", err)
-	}
-	config := webrtc.Configuration{
-		PeerIdentity: "webexec",
-		ICEServers:   iceservers,
-		Certificates: []webrtc.Certificate{*conf.Certificate},
-	}
-	pc, err := WebRTCAPI.NewPeerConnection(config)
-	if err != nil {
-		return nil, fmt.Errorf("NewPeerConnection failed: %s", err)
-	}
-	peer := Peer{
-		FP:                fp,
-		Token:             "",
-		LastContact:       nil,
-		LastRef:           0,
-		PC:                pc,
-		Marker:            -1,
-		pendingCandidates: make(chan *webrtc.ICECandidateInit, 8),
-		logger:            conf.Logger,
-		Conf:              conf,
-	}
-	peersM.Lock()
-	if Peers == nil {
-		Peers = make(map[string]*Peer)
-	}
-	Peers[fp] = &peer
-	peersM.Unlock()
-	// Status changes happend when the peer has connected/disconnected
-	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		peer.logger.Infof("WebRTC Connection State change: %s", state.String())
-		if state == webrtc.PeerConnectionStateFailed {
-			peer.PC.Close()
-			peer.PC = nil
-			return
-		}
-		if state == webrtc.PeerConnectionStateConnecting {
-			for c := range peer.pendingCandidates {
-				err := pc.AddICECandidate(*c)
-				if err != nil {
-					peer.logger.Errorf("Failed to add ice candidate: %s", err)
-				}
-			}
-		}
-	})
-	pc.OnDataChannel(peer.OnChannelReq)
-	return &peer, nil
+// GetPC returns the peer's connection, nil once the peer is closed
+func (peer *Peer) GetPC() *webrtc.PeerConnection {
+	peer.connM.RLock()
+	defer peer.connM.RUnlock()
+	return peer.PC
+}
+
+// controlChannel returns the peer's control channel, nil when it has none
+func (peer *Peer) controlChannel() *webrtc.DataChannel {
+	peer.connM.RLock()
+	defer peer.connM.RUnlock()
+	return peer.cdc
+}
+
+func (peer *Peer) setControlChannel(d *webrtc.DataChannel) {
+	peer.connM.Lock()
+	peer.cdc = d
+	peer.connM.Unlock()
 }
 
 // Listen get's a client offer, starts listens to it and returns an answear
+// with all the ICE candidates, for clients that don't trickle them
 func (peer *Peer) Listen(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
 	peer.logger.Infof("Listening to: %v", offer)
-	err := peer.PC.SetRemoteDescription(offer)
+	pc := peer.GetPC()
+	if pc == nil {
+		return nil, fmt.Errorf("peer %d is closed", peer.ID)
+	}
+	err := pc.SetRemoteDescription(offer)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to set remote description: %s", err)
 	}
-	answer, err := peer.PC.CreateAnswer(nil)
+	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
 		return nil, err
 	}
 	// Sets the LocalDescription, and starts listning for UDP packets
 	// Create channel that is blocked until ICE Gathering is complete
-	// TODO: remove this and erplace with ICE trickle
-	gatherComplete := webrtc.GatheringCompletePromise(peer.PC)
-	err = peer.PC.SetLocalDescription(answer)
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(answer)
 	if err != nil {
 		return nil, err
 	}
@@ -156,56 +163,81 @@ func (peer *Peer) Listen(offer webrtc.SessionDescription) (*webrtc.SessionDescri
 		return nil, fmt.Errorf("timed out waiting to finish gathering ICE candidates")
 	case <-gatherComplete:
 	}
-	return peer.PC.LocalDescription(), nil
+	return pc.LocalDescription(), nil
 }
 
-// OnChannelReq starts the cdc channel.
-// Upon establishing the connection, the client opens this channel with the
-// api version he uses
+// Answer sets the client's offer and returns the answer with no waiting for
+// ICE gathering. onCandidate is called with each local candidate as it's
+// gathered and with nil when gathering is complete.
+func (peer *Peer) Answer(offer webrtc.SessionDescription,
+	onCandidate func(*webrtc.ICECandidate)) (*webrtc.SessionDescription, error) {
+
+	peer.logger.Infof("Answering: %v", offer)
+	pc := peer.GetPC()
+	if pc == nil {
+		return nil, fmt.Errorf("peer %d is closed", peer.ID)
+	}
+	pc.OnICECandidate(onCandidate)
+	err := pc.SetRemoteDescription(offer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set remote description: %s", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// OnChannelReq is called when the client opens a data channel, either the
+// control channel or a channel to a pane
 func (peer *Peer) OnChannelReq(d *webrtc.DataChannel) {
 	// the singalig channel is used for test setup
 	if d.Label() == "signaling" {
 		return
 	}
 	label := d.Label()
+	atomic.AddInt32(&peer.channels, 1)
 	peer.logger.Infof("Got a channel request: channel label %q", label)
-	if label != "%" {
-		peer.logger.Errorf("Closing client with wrong version: %s", label)
-	}
 	d.OnOpen(func() {
-		pane, err := peer.GetOrCreatePane(d)
+		err := peer.server.allowChannel(peer, label)
+		if err != nil {
+			msg := fmt.Sprintf("Channel %q rejected: %s", label, err)
+			d.Send([]byte(msg))
+			peer.logger.Warnf(msg)
+			d.Close()
+			return
+		}
+		_, err = peer.GetOrCreatePane(d)
 		if err != nil {
 			msg := fmt.Sprintf("Failed to get or create pane for dc %q: %s",
 				d.Label(), err)
 			d.Send([]byte(msg))
 			peer.logger.Errorf(msg)
 		}
-		if pane != nil {
-			c := cdb.Add(d, pane, peer)
-			d.OnMessage(pane.OnMessage)
-			d.OnClose(func() {
-				cdb.Delete(c)
-			})
-		}
-		if label != "%" {
-			peer.logger.Infof("Ignoring a strange channel label %q", label)
-		}
 	})
 }
 
-// GetOrCreatePane gets a data channel and creates an associated pane
+// GetOrCreatePane gets a data channel, creates an associated pane or gets
+// the pane to reconnect to and adds the channel as the pane's client.
 // The function parses the label to figure out what it needs to exec:
 //
 //	the command to run and rows & cols of the pseudo tty.
 //
 // returns a nil when it fails to parse the channel name or when the name is
-// '%' used for command & control channel.
+// '%' used for command & control channel. "%cbor" opens a control channel
+// that uses the CBOR encoding and "%mux" opens the mux channel.
 //
 // label examples:
 //
 //	     simple form with no pty: `echo,Hello world`
 //			to start bash: `24x80,bash`
 //			to reconnect to pane id 123: `>123`
+//			to watch pane id 123 as a read only client: `>123,read_only`
 func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 	var (
 		err      error
@@ -218,11 +250,21 @@ func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 	// i.e. "24x80,echo,Hello World"
 	l := d.Label()
 	fields := strings.Split(l, ",")
+	// "%mux" carries the streams of many panes
+	if l == MuxLabel {
+		peer.logger.Info("Got a request to open a mux channel")
+		return nil, peer.openMux(d)
+	}
 	// "%" is the command & control channel - aka cdc
 	if l[0] == '%' {
 		//TODO: if there's an older cdc close it
-		peer.logger.Info("Got a request to open a control channel")
-		peer.cdc = d
+		enc, err := labelEncoding(l)
+		if err != nil {
+			return nil, err
+		}
+		peer.logger.Infof("Got a request to open a %s control channel", enc.name)
+		peer.setEncoding(enc)
+		peer.setControlChannel(d)
 		d.OnMessage(peer.OnCTRLMsg)
 		return nil, nil
 	}
@@ -249,8 +291,28 @@ func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 			return nil, fmt.Errorf("Got an error converting incoming reconnect id : %q",
 				fields[cmdIndex])
 		}
+		a := ReconnectPaneArgs{ID: id}
+		for _, flag := range fields[cmdIndex+1:] {
+			if flag != ReadOnlyLabelFlag {
+				return nil, fmt.Errorf("Got an unknown reconnect flag: %q", flag)
+			}
+			a.ReadOnly = true
+		}
 		peer.logger.Infof("Got a reconnect request to pane %d", id)
-		return peer.Reconnect(d, id)
+		err = peer.authorize("reconnect_pane")
+		if err != nil {
+			return nil, err
+		}
+		return peer.Reconnect(d, a)
+	}
+	if peer.Conf.ProfilesOnly {
+		return nil, ctrlErrorf(CodeUnauthorized,
+			"Only profiles can be launched, got a command")
+	}
+	// label panes run under a pty, sized or not
+	err = peer.authorizePane("channel", fields[cmdIndex:], "", true)
+	if err != nil {
+		return nil, err
 	}
 	pane, err = NewPane(peer, ws, 0)
 	if err != nil {
@@ -258,11 +320,18 @@ func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 	}
 	if pane != nil {
 		pane.sendFirstMessage(d)
+		// the client is added first so it gets all of the command's output
+		c := peer.server.cdb.Add(d, pane, peer, false, false)
 		err = pane.run(fields[cmdIndex:])
 		if err != nil {
+			peer.server.cdb.Delete(c)
+			pane.discard()
 			return nil, fmt.Errorf("Failed to run command: %q", err)
 		}
-		go pane.ReadLoop()
+		d.OnMessage(c.input)
+		d.OnClose(func() {
+			peer.server.cdb.Delete(c)
+		})
 		return pane, nil
 	}
 
@@ -271,208 +340,101 @@ func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 
 // Reconnect reconnects to a pane and restore the screen/buffer
 // buffer from that marker if not we use our headless terminal emulator to
-// send over the current screen.
-func (peer *Peer) Reconnect(d *webrtc.DataChannel, id int) (*Pane, error) {
-	pane := Panes.Get(id)
+// send over the current screen. When the args have an offset the pane is
+// resumed from it instead.
+func (peer *Peer) Reconnect(d Channel, a ReconnectPaneArgs) (*Pane, error) {
+	pane := peer.server.Panes.Get(a.ID)
 	if pane == nil {
-		return nil, fmt.Errorf("Got a bad pane id: %d", id)
+		return nil, ctrlErrorf(CodePaneNotFound, "Got a bad pane id: %d", a.ID)
+	}
+	err := peer.authorizeAttach(pane, a.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	running := pane.running()
+	if running && a.Mode == ModeScreen {
+		if pane.vt == nil {
+			d.Close()
+			return nil, ctrlErrorf(CodeNoTTY, "Pane %d has no screen", a.ID)
+		}
+		c := peer.server.cdb.AddSync(d, pane, peer, a.ReadOnly)
+		d.OnMessage(c.sync.onMessage)
+		d.OnClose(func() {
+			peer.server.cdb.Delete(c)
+		})
+		return pane, nil
 	}
-	if pane.IsRunning {
-		c := cdb.Add(d, pane, peer)
-		d.OnMessage(pane.OnMessage)
+	if running {
+		d, err := pane.compress(d, a.Compression)
+		if err != nil {
+			return nil, err
+		}
+		var c *Client
+		if a.Offset != nil {
+			c = pane.Resume(d, peer, *a.Offset, a.Offsets, a.ReadOnly)
+		} else {
+			c = peer.server.cdb.Add(d, pane, peer, a.Offsets, a.ReadOnly)
+		}
+		d.OnMessage(c.input)
 		d.OnClose(func() {
-			cdb.Delete(c)
+			peer.server.cdb.Delete(c)
 		})
-		pane.Restore(d, peer.Marker)
+		if a.Offset == nil {
+			pane.Restore(d, peer.Marker)
+		}
 		return pane, nil
 	}
 	d.Close()
-	return nil, fmt.Errorf("Can not reconnect as pane is not running")
+	return nil, ctrlErrorf(CodePaneNotRunning,
+		"Can not reconnect as pane is not running")
 }
 
-// SendAck sends an ack for a given control message
-func (peer *Peer) SendAck(cm CTRLMessage, body []byte) error {
-	args := AckArgs{Ref: cm.Ref, Body: body}
+// SendAck sends an ack for a given control message. The body is encoded
+// with the peer's encoding, raw JSON should be passed as a RawJSON.
+func (peer *Peer) SendAck(cm CTRLMessage, body interface{}) error {
+	args := ackReply{Ref: cm.Ref, Body: body}
 	return SendCTRLMsg(peer, "ack", &args)
 }
 
-// SendNack sends an nack for a given control message
-func (peer *Peer) SendNack(cm CTRLMessage, desc string) error {
-	args := NAckArgs{Ref: cm.Ref, Desc: desc}
+// SendNack sends an nack with an error code for a given control message
+func (peer *Peer) SendNack(cm CTRLMessage, code string, desc string) error {
+	args := NAckArgs{Ref: cm.Ref, Code: code, Desc: desc}
 	return SendCTRLMsg(peer, "nack", &args)
 }
 
 // Peer.AddCandidate adds a new ICE candidate to the peer
 func (peer *Peer) AddCandidate(candidate webrtc.ICECandidateInit) error {
-	if peer.PC == nil {
+	if peer.State() == PeerClosed {
+		return fmt.Errorf("peer %d is closed", peer.ID)
+	}
+	pc := peer.GetPC()
+	if pc == nil {
 		peer.logger.Infof("ICE Candidate pending: %v", candidate)
 		peer.pendingCandidates <- &candidate
 		return nil
 	}
 	peer.logger.Infof("Adding an ICE Candidate: %v", candidate)
-	return peer.PC.AddICECandidate(candidate)
+	return pc.AddICECandidate(candidate)
 }
 
 // OnCTRLMsg handles incoming control messages
 func (peer *Peer) OnCTRLMsg(msg webrtc.DataChannelMessage) {
-	var raw json.RawMessage
-	m := CTRLMessage{
-		Args: &raw,
-	}
-	t := true
-	dcOpts := &webrtc.DataChannelInit{Ordered: &t}
+	enc := peer.encoding()
+	atomic.AddInt32(&peer.ctrlMsgs, 1)
 	peer.logger.Infof("Got a CTRLMessage: %q\n", string(msg.Data))
-	err := json.Unmarshal(msg.Data, &m)
+	m, raw, err := enc.decodeMsg(msg.Data)
 	if err != nil {
 		peer.logger.Infof("Failed to parse incoming control message: %v", err)
+		r := &ctrlReply{peer: peer, m: m}
+		r.send(nil, ctrlErrorf(CodeInvalidMessage,
+			"Failed to parse control message: %s", err))
 		return
 	}
-	switch m.Type {
-	case "resize":
-		var resizeArgs ResizeArgs
-		err = json.Unmarshal(raw, &resizeArgs)
-		if err != nil {
-			peer.logger.Infof("Failed to parse incoming control message: %v", err)
-			return
-		}
-		cID := resizeArgs.PaneID
-		pane := Panes.Get(cID)
-		if pane == nil {
-			peer.logger.Error("Failed to parse resize message pane_id out of range")
-			return
-		}
-		if pane.TTY == nil {
-			peer.logger.Warnf("Tried to resize a pane with no tty")
-			peer.SendNack(m, "Tried to resize a pane with no tty")
-			return
-		}
-		var ws pty.Winsize
-		ws.Cols = resizeArgs.Sx
-		ws.Rows = resizeArgs.Sy
-		pane.Resize(&ws)
-		err = peer.SendAck(m, nil)
-		if err != nil {
-			peer.logger.Errorf("#%d: Failed to send a resize ack: %v", peer.FP, err)
-			return
-		}
-	case "restore":
-		var args RestoreArgs
-		err = json.Unmarshal(raw, &args)
-		peer.Marker = args.Marker
-		err = peer.SendAck(m, Payload)
-	case "get_payload":
-		err = peer.SendAck(m, Payload)
-	case "set_payload":
-		var payloadArgs SetPayloadArgs
-		err = json.Unmarshal(raw, &payloadArgs)
-		peer.logger.Infof("Setting payload to: %s", payloadArgs.Payload)
-		Payload = payloadArgs.Payload
-		err = peer.SendAck(m, Payload)
-	case "mark":
-		// acdb a marker and store it in each pane
-		markerM.Lock()
-		lastMarker++
-		peer.Marker = lastMarker
-		markerM.Unlock()
-		for _, client := range cdb.All4Peer(peer) {
-			client.pane.Buffer.Mark(peer.Marker)
-			client.dc.Close()
-			// will be removed on close
-		}
-		err = peer.SendAck(m, []byte(fmt.Sprintf("%d", peer.Marker)))
-	case "reconnect_pane":
-		var a ReconnectPaneArgs
-		err = json.Unmarshal(raw, &a)
-		if err != nil {
-			peer.logger.Infof("Failed to parse incoming control message: %v", err)
-			return
-		}
-		peer.logger.Infof("@%d: got reconnect_pane", a.ID)
-
-		l := fmt.Sprintf("%d:%d", m.Ref, a.ID)
-		d, err := peer.PC.CreateDataChannel(l, dcOpts)
-		if err != nil {
-			peer.logger.Warnf("Failed to create data channel : %v", err)
-			return
-		}
-		d.OnOpen(func() {
-			peer.logger.Info("open is completed!!!")
-			pane, err := peer.Reconnect(d, a.ID)
-			if err != nil || pane == nil {
-				peer.logger.Warnf("Failed to reconnect to pane  data channel : %v", err)
-				peer.SendNack(m, fmt.Sprintf("Failed to reconnect to: %d", a.ID))
-				return
-			} else {
-				peer.SendAck(m, []byte(fmt.Sprintf("%d", pane.ID)))
-			}
-		})
-
-	case "add_pane":
-		var a AddPaneArgs
-		var ws *pty.Winsize
-		err = json.Unmarshal(raw, &a)
-		if err != nil {
-			peer.logger.Infof("Failed to parse incoming control message: %v", err)
-			return
-		}
-		peer.logger.Infof("got add_pane: %v", a)
-		if a.Rows > 0 && a.Cols > 0 {
-			ws = &pty.Winsize{Rows: a.Rows, Cols: a.Cols, X: a.X, Y: a.Y}
-		} else {
-			ws = &pty.Winsize{Rows: 24, Cols: 80}
-			peer.logger.Warn("Got an add_pane commenad with no rows or cols")
-		}
-
-		if a.Command[0] == "*" {
-			shell, err := loginshell.Shell()
-			if err != nil {
-				peer.logger.Warnf("Failed to determine user's shell: %v", err)
-				a.Command[0] = "/bin/bash"
-			} else {
-				peer.logger.Infof("Using %s for shell", shell)
-				a.Command[0] = shell
-			}
-		}
-		/* TODO: delete
-		dirname, err := os.UserHomeDir()
-		if err != nil {
-			peer.logger.Warnf("Failed to determine user's home directory: %v", err)
-			dirname = "/"
-		}
-		cmd := append([]string{"env", fmt.Sprintf("HOME=%s", dirname)}, a.Command...)
-		*/
-		cmd := a.Command
-		pane, err := NewPane(peer, ws, a.Parent)
-		if err != nil {
-			peer.logger.Warnf("Failed to add a new pane: %v", err)
-			return
-		}
-		l := fmt.Sprintf("%d:%d", m.Ref, pane.ID)
-		d, err := peer.PC.CreateDataChannel(l, dcOpts)
-		if err != nil {
-			msg := fmt.Sprintf("Failed to create data channel : %s", l)
-			peer.SendNack(m, msg)
-			peer.logger.Warnf(msg)
-			return
-		}
-		d.OnOpen(func() {
-			pane.run(cmd)
-			c := cdb.Add(d, pane, peer)
-			peer.logger.Infof("opened data channel for pane %d", pane.ID)
-			peer.SendAck(m, []byte(fmt.Sprintf("%d", pane.ID)))
-			d.OnMessage(pane.OnMessage)
-			d.OnClose(func() {
-				cdb.Delete(c)
-			})
-		})
-
-	default:
-		peer.logger.Errorf("Got a control message with unknown type: %q", m.Type)
+	if peer.server.Conf.Hooks != nil {
+		peer.server.emit(CTRLMessageEvent{
+			Peer: peer, Type: m.Type, Ref: m.Ref, Args: enc.toJSON(raw)})
 	}
-	if err != nil {
-		peer.logger.Errorf("#%d: Failed to send [n]ack: %v", peer.FP, err)
-	}
-	return
+	peer.handleCTRLMsg(m, enc, raw)
 }
 
 // GetFingerprint extract the fingerprints from a client's offer and returns
@@ -535,26 +497,3 @@ func ExtractFP(certificate *webrtc.Certificate) (string, error) {
 	}
 	return CompressFP(fp[0].Value), nil
 }
-
-// Shutdown is called when it's time to go.Sweet dreams.
-func Shutdown() {
-	var logger *zap.SugaredLogger
-	var err error
-	for _, peer := range Peers {
-		if logger == nil {
-			logger = peer.logger
-		}
-		if peer.PC != nil {
-			err = peer.PC.Close()
-			if err != nil {
-				logger.Error("Failed closing peer connection: %w", err)
-			}
-		}
-	}
-	for _, p := range Panes.All() {
-		err = p.C.Process.Kill()
-		if err != nil {
-			logger.Error("Failed closing a process: %w", err)
-		}
-	}
-}
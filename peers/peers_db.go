@@ -0,0 +1,110 @@
+package peers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PeersDB holds the peers, one for each connection, by id. A client
+// connecting more than once with the same certificate has more than one
+// peer, so peers are indexed by fingerprint as well.
+type PeersDB struct {
+	peers  map[int]*Peer
+	byFP   map[string][]*Peer
+	m      sync.RWMutex
+	nextID int
+}
+
+// NewPeersDB returns a new database
+func NewPeersDB() *PeersDB {
+	return &PeersDB{
+		peers: make(map[int]*Peer),
+		byFP:  make(map[string][]*Peer),
+	}
+}
+
+// Add adds a new peer to the database, setting its ID
+func (db *PeersDB) Add(p *Peer) {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	db.nextID++
+	p.ID = db.nextID
+	db.peers[p.ID] = p
+	db.byFP[p.FP] = append(db.byFP[p.FP], p)
+}
+
+// Get retrieves a peer from the database based on id
+func (db *PeersDB) Get(id int) *Peer {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	return db.peers[id]
+}
+
+// All4FP returns the peers of a fingerprint, oldest first
+func (db *PeersDB) All4FP(fp string) []*Peer {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	return append([]*Peer{}, db.byFP[fp]...)
+}
+
+// Latest4FP returns the newest peer of a fingerprint, nil if there's none
+func (db *PeersDB) Latest4FP(fp string) *Peer {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	ps := db.byFP[fp]
+	if len(ps) == 0 {
+		return nil
+	}
+	return ps[len(ps)-1]
+}
+
+// All returns a slice with all the peers in the database, sorted by id
+func (db *PeersDB) All() []*Peer {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	r := make([]*Peer, 0, len(db.peers))
+	for _, p := range db.peers {
+		r = append(r, p)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	return r
+}
+
+// Len returns how many peers are in the database
+func (db *PeersDB) Len() int {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	return len(db.peers)
+}
+
+// Delete removes a peer from the database
+func (db *PeersDB) Delete(id int) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	p, ok := db.peers[id]
+	if !ok {
+		return fmt.Errorf("peer %d not found", id)
+	}
+	delete(db.peers, id)
+	ps := db.byFP[p.FP]
+	for i, fpp := range ps {
+		if fpp == p {
+			ps = append(ps[:i], ps[i+1:]...)
+			break
+		}
+	}
+	if len(ps) == 0 {
+		delete(db.byFP, p.FP)
+	} else {
+		db.byFP[p.FP] = ps
+	}
+	return nil
+}
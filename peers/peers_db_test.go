@@ -0,0 +1,29 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeersDB(t *testing.T) {
+	db := NewPeersDB()
+	a := &Peer{FP: "A"}
+	b := &Peer{FP: "B"}
+	a2 := &Peer{FP: "A"}
+	db.Add(a)
+	db.Add(b)
+	db.Add(a2)
+	// a second connection with the same fingerprint doesn't replace the first
+	require.NotEqual(t, a.ID, a2.ID)
+	require.Equal(t, 3, db.Len())
+	require.Equal(t, []*Peer{a, a2}, db.All4FP("A"))
+	require.Equal(t, a2, db.Latest4FP("A"))
+	require.Equal(t, b, db.Get(b.ID))
+	require.NoError(t, db.Delete(a2.ID))
+	require.Equal(t, a, db.Latest4FP("A"))
+	require.NoError(t, db.Delete(a.ID))
+	require.Nil(t, db.Latest4FP("A"))
+	require.Error(t, db.Delete(a.ID))
+	require.Equal(t, []*Peer{b}, db.All())
+}
@@ -0,0 +1,111 @@
+// This file holds the code to run commands without a pseudo tty, connected
+// through pipes
+package peers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+const (
+	// StdoutTag prefixes messages carrying the stdout of a pane with no pty
+	StdoutTag byte = 1
+	// StderrTag prefixes messages carrying the stderr of a pane with no pty
+	StderrTag byte = 2
+)
+
+// Pipes connects to the standard streams of a command running with no pty.
+// Reading returns the command's stdout, writing goes to its stdin.
+type Pipes struct {
+	stdin  *os.File
+	stdout *os.File
+	// Stderr is used to read the command's stderr
+	Stderr *os.File
+	// the command's ends of the pipes, closed once the command starts
+	child []*os.File
+}
+
+// newPipes creates the pipes and connects them to the command
+func newPipes(cmd *exec.Cmd) (*Pipes, error) {
+	p := &Pipes{}
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		outR.Close()
+		outW.Close()
+		return nil, err
+	}
+	p.stdin, p.stdout, p.Stderr = inW, outR, errR
+	p.child = []*os.File{inR, outW, errW}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, errW
+	return p, nil
+}
+
+// closeChild closes the command's ends of the pipes so we'll get an EOF
+// when the command exits
+func (p *Pipes) closeChild() {
+	for _, f := range p.child {
+		f.Close()
+	}
+	p.child = nil
+}
+
+// Read reads from the command's stdout
+func (p *Pipes) Read(b []byte) (int, error) {
+	return p.stdout.Read(b)
+}
+
+// Write writes to the command's stdin
+func (p *Pipes) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+// CloseWrite closes the command's stdin so it reads an EOF
+func (p *Pipes) CloseWrite() error {
+	err := p.stdin.Close()
+	p.stdin = nil
+	return err
+}
+
+// Close closes all the pipes
+func (p *Pipes) Close() error {
+	p.closeChild()
+	p.stdin.Close()
+	p.Stderr.Close()
+	return p.stdout.Close()
+}
+
+// ExecPipeCommand is a RunCommandInterface that executes a command with its
+// standard streams connected to pipes. ws is ignored as there's no pty.
+func ExecPipeCommand(command []string, env map[string]string, dir string, ws *pty.Winsize, pID int, fp string) (*exec.Cmd, io.ReadWriteCloser, error) {
+	cmd, err := newCommand(command, env, dir, pID, fp)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := newPipes(cmd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create pipes: %s %s", err, fp)
+	}
+	err = cmd.Start()
+	if err != nil {
+		p.Close()
+		return nil, nil, fmt.Errorf("Failed launching %q: %q %s", command, err, fp)
+	}
+	p.closeChild()
+	return cmd, p, nil
+}
@@ -0,0 +1,189 @@
+// This file holds the policies that limit what clients can do. A client's
+// policy is looked up by its fingerprint & token when first needed, a
+// client with no policy can do anything.
+package peers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policy holds a client's permissions. Its zero value allows everything.
+type Policy struct {
+	// Name identifies the policy in the audit log
+	Name string
+	// Commands are the patterns of the commands the client can run, nil
+	// allows all. A pattern is matched against the command line, the
+	// command & its args joined by spaces, and a * in it matches any text.
+	Commands []string
+	// Profiles are the names of the profiles the client can launch, nil
+	// allows all
+	Profiles []string
+	// NoPTY denies panes with a pty
+	NoPTY bool
+	// MaxPanes, when positive, limits the number of running panes the
+	// client's fingerprint added
+	MaxPanes int
+	// NoPayload denies getting & setting the payload
+	NoPayload bool
+	// ReadOnly lets the client watch panes but not add panes, write to
+	// them, resize them, drive them or set the payload
+	ReadOnly bool
+}
+
+// readOnlyTypes are the control messages read only clients can't send
+var readOnlyTypes = []string{"add_pane", "resize", "close_stdin", "set_payload",
+	"request_control"}
+
+// payloadTypes are the control messages that get or set the payload
+var payloadTypes = []string{"get_payload", "set_payload", "restore"}
+
+// denyAll is the policy of clients whose policy failed to load
+var denyAll = &Policy{Name: "deny-all", Commands: []string{},
+	Profiles: []string{}, NoPTY: true, NoPayload: true, ReadOnly: true}
+
+// Policy returns the peer's policy, nil when it can do anything
+func (peer *Peer) Policy() *Policy {
+	peer.policyOnce.Do(func() {
+		get := peer.Conf.GetPolicy
+		if get == nil {
+			return
+		}
+		p, err := get(peer.FP, peer.Token)
+		if err != nil {
+			peer.logger.Errorf("Failed to get the policy, denying all: %s", err)
+			p = denyAll
+		}
+		peer.policy = p
+	})
+	return peer.policy
+}
+
+// deny logs a denial in the audit log, emits an event and returns an
+// unauthorized error to send in a nack
+func (peer *Peer) deny(action string, format string, a ...interface{}) error {
+	reason := fmt.Sprintf(format, a...)
+	name := ""
+	if p := peer.Policy(); p != nil {
+		name = p.Name
+	}
+	peer.logger.Warnw("Policy denied", "audit", true, "fp", peer.FP,
+		"policy", name, "action", action, "reason", reason)
+	peer.server.emit(PolicyDeniedEvent{Peer: peer, Action: action, Reason: reason})
+	return ctrlErrorf(CodeUnauthorized, "%s denied by policy: %s", action, reason)
+}
+
+// authorize checks the policy allows a control message
+func (peer *Peer) authorize(typ string) error {
+	p := peer.Policy()
+	if p == nil {
+		return nil
+	}
+	if p.ReadOnly && Contains(readOnlyTypes, typ) {
+		return peer.deny(typ, "read only client")
+	}
+	if p.NoPayload && Contains(payloadTypes, typ) {
+		return peer.deny(typ, "no payload access")
+	}
+	return nil
+}
+
+// authorizePane checks the policy allows adding a pane that runs a command
+// or launches a profile. action is how the pane is added, for the audit log.
+func (peer *Peer) authorizePane(action string, command []string, profile string, tty bool) error {
+	p := peer.Policy()
+	if p == nil {
+		return nil
+	}
+	line := strings.Join(command, " ")
+	switch {
+	case p.ReadOnly:
+		return peer.deny(action, "read only client")
+	case tty && p.NoPTY:
+		return peer.deny(action, "no pty panes")
+	case profile != "" && p.Profiles != nil && !Contains(p.Profiles, profile):
+		return peer.deny(action, "profile %q is not allowed", profile)
+	case profile == "" && !p.allowCommand(line):
+		return peer.deny(action, "command %q is not allowed", line)
+	}
+	if p.MaxPanes > 0 && peer.server.runningPanes(peer.FP) >= p.MaxPanes {
+		return peer.deny(action, "reached the maximum of %d panes",
+			p.MaxPanes)
+	}
+	return nil
+}
+
+// authorizeAttach checks the policy allows attaching to a pane. A writable
+// client can type any command into the pane, so it's allowed only when the
+// policy would have let the peer add the pane. Any pane can be watched read
+// only.
+func (peer *Peer) authorizeAttach(pane *Pane, readOnly bool) error {
+	p := peer.Policy()
+	if p == nil || p.ReadOnly || readOnly {
+		return nil
+	}
+	const action = "reconnect_pane"
+	line := strings.Join(pane.command, " ")
+	switch {
+	case p.NoPTY && !pane.pipe:
+		return peer.deny(action, "pane %d has a pty, attach read only", pane.ID)
+	case pane.profile != "" && !p.allowProfile(pane.profile):
+		return peer.deny(action, "profile %q is not allowed, attach read only",
+			pane.profile)
+	case pane.profile == "" && !p.allowCommand(line):
+		return peer.deny(action, "command %q is not allowed, attach read only",
+			line)
+	}
+	return nil
+}
+
+// allowCommand returns true when a command line matches one of the patterns
+func (p *Policy) allowCommand(line string) bool {
+	if p.Commands == nil {
+		return true
+	}
+	for _, pattern := range p.Commands {
+		if match(pattern, line) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowProfile returns true when the policy allows a profile
+func (p *Policy) allowProfile(name string) bool {
+	return p == nil || p.Profiles == nil || Contains(p.Profiles, name)
+}
+
+// match returns true when s matches a pattern where * matches any text
+func match(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
+
+// runningPanes returns the number of running panes added by peers with a
+// given fingerprint
+func (s *Server) runningPanes(fp string) int {
+	n := 0
+	for _, pane := range s.Panes.All() {
+		if pane.running() && pane.peer != nil && pane.peer.FP == fp {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,173 @@
+package peers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// staticPolicy returns a GetPolicy that gives p to the peer with the "FP"
+// fingerprint
+func staticPolicy(t *testing.T, p *Policy) func(string, string) (*Policy, error) {
+	return func(fp string, token string) (*Policy, error) {
+		require.Equal(t, "FP", fp)
+		return p, nil
+	}
+}
+
+func requireDenied(t *testing.T, err error) {
+	require.Error(t, err)
+	require.Equal(t, CodeUnauthorized, err.(*CTRLError).Code)
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"htop", "htop", true},
+		{"htop", "htop -d 10", false},
+		{"htop*", "htop -d 10", true},
+		{"tail -f /var/log/*", "tail -f /var/log/nginx/error.log", true},
+		{"tail -f /var/log/*", "tail -f /etc/shadow", false},
+		{"*.sh", "/home/user/deploy.sh", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "acb", false},
+		{"ab*ba", "aba", false},
+		{"*", "anything goes", true},
+	} {
+		require.Equal(t, c.match, match(c.pattern, c.s), "%q ~ %q", c.pattern, c.s)
+	}
+}
+
+func TestPolicyNone(t *testing.T) {
+	peer := newTestPeer(t, &Conf{GetPolicy: staticPolicy(t, nil)})
+	peer.FP = "FP"
+	require.Nil(t, peer.Policy())
+	require.NoError(t, peer.authorize("set_payload"))
+	require.NoError(t, peer.authorizePane("add_pane", []string{"rm", "-rf", "/"}, "", true))
+	pane := newPane(peer, nil)
+	var written []byte
+	pane.TTY = writerFunc(func(b []byte) (int, error) {
+		written = append(written, b...)
+		return len(b), nil
+	})
+	c := attach(t, pane, peer, false)
+	c.input(webrtc.DataChannelMessage{Data: []byte("ls\n")})
+	require.Equal(t, "ls\n", string(written))
+}
+
+func TestPolicyAddPane(t *testing.T) {
+	r := &recorder{}
+	peer := newTestPeer(t, &Conf{Hooks: r, GetPolicy: staticPolicy(t, &Policy{
+		Name:     "dev",
+		Commands: []string{"htop", "tail -f *"},
+		Profiles: []string{"dev"},
+		MaxPanes: 2,
+	})})
+	peer.FP = "FP"
+	require.NoError(t, peer.authorizePane("add_pane", []string{"htop"}, "", true))
+	require.NoError(t, peer.authorizePane("add_pane", []string{"tail", "-f", "x.log"}, "", false))
+	requireDenied(t, peer.authorizePane("add_pane", []string{"bash"}, "", true))
+	// profiles are not matched against the commands
+	require.NoError(t, peer.authorizePane("add_pane", []string{"zsh"}, "dev", true))
+	requireDenied(t, peer.authorizePane("add_pane", []string{"zsh"}, "prod", true))
+	// the events are sent for the audit
+	events := r.get()
+	require.Len(t, events, 2)
+	e := events[0].(PolicyDeniedEvent)
+	require.Equal(t, "add_pane", e.Action)
+	require.Contains(t, e.Reason, "bash")
+	for i := 0; i < 2; i++ {
+		pane := newPane(peer, nil)
+		pane.setRunning(true)
+		peer.server.Panes.Add(pane)
+	}
+	err := peer.authorizePane("add_pane", []string{"htop"}, "", true)
+	requireDenied(t, err)
+	require.Contains(t, err.Error(), "maximum of 2")
+}
+
+func TestPolicyReadOnly(t *testing.T) {
+	peer := newTestPeer(t, &Conf{
+		GetPolicy: staticPolicy(t, &Policy{ReadOnly: true, NoPTY: true})})
+	peer.FP = "FP"
+	for _, typ := range []string{"add_pane", "resize", "close_stdin", "set_payload"} {
+		requireDenied(t, peer.authorize(typ))
+	}
+	require.NoError(t, peer.authorize("reconnect_pane"))
+	require.NoError(t, peer.authorize("get_payload"))
+	requireDenied(t, peer.authorizePane("channel", []string{"echo", "hi"}, "", false))
+	// the input is dropped, even when the client didn't ask to be read only
+	pane := newPane(peer, nil)
+	written := false
+	pane.TTY = writerFunc(func(b []byte) (int, error) {
+		written = true
+		return len(b), nil
+	})
+	c := attach(t, pane, peer, false)
+	c.input(webrtc.DataChannelMessage{Data: []byte("rm -rf /\n")})
+	require.False(t, written)
+}
+
+func TestPolicyAttach(t *testing.T) {
+	peer := newTestPeer(t, &Conf{GetPolicy: staticPolicy(t, &Policy{
+		Commands: []string{"htop"},
+		Profiles: []string{"dev"},
+	})})
+	peer.FP = "FP"
+	add := func(command []string, profile string) *Pane {
+		pane := newPane(peer, nil)
+		pane.command = command
+		pane.profile = profile
+		pane.setRunning(true)
+		peer.server.Panes.Add(pane)
+		return pane
+	}
+	shell := add([]string{"bash"}, "")
+	// the peer can't type into a shell it couldn't have added
+	_, err := peer.Reconnect(&fakeChannel{}, ReconnectPaneArgs{ID: shell.ID})
+	requireDenied(t, err)
+	require.Empty(t, peer.server.cdb.All4Pane(shell))
+	// it can watch it
+	_, err = peer.Reconnect(&fakeChannel{},
+		ReconnectPaneArgs{ID: shell.ID, ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, peer.authorizeAttach(add([]string{"htop"}, ""), false))
+	require.NoError(t, peer.authorizeAttach(add([]string{"zsh"}, "dev"), false))
+	requireDenied(t, peer.authorizeAttach(add([]string{"zsh"}, "prod"), false))
+	// panes with a pty are watched by clients limited to pipes
+	peer = newTestPeer(t, &Conf{GetPolicy: staticPolicy(t, &Policy{NoPTY: true})})
+	peer.FP = "FP"
+	requireDenied(t, peer.authorizeAttach(shell, false))
+	require.NoError(t, peer.authorizeAttach(shell, true))
+}
+
+func TestPolicyPayload(t *testing.T) {
+	peer := newTestPeer(t, &Conf{GetPolicy: staticPolicy(t, &Policy{NoPayload: true})})
+	peer.FP = "FP"
+	for _, typ := range []string{"get_payload", "set_payload", "restore"} {
+		requireDenied(t, peer.authorize(typ))
+	}
+	require.NoError(t, peer.authorize("add_pane"))
+}
+
+func TestPolicyFailed(t *testing.T) {
+	peer := newTestPeer(t, &Conf{
+		GetPolicy: func(fp string, token string) (*Policy, error) {
+			return nil, fmt.Errorf("bad policy file")
+		},
+	})
+	require.Equal(t, denyAll, peer.Policy())
+	requireDenied(t, peer.authorize("get_payload"))
+}
+
+// writerFunc is a pane's TTY that calls a function on write
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+func (f writerFunc) Read(b []byte) (int, error)  { return 0, nil }
+func (f writerFunc) Close() error                { return nil }
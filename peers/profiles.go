@@ -0,0 +1,119 @@
+// This file holds the command profiles, named commands with their working
+// directory & environment that clients launch with add_pane
+package peers
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PreLaunchTimeout is how long a profile's pre launch script can run
+var PreLaunchTimeout = 30 * time.Second
+
+// Profile is a named command clients can launch in add_pane
+type Profile struct {
+	Name    string
+	Command []string
+	// Cwd is the command's working directory, see AddPaneArgs.Cwd
+	Cwd string
+	Env map[string]string
+	// Term, when set, is the command's TERM
+	Term string
+	// ScrollbackSize, when positive, overrides Conf.ScrollbackSize
+	ScrollbackSize int
+	// PreLaunch, when set, is a shell script that runs before the command,
+	// in its working directory & environment. The pane fails when it fails.
+	PreLaunch string
+}
+
+// profile returns the profile with the given name, nil if there's none
+func (s *Server) profile(name string) *Profile {
+	for i := range s.Conf.Profiles {
+		if s.Conf.Profiles[i].Name == name {
+			return &s.Conf.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// ProfileNames returns the names of the server's profiles
+func (s *Server) ProfileNames() []string {
+	r := []string{}
+	for _, p := range s.Conf.Profiles {
+		r = append(r, p.Name)
+	}
+	return r
+}
+
+// forwardable returns true for the variables clients can set for a profile
+// when they are restricted to profiles: the locale, timezone & TERM
+func forwardable(name string) bool {
+	return name == "LANG" || name == "TZ" || name == "TERM" ||
+		strings.HasPrefix(name, "LC_")
+}
+
+// applyProfile sets the args' command, working directory & environment from
+// its profile. The client's cwd & env override the profile's, unless the
+// configuration restricts clients to profiles.
+func (peer *Peer) applyProfile(a *AddPaneArgs) (*Profile, error) {
+	p := peer.server.profile(a.Profile)
+	if p == nil {
+		return nil, ctrlErrorf(CodeProfileNotFound, "Unknown profile %q",
+			a.Profile)
+	}
+	if peer.Conf.ProfilesOnly {
+		if a.Cwd != "" || a.InheritEnv != "" {
+			return nil, ctrlErrorf(CodeUnauthorized,
+				"Profile %q can not be launched with cwd or inherit_env", p.Name)
+		}
+		for k := range a.Env {
+			if !forwardable(k) {
+				return nil, ctrlErrorf(CodeUnauthorized,
+					"Profile %q can not be launched with %s set", p.Name, k)
+			}
+		}
+	}
+	a.Command = append([]string{}, p.Command...)
+	if a.Cwd == "" {
+		a.Cwd = p.Cwd
+	}
+	env := make(map[string]string)
+	for k, v := range p.Env {
+		env[k] = v
+	}
+	if p.Term != "" {
+		env["TERM"] = p.Term
+	}
+	for k, v := range a.Env {
+		env[k] = v
+	}
+	a.Env = env
+	return p, nil
+}
+
+// preLaunch runs a profile's pre launch script where the pane's command
+// will run, killing it if it runs longer than PreLaunchTimeout
+func (pane *Pane) preLaunch(script string) error {
+	cmd, err := newCommand([]string{"/bin/sh", "-c", script},
+		pane.commandEnv(), pane.cwd, pane.parent, pane.peer.FP)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start the pre launch script: %s", err)
+	}
+	t := time.AfterFunc(PreLaunchTimeout, func() { cmd.Process.Kill() })
+	err = cmd.Wait()
+	t.Stop()
+	if err != nil {
+		return fmt.Errorf("Pre launch script failed: %s: %s", err,
+			strings.TrimSpace(out.String()))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package peers
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// profilesConf returns a configuration with a "dev" profile
+func profilesConf(only bool) *Conf {
+	return &Conf{
+		Profiles: []Profile{{
+			Name:    "dev",
+			Command: []string{"zsh", "-l"},
+			Cwd:     "/tmp",
+			Env:     map[string]string{"EDITOR": "vim", "LANG": "C"},
+			Term:    "xterm-256color",
+		}},
+		ProfilesOnly: only,
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	peer := newTestPeer(t, profilesConf(false))
+	require.Equal(t, []string{"dev"}, peer.server.ProfileNames())
+	a := AddPaneArgs{Profile: "dev", Cwd: "/var",
+		Env: map[string]string{"LANG": "he_IL.UTF-8"}}
+	require.NoError(t, a.Validate())
+	p, err := peer.applyProfile(&a)
+	require.NoError(t, err)
+	require.Equal(t, "dev", p.Name)
+	require.Equal(t, []string{"zsh", "-l"}, a.Command)
+	require.Equal(t, "/var", a.Cwd)
+	require.Equal(t, map[string]string{"EDITOR": "vim",
+		"LANG": "he_IL.UTF-8", "TERM": "xterm-256color"}, a.Env)
+	// the profile's command is not changed by the pane's
+	a.Command[0] = "bash"
+	require.Equal(t, "zsh", p.Command[0])
+	_, err = peer.applyProfile(&AddPaneArgs{Profile: "prod"})
+	require.Equal(t, CodeProfileNotFound, err.(*CTRLError).Code)
+	a = AddPaneArgs{Profile: "dev", Command: []string{"bash"}}
+	require.Error(t, a.Validate())
+}
+
+func TestApplyProfileOnly(t *testing.T) {
+	peer := newTestPeer(t, profilesConf(true))
+	a := AddPaneArgs{Profile: "dev",
+		Env: map[string]string{"TZ": "UTC", "LC_ALL": "C", "TERM": "vt100"}}
+	_, err := peer.applyProfile(&a)
+	require.NoError(t, err)
+	require.Equal(t, "/tmp", a.Cwd)
+	for _, a := range []AddPaneArgs{
+		{Profile: "dev", Cwd: "/"},
+		{Profile: "dev", InheritEnv: InheritAll},
+		{Profile: "dev", Env: map[string]string{"LD_PRELOAD": "evil.so"}},
+	} {
+		_, err := peer.applyProfile(&a)
+		require.Equal(t, CodeUnauthorized, err.(*CTRLError).Code)
+	}
+}
+
+func TestPreLaunch(t *testing.T) {
+	peer := newTestPeer(t, profilesConf(false))
+	pane := newPane(peer, nil)
+	pane.cwd = t.TempDir()
+	pane.env = map[string]string{"NAME": "ready"}
+	require.NoError(t, pane.preLaunch("echo $NAME > flag"))
+	b, err := os.ReadFile(filepath.Join(pane.cwd, "flag"))
+	require.NoError(t, err)
+	require.Equal(t, "ready\n", string(b))
+	err = pane.preLaunch("echo not today >&2; exit 1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not today")
+}
+
+func TestFailedPaneFreesBuffer(t *testing.T) {
+	dir := t.TempDir()
+	peer := newTestPeer(t, &Conf{ScrollbackSize: 1000, SpillDir: dir})
+	pane, err := NewPane(peer, nil, 0)
+	require.NoError(t, err)
+	pane.pipe = true
+	// random data doesn't compress, so it's spilled
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(42)).Read(data)
+	pane.Buffer.Add(data)
+	files, err := filepath.Glob(filepath.Join(dir, "pane-*.z"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	err = peer.runPane(pane, &fakeChannel{},
+		&AddPaneArgs{Command: []string{"/no/such/command"}, Pipe: true})
+	require.Equal(t, CodeSpawnFailed, err.(*CTRLError).Code)
+	require.Nil(t, peer.server.Panes.Get(pane.ID))
+	files, err = filepath.Glob(filepath.Join(dir, "pane-*.z"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
@@ -3,6 +3,7 @@ package peers
 import (
 	"os"
 	"os/exec"
+	"syscall"
 
 	"github.com/creack/pty"
 )
@@ -21,4 +22,18 @@ func (pm PtyMuxType) StartWithSize(c *exec.Cmd, sz *pty.Winsize) (*os.File, erro
 	return pty.StartWithSize(c, sz)
 }
 
-var PtyMux PtyMuxInterface
+// nonBlocking replaces a pty master with a non blocking copy so reading from
+// it can be interrupted by a deadline, i.e. when handing off a pane
+func nonBlocking(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	f.Close()
+	return os.NewFile(uintptr(fd), "/dev/ptmx"), nil
+}
@@ -0,0 +1,84 @@
+// This file holds the read only clients, viewers that watch a pane but
+// can't write to it or resize it. A client is read only when it asks for it
+// in reconnect_pane or its label, or when its peer's policy is read only, i.e.
+// when its token is granted read only access.
+package peers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ReadOnlyLabelFlag is the field that follows a pane's id in a reconnect
+// label to attach as a read only client, i.e. ">12,read_only"
+const ReadOnlyLabelFlag = "read_only"
+
+// DropReportInterval is the minimum time between the reports of a read only
+// client's dropped input
+var DropReportInterval = time.Second
+
+// clientReadOnly returns true when a client of the peer is read only: when
+// it asks to be or when the peer's policy is read only
+func (peer *Peer) clientReadOnly(asked bool) bool {
+	p := peer.Policy()
+	return asked || (p != nil && p.ReadOnly)
+}
+
+// input writes the client's input to the pane, dropping & reporting it when
+// the client is read only or its peer doesn't drive the pane
+func (c *Client) input(msg webrtc.DataChannelMessage) {
+	err := c.checkInput()
+	if err == nil {
+		c.pane.OnMessage(msg)
+		return
+	}
+	c.peer.logger.Infof("@%d: dropping %d bytes of input: %s",
+		c.pane.ID, len(msg.Data), err)
+	now := time.Now()
+	if now.Sub(c.lastDropReport) < DropReportInterval {
+		return
+	}
+	c.lastDropReport = now
+	c.reportDrop(err.(*CTRLError))
+}
+
+// checkInput returns an error when the client can't write to the pane
+func (c *Client) checkInput() error {
+	if c.readOnly {
+		return ctrlErrorf(CodeReadOnly, "Pane %d is attached read only", c.pane.ID)
+	}
+	return c.pane.driver.check(c.peer)
+}
+
+// reportDrop tells the client its input was dropped
+func (c *Client) reportDrop(e *CTRLError) {
+	c.report(e.Code, fmt.Sprintf("%s, input dropped", e.Desc))
+}
+
+// checkWritable returns an error when the peer can't resize a pane or close
+// its stdin: when it has no writable client of the pane or when it doesn't
+// drive the pane
+func (peer *Peer) checkWritable(pane *Pane) error {
+	err := peer.checkReadOnly(pane)
+	if err != nil {
+		return err
+	}
+	return pane.driver.check(peer)
+}
+
+// checkReadOnly returns an error unless the peer has a writable client of
+// the pane, so a peer that's not attached to the pane can't write to it
+func (peer *Peer) checkReadOnly(pane *Pane) error {
+	clients := peer.clients(pane)
+	for _, c := range clients {
+		if !c.readOnly {
+			return nil
+		}
+	}
+	if len(clients) == 0 {
+		return ctrlErrorf(CodeReadOnly, "Pane %d is not attached", pane.ID)
+	}
+	return ctrlErrorf(CodeReadOnly, "Pane %d is attached read only", pane.ID)
+}
@@ -0,0 +1,39 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyClient(t *testing.T) {
+	peer := newTestPeer(t, nil)
+	pane := newPane(peer, nil)
+	var written []byte
+	pane.TTY = writerFunc(func(b []byte) (int, error) {
+		written = append(written, b...)
+		return len(b), nil
+	})
+	viewer := attach(t, pane, peer, true)
+	viewer.input(webrtc.DataChannelMessage{Data: []byte("rm -rf /\n")})
+	require.Empty(t, written)
+	// the drop is reported once per interval
+	reported := viewer.lastDropReport
+	require.False(t, reported.IsZero())
+	viewer.input(webrtc.DataChannelMessage{Data: []byte("y\n")})
+	require.Equal(t, reported, viewer.lastDropReport)
+	// a viewer can't resize the pane or close its stdin
+	err := peer.checkWritable(pane)
+	require.Equal(t, CodeReadOnly, err.(*CTRLError).Code)
+	// unless the peer is also attached as a driver
+	driver := attach(t, pane, peer, false)
+	require.NoError(t, peer.checkWritable(pane))
+	driver.input(webrtc.DataChannelMessage{Data: []byte("ls\n")})
+	require.Equal(t, "ls\n", string(written))
+	// a peer that's not attached can't write either
+	require.NoError(t, peer.server.cdb.Delete(driver))
+	other := peer.server.newOrphanPeer()
+	err = other.checkWritable(pane)
+	require.Equal(t, CodeReadOnly, err.(*CTRLError).Code)
+}
@@ -0,0 +1,331 @@
+// This file holds the headless terminal used to restore the screen when a
+// client reconnects
+package peers
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/hinshun/vt10x"
+)
+
+// vt10x's glyph attributes & cursor state bits, they're not exported
+const (
+	vtAttrReverse   = 1 << 0
+	vtAttrUnderline = 1 << 1
+	vtAttrBold      = 1 << 2
+	vtAttrItalic    = 1 << 4
+	vtAttrBlink     = 1 << 5
+	vtCursorOrigin  = 1 << 2
+)
+
+// vtModes maps terminal modes to the private modes that set them
+var vtModes = []struct {
+	flag vt10x.ModeFlag
+	code string
+}{
+	{vt10x.ModeAppCursor, "?1"},
+	{vt10x.ModeReverse, "?5"},
+	{vt10x.ModeMouseX10, "?9"},
+	{vt10x.ModeMouseButton, "?1000"},
+	{vt10x.ModeMouseMotion, "?1002"},
+	{vt10x.ModeMouseMany, "?1003"},
+	{vt10x.ModeFocus, "?1004"},
+	{vt10x.ModeMouseSgr, "?1006"},
+	{vt10x.ModeInsert, "4"},
+}
+
+// parser states for tracking escape sequences
+const (
+	stateGround = iota
+	stateEsc
+	stateCSI
+)
+
+// maxCSI is the longest control sequence we track
+const maxCSI = 32
+
+// screen wraps vt10x's terminal emulator and tracks the state vt10x doesn't
+// expose: the scroll region and the cursor shape
+type screen struct {
+	vt10x.Terminal
+	m sync.Mutex
+	// region holds the parameters of the last DECSTBM and top is the
+	// region's first line, zero based
+	region string
+	top    int
+	// cursorShape holds the parameters of the last DECSCUSR
+	cursorShape string
+	state       int
+	csi         []byte
+}
+
+// newScreen returns a new screen of a given size
+func newScreen(cols int, rows int) *screen {
+	return &screen{Terminal: vt10x.New(vt10x.WithSize(cols, rows))}
+}
+
+// Write parses the output, tracking the scroll region & cursor shape
+func (s *screen) Write(b []byte) (int, error) {
+	s.m.Lock()
+	for _, c := range b {
+		s.track(c)
+	}
+	s.m.Unlock()
+	return s.Terminal.Write(b)
+}
+
+// Resize resizes the screen, resetting the scroll region like vt10x does
+func (s *screen) Resize(cols int, rows int) {
+	s.m.Lock()
+	s.region = ""
+	s.top = 0
+	s.m.Unlock()
+	s.Terminal.Resize(cols, rows)
+}
+
+func (s *screen) track(c byte) {
+	switch s.state {
+	case stateGround:
+		if c == 0x1b {
+			s.state = stateEsc
+		}
+	case stateEsc:
+		switch c {
+		case '[':
+			s.state = stateCSI
+			s.csi = s.csi[:0]
+		case 'c':
+			// full reset
+			s.region, s.top, s.cursorShape = "", 0, ""
+			s.state = stateGround
+		case 0x1b:
+		default:
+			s.state = stateGround
+		}
+	case stateCSI:
+		if c >= 0x40 && c <= 0x7e {
+			s.csiDone(c)
+			s.state = stateGround
+		} else if c == 0x1b {
+			s.state = stateEsc
+		} else if len(s.csi) < maxCSI {
+			s.csi = append(s.csi, c)
+		} else {
+			s.state = stateGround
+		}
+	}
+}
+
+// csiDone handles a complete control sequence
+func (s *screen) csiDone(final byte) {
+	params := string(s.csi)
+	switch {
+	case final == 'r' && !strings.HasPrefix(params, "?"):
+		s.region = params
+		s.top = 0
+		if t := strings.Split(params, ";")[0]; t != "" {
+			n, err := strconv.Atoi(t)
+			if err == nil && n > 0 {
+				s.top = n - 1
+			}
+		}
+	case final == 'q' && strings.HasSuffix(params, " "):
+		s.cursorShape = params
+		if params == " " || params == "0 " {
+			// the default shape
+			s.cursorShape = ""
+		}
+	}
+}
+
+// Render returns an ANSI rendering of the screen: the cells with their
+// attributes, the title, the modes and the cursor
+func (s *screen) Render() []byte {
+	var b bytes.Buffer
+	s.Lock()
+	defer s.Unlock()
+	s.m.Lock()
+	defer s.m.Unlock()
+	cols, rows := s.Size()
+	if s.Mode()&vt10x.ModeAltScreen != 0 {
+		b.WriteString("\x1b[?1049h")
+	}
+	b.WriteString("\x1b[r\x1b[?6l\x1b[0m\x1b[H\x1b[2J")
+	for y := 0; y < rows; y++ {
+		if l := s.line(y, cols); l != "" {
+			fmt.Fprintf(&b, "\x1b[%d;1H", y+1)
+			b.WriteString(l)
+		}
+	}
+	b.WriteString("\x1b[0m")
+	s.writeState(&b, false)
+	return b.Bytes()
+}
+
+// writeState writes the title, the scroll region, the modes and the
+// cursor. When explicit is false it assumes a reset terminal and writes
+// only what differs from the defaults. It should be called while holding
+// both locks.
+func (s *screen) writeState(b *bytes.Buffer, explicit bool) {
+	mode := s.Mode()
+	if title := s.Title(); title != "" || explicit {
+		fmt.Fprintf(b, "\x1b]0;%s\x07", title)
+	}
+	if s.region != "" {
+		fmt.Fprintf(b, "\x1b[%sr", s.region)
+	}
+	for _, m := range vtModes {
+		if mode&m.flag != 0 {
+			fmt.Fprintf(b, "\x1b[%sh", m.code)
+		} else if explicit {
+			fmt.Fprintf(b, "\x1b[%sl", m.code)
+		}
+	}
+	if mode&vt10x.ModeAppKeypad != 0 {
+		b.WriteString("\x1b=")
+	} else if explicit {
+		b.WriteString("\x1b>")
+	}
+	if mode&vt10x.ModeWrap == 0 {
+		b.WriteString("\x1b[?7l")
+	} else if explicit {
+		b.WriteString("\x1b[?7h")
+	}
+	cur := s.Cursor()
+	y := cur.Y
+	if cur.State&vtCursorOrigin != 0 {
+		b.WriteString("\x1b[?6h")
+		y -= s.top
+	}
+	fmt.Fprintf(b, "\x1b[%d;%dH", y+1, cur.X+1)
+	// the attributes used for the next output
+	b.WriteString(sgr(cur.Attr))
+	if s.cursorShape != "" {
+		fmt.Fprintf(b, "\x1b[%sq", s.cursorShape)
+	} else if explicit {
+		b.WriteString("\x1b[0 q")
+	}
+	if s.CursorVisible() {
+		b.WriteString("\x1b[?25h")
+	} else {
+		b.WriteString("\x1b[?25l")
+	}
+}
+
+// line renders a line, changing attributes only when needed and skipping
+// the trailing blanks. It returns an empty string for a blank line.
+func (s *screen) line(y int, cols int) string {
+	end := cols
+	for end > 0 && isBlank(s.Cell(end-1, y)) {
+		end--
+	}
+	if end == 0 {
+		return ""
+	}
+	var b strings.Builder
+	// vt10x keeps a wide character in one cell, so we count the width to
+	// avoid wrapping
+	width := 0
+	last := ""
+	for x := 0; x < end; x++ {
+		g := s.Cell(x, y)
+		if g.Char == 0 {
+			g = vt10x.Glyph{Char: ' ', FG: vt10x.DefaultFG, BG: vt10x.DefaultBG}
+		}
+		if g.Mode&vtAttrReverse != 0 {
+			// vt10x stores the reversed colors
+			g.FG, g.BG = g.BG, g.FG
+		}
+		w := runeWidth(g.Char)
+		if width+w > cols {
+			break
+		}
+		width += w
+		a := sgr(g)
+		if a != last {
+			b.WriteString(a)
+			last = a
+		}
+		b.WriteRune(g.Char)
+	}
+	return b.String()
+}
+
+// isBlank returns true for an empty cell with the default background
+func isBlank(g vt10x.Glyph) bool {
+	if g.Char == 0 {
+		return true
+	}
+	return g.Char == ' ' && g.BG == vt10x.DefaultBG &&
+		g.Mode&(vtAttrUnderline|vtAttrReverse) == 0
+}
+
+// sgr returns the control sequence that sets a glyph's attributes
+func sgr(g vt10x.Glyph) string {
+	params := []string{"0"}
+	if g.Mode&vtAttrBold != 0 {
+		params = append(params, "1")
+	}
+	if g.Mode&vtAttrItalic != 0 {
+		params = append(params, "3")
+	}
+	if g.Mode&vtAttrUnderline != 0 {
+		params = append(params, "4")
+	}
+	if g.Mode&vtAttrBlink != 0 {
+		params = append(params, "5")
+	}
+	if g.Mode&vtAttrReverse != 0 {
+		params = append(params, "7")
+	}
+	params = append(params, color(g.FG, 30, 90, 38)...)
+	params = append(params, color(g.BG, 40, 100, 48)...)
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+// color returns the SGR parameters for a color, using the basic, bright or
+// extended parameters
+func color(c vt10x.Color, basic int, bright int, extended int) []string {
+	switch {
+	case c >= vt10x.DefaultFG:
+		// default colors
+		return nil
+	case c < 8:
+		return []string{strconv.Itoa(basic + int(c))}
+	case c < 16:
+		return []string{strconv.Itoa(bright + int(c) - 8)}
+	case c < 256:
+		return []string{strconv.Itoa(extended), "5", strconv.Itoa(int(c))}
+	}
+	return []string{strconv.Itoa(extended), "2", strconv.Itoa(int(c >> 16 & 0xff)),
+		strconv.Itoa(int(c >> 8 & 0xff)), strconv.Itoa(int(c & 0xff))}
+}
+
+// wideRanges are the ranges of east asian wide & full width characters
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x2e80, 0x303e}, {0x3041, 0x33ff}, {0x3400, 0x4dbf},
+	{0x4e00, 0x9fff}, {0xa000, 0xa4cf}, {0xac00, 0xd7a3}, {0xf900, 0xfaff},
+	{0xfe30, 0xfe4f}, {0xff00, 0xff60}, {0xffe0, 0xffe6}, {0x1f300, 0x1f64f},
+	{0x1f900, 0x1f9ff}, {0x20000, 0x2fffd}, {0x30000, 0x3fffd},
+}
+
+// runeWidth returns the number of columns a character takes
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	for _, w := range wideRanges {
+		if r < w[0] {
+			break
+		}
+		if r <= w[1] {
+			return 2
+		}
+	}
+	return 1
+}
@@ -0,0 +1,64 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/hinshun/vt10x"
+	"github.com/stretchr/testify/require"
+)
+
+// requireSameScreen checks two screens have the same cells, cursor & modes
+func requireSameScreen(t *testing.T, expected *screen, actual *screen) {
+	cols, rows := expected.Size()
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			require.Equal(t, expected.Cell(x, y), actual.Cell(x, y),
+				"cell %d,%d", x, y)
+		}
+	}
+	require.Equal(t, expected.Cursor().X, actual.Cursor().X)
+	require.Equal(t, expected.Cursor().Y, actual.Cursor().Y)
+	require.Equal(t, expected.Cursor().Attr, actual.Cursor().Attr)
+	require.Equal(t, expected.Mode(), actual.Mode())
+	require.Equal(t, expected.Title(), actual.Title())
+	require.Equal(t, expected.region, actual.region)
+	require.Equal(t, expected.cursorShape, actual.cursorShape)
+}
+
+func TestScreenRender(t *testing.T) {
+	s := newScreen(20, 5)
+	s.Write([]byte("\x1b]0;BADWOLF\x07héllo \x1b[1;31mred\x1b[0m\r\n"))
+	s.Write([]byte("\x1b[4;38;5;200mpink\x1b[0m \x1b[48;2;1;2;3mrgb\x1b[0m\r\n"))
+	s.Write([]byte("\x1b[7minv\x1b[0m \x1b[2 q\x1b[?1h\x1b[2;4r\x1b[5;3H\x1b[32m"))
+	r := newScreen(20, 5)
+	r.Write(s.Render())
+	requireSameScreen(t, s, r)
+	require.Equal(t, 'é', r.Cell(1, 0).Char)
+}
+
+func TestScreenRenderAltScreen(t *testing.T) {
+	s := newScreen(10, 3)
+	s.Write([]byte("main\x1b[?1049h\x1b[H\x1b[2Jalt\x1b[?25l"))
+	require.NotZero(t, s.Mode()&vt10x.ModeAltScreen)
+	r := newScreen(10, 3)
+	r.Write(s.Render())
+	requireSameScreen(t, s, r)
+	require.False(t, r.CursorVisible())
+}
+
+func TestScreenSplitSequence(t *testing.T) {
+	s := newScreen(10, 3)
+	s.Write([]byte("\x1b[1;"))
+	s.Write([]byte("2r\x1b[4"))
+	s.Write([]byte(" q"))
+	require.Equal(t, "1;2", s.region)
+	require.Equal(t, "4 ", s.cursorShape)
+	s.Write([]byte("\x1bc"))
+	require.Equal(t, "", s.region)
+}
+
+func TestRuneWidth(t *testing.T) {
+	require.Equal(t, 1, runeWidth('a'))
+	require.Equal(t, 2, runeWidth('中'))
+	require.Equal(t, 0, runeWidth('́'))
+}
@@ -0,0 +1,341 @@
+// This file holds the screen sync mode, where a client gets the pane's
+// screen instead of its output. The client gets numbered frames, each
+// patching the screen from the last state the client acknowledged to the
+// current one, so floods of output cost bounded bandwidth and frames can
+// be lost. The frames are ANSI sequences the client writes to its
+// terminal as is.
+package peers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hinshun/vt10x"
+	"github.com/pion/webrtc/v3"
+)
+
+// The output modes of a pane's client
+const (
+	// ModeRaw streams the pane's output, the default
+	ModeRaw = "raw"
+	// ModeScreen syncs the pane's screen
+	ModeScreen = "screen"
+)
+
+// SyncFrameHeaderSize is the size of a screen sync frame's header: the
+// frame's number and the number of the frame it patches, 8 bytes each, the
+// sequence number of the last input written, 4 bytes, and the screen's
+// rows & cols, 2 bytes each. All in network order.
+const SyncFrameHeaderSize = 24
+
+// The types of the messages a screen sync client sends
+const (
+	// SyncInput is followed by the input's sequence number, 4 bytes, and
+	// the input
+	SyncInput byte = iota
+	// SyncAck is followed by the number of the frame the client applied,
+	// 8 bytes
+	SyncAck
+)
+
+var (
+	// SyncFrameInterval is the shortest time between two frames
+	SyncFrameInterval = 30 * time.Millisecond
+	// SyncRetransmitTimeout is how long to wait for an ack before sending
+	// a new frame
+	SyncRetransmitTimeout = 300 * time.Millisecond
+)
+
+// maxUnacked is the number of frames sent with no ack before the frames
+// redraw the whole screen
+const maxUnacked = 64
+
+// validateMode returns an error for unknown modes and for args screen
+// sync mode doesn't support
+func validateMode(mode string, offsets bool, compression string) error {
+	switch mode {
+	case "", ModeRaw:
+		return nil
+	case ModeScreen:
+		if offsets || compression != "" {
+			return fmt.Errorf("screen mode has no offsets or compression")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// screenState is a snapshot of a screen
+type screenState struct {
+	cols  int
+	rows  int
+	alt   bool
+	lines []string
+	// tail holds the rendered title, modes & cursor
+	tail string
+}
+
+// syncState returns a snapshot of the screen
+func (s *screen) syncState() *screenState {
+	s.Lock()
+	defer s.Unlock()
+	s.m.Lock()
+	defer s.m.Unlock()
+	cols, rows := s.Size()
+	st := &screenState{
+		cols:  cols,
+		rows:  rows,
+		alt:   s.Mode()&vt10x.ModeAltScreen != 0,
+		lines: make([]string, rows),
+	}
+	for y := 0; y < rows; y++ {
+		st.lines[y] = s.line(y, cols)
+	}
+	var b bytes.Buffer
+	s.writeState(&b, true)
+	st.tail = b.String()
+	return st
+}
+
+func (st *screenState) equal(o *screenState) bool {
+	if st.cols != o.cols || st.rows != o.rows || st.alt != o.alt ||
+		st.tail != o.tail {
+		return false
+	}
+	for y := range st.lines {
+		if st.lines[y] != o.lines[y] {
+			return false
+		}
+	}
+	return true
+}
+
+// patch renders the state's lines in draw, or all of them when full is
+// true, and its title, modes & cursor. leaveAlt is true when a full patch
+// should leave the alternate screen the client may show.
+func (st *screenState) patch(draw []int, full bool, leaveAlt bool) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x1b[r\x1b[?6l\x1b[0m")
+	if full {
+		if st.alt {
+			b.WriteString("\x1b[?1049h")
+		} else if leaveAlt {
+			b.WriteString("\x1b[?1049l")
+		}
+		b.WriteString("\x1b[0m\x1b[H\x1b[2J")
+		for y, l := range st.lines {
+			if l != "" {
+				fmt.Fprintf(&b, "\x1b[%d;1H%s", y+1, l)
+			}
+		}
+	} else {
+		for _, y := range draw {
+			fmt.Fprintf(&b, "\x1b[%d;1H\x1b[0m\x1b[2K%s", y+1, st.lines[y])
+		}
+	}
+	b.WriteString("\x1b[0m")
+	b.WriteString(st.tail)
+	return b.Bytes()
+}
+
+// syncFrame is a frame sent to a client
+type syncFrame struct {
+	num   uint64
+	state *screenState
+	// drawn holds the lines the frame drew, unless it's full
+	drawn []int
+	full  bool
+	// input is the sequence number of the last input written
+	input uint32
+}
+
+// syncClient sends a pane's screen to a client in screen sync mode
+type syncClient struct {
+	client *Client
+	wake   chan struct{}
+	m      sync.Mutex
+	num    uint64
+	// acked is the last frame the client acknowledged, nil before its
+	// first ack, and sent are the frames sent since
+	acked *syncFrame
+	sent  []*syncFrame
+	// input is the sequence number of the last input written
+	input uint32
+	// alt is true once a frame showed the alternate screen
+	alt bool
+}
+
+func newSyncClient(c *Client) *syncClient {
+	s := &syncClient{client: c, wake: make(chan struct{}, 1)}
+	// the first frame is sent right away
+	s.signal()
+	return s
+}
+
+// signal tells the sender the screen changed
+func (s *syncClient) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// unacked returns true when there are frames with no ack
+func (s *syncClient) unacked() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.sent) > 0
+}
+
+// run sends the frames until the client is stopped
+func (s *syncClient) run() {
+	logger := s.client.pane.peer.logger
+	var last time.Time
+	for {
+		var timeout <-chan time.Time
+		if s.unacked() {
+			timeout = time.After(SyncRetransmitTimeout)
+		}
+		retry := false
+		select {
+		case <-s.client.done:
+			return
+		case <-s.wake:
+		case <-timeout:
+			retry = true
+		}
+		if wait := SyncFrameInterval - time.Since(last); wait > 0 {
+			select {
+			case <-s.client.done:
+				return
+			case <-time.After(wait):
+			}
+		}
+		f := s.nextFrame(retry)
+		if f == nil {
+			continue
+		}
+		err := s.client.dc.Send(f)
+		if err != nil {
+			logger.Warnf("@%d: failed to send a screen frame: %s",
+				s.client.pane.ID, err)
+		}
+		last = time.Now()
+	}
+}
+
+// nextFrame returns the next frame, nil when the client is up to date
+func (s *syncClient) nextFrame(retry bool) []byte {
+	st := s.client.pane.vt.syncState()
+	s.m.Lock()
+	defer s.m.Unlock()
+	last := s.acked
+	if len(s.sent) > 0 {
+		last = s.sent[len(s.sent)-1]
+	}
+	if last != nil && last.input == s.input && last.state.equal(st) &&
+		!(retry && len(s.sent) > 0) {
+		return nil
+	}
+	if len(s.sent) >= maxUnacked {
+		// the client is not acking, the frames redraw the screen until it
+		// acks one of them
+		s.acked = nil
+		s.sent = nil
+	}
+	f := &syncFrame{state: st, input: s.input, full: s.acked == nil}
+	var base uint64
+	if !f.full {
+		base = s.acked.num
+		f.drawn, f.full = s.draw(st)
+	}
+	s.num++
+	f.num = s.num
+	s.sent = append(s.sent, f)
+	leaveAlt := s.alt
+	s.alt = s.alt || st.alt
+	h := make([]byte, SyncFrameHeaderSize)
+	binary.BigEndian.PutUint64(h, f.num)
+	binary.BigEndian.PutUint64(h[8:], base)
+	binary.BigEndian.PutUint32(h[16:], f.input)
+	binary.BigEndian.PutUint16(h[20:], uint16(st.rows))
+	binary.BigEndian.PutUint16(h[22:], uint16(st.cols))
+	return append(h, st.patch(f.drawn, f.full, leaveAlt)...)
+}
+
+// draw returns the lines to draw so a client showing the acked state, or
+// any state sent since, shows st. Those are the lines that changed since
+// the acked state and the lines drawn by the frames sent since. It returns
+// true when the whole screen should be redrawn. It should be called while
+// holding s.m.
+func (s *syncClient) draw(st *screenState) ([]int, bool) {
+	base := s.acked.state
+	if base.cols != st.cols || base.rows != st.rows || base.alt != st.alt {
+		return nil, true
+	}
+	touched := make(map[int]bool)
+	for _, f := range s.sent {
+		if f.full || f.state.alt != st.alt || f.state.rows != st.rows ||
+			f.state.cols != st.cols {
+			return nil, true
+		}
+		for _, y := range f.drawn {
+			touched[y] = true
+		}
+	}
+	var draw []int
+	for y, l := range st.lines {
+		if touched[y] || l != base.lines[y] {
+			draw = append(draw, y)
+		}
+	}
+	return draw, false
+}
+
+// ack handles the client's ack of a frame
+func (s *syncClient) ack(num uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i, f := range s.sent {
+		if f.num == num {
+			s.acked = f
+			s.sent = s.sent[i+1:]
+			return
+		}
+	}
+}
+
+// accept returns true when the input with the given sequence number is the
+// next input to write
+func (s *syncClient) accept(seq uint32) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if seq != s.input+1 {
+		return false
+	}
+	s.input = seq
+	return true
+}
+
+// onMessage handles the client's input & acks. Input that's out of order or
+// was already written is dropped, the client sends it again until a frame
+// acks it.
+func (s *syncClient) onMessage(msg webrtc.DataChannelMessage) {
+	logger := s.client.pane.peer.logger
+	b := msg.Data
+	switch {
+	case len(b) >= 5 && b[0] == SyncInput:
+		if s.accept(binary.BigEndian.Uint32(b[1:])) {
+			s.client.input(webrtc.DataChannelMessage{Data: b[5:]})
+		}
+		// the next frame acks the input
+		s.signal()
+	case len(b) == 9 && b[0] == SyncAck:
+		s.ack(binary.BigEndian.Uint64(b[1:]))
+	default:
+		logger.Warnf("@%d: got an invalid screen sync message", s.client.pane.ID)
+	}
+}
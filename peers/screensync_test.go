@@ -0,0 +1,139 @@
+package peers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSyncClient(cols int, rows int) *syncClient {
+	pane := &Pane{vt: newScreen(cols, rows)}
+	return newSyncClient(&Client{pane: pane, done: make(chan struct{})})
+}
+
+// applyFrame writes a frame's patch to a client's screen, returning the
+// frame's number & base
+func applyFrame(t *testing.T, r *screen, f []byte) (uint64, uint64) {
+	require.GreaterOrEqual(t, len(f), SyncFrameHeaderSize)
+	rows := int(binary.BigEndian.Uint16(f[20:]))
+	cols := int(binary.BigEndian.Uint16(f[22:]))
+	if c, r0 := r.Size(); c != cols || r0 != rows {
+		r.Resize(cols, rows)
+	}
+	r.Write(f[SyncFrameHeaderSize:])
+	return binary.BigEndian.Uint64(f), binary.BigEndian.Uint64(f[8:])
+}
+
+func TestSyncFrames(t *testing.T) {
+	s := newTestSyncClient(20, 5)
+	vt := s.client.pane.vt
+	vt.Write([]byte("\x1b]0;BADWOLF\x07hello \x1b[1;31mred\x1b[0m\r\n"))
+	r := newScreen(20, 5)
+	f := s.nextFrame(false)
+	num, base := applyFrame(t, r, f)
+	require.Equal(t, uint64(1), num)
+	require.Equal(t, uint64(0), base)
+	requireSameScreen(t, vt, r)
+	// nothing changed
+	require.Nil(t, s.nextFrame(false))
+	s.ack(num)
+	vt.Write([]byte("second\r\n\x1b[?25l"))
+	f = s.nextFrame(false)
+	num, base = applyFrame(t, r, f)
+	require.Equal(t, uint64(2), num)
+	require.Equal(t, uint64(1), base)
+	requireSameScreen(t, vt, r)
+	require.False(t, r.CursorVisible())
+	// a diff draws only the changed lines
+	require.NotContains(t, string(f), "hello")
+	require.Contains(t, string(f), "second")
+}
+
+func TestSyncFramesLost(t *testing.T) {
+	s := newTestSyncClient(20, 5)
+	vt := s.client.pane.vt
+	vt.Write([]byte("one\r\n"))
+	r := newScreen(20, 5)
+	num, _ := applyFrame(t, r, s.nextFrame(false))
+	s.ack(num)
+	// frame 2 is lost, frame 3 is based on frame 1 and redraws what 2 drew
+	vt.Write([]byte("two\r\n"))
+	require.NotNil(t, s.nextFrame(false))
+	vt.Write([]byte("\x1b[Hzero"))
+	num, base := applyFrame(t, r, s.nextFrame(false))
+	require.Equal(t, uint64(3), num)
+	require.Equal(t, uint64(1), base)
+	requireSameScreen(t, vt, r)
+	s.ack(num)
+	require.Empty(t, s.sent)
+	// a retry resends the screen even with no change
+	vt.Write([]byte("three"))
+	applyFrame(t, r, s.nextFrame(false))
+	requireSameScreen(t, vt, r)
+	require.Nil(t, s.nextFrame(false))
+	require.NotNil(t, s.nextFrame(true))
+}
+
+func TestSyncFramesResize(t *testing.T) {
+	s := newTestSyncClient(20, 5)
+	vt := s.client.pane.vt
+	vt.Write([]byte("wide"))
+	r := newScreen(20, 5)
+	num, _ := applyFrame(t, r, s.nextFrame(false))
+	s.ack(num)
+	vt.Resize(10, 3)
+	vt.Write([]byte("\x1b[?1049hnarrow"))
+	applyFrame(t, r, s.nextFrame(false))
+	requireSameScreen(t, vt, r)
+	require.True(t, s.sent[0].full)
+}
+
+func TestSyncFramesNoAck(t *testing.T) {
+	s := newTestSyncClient(20, 5)
+	vt := s.client.pane.vt
+	num, _ := applyFrame(t, newScreen(20, 5), s.nextFrame(false))
+	s.ack(num)
+	for i := 0; i < maxUnacked; i++ {
+		vt.Write([]byte(fmt.Sprintf("\r%d", i)))
+		require.NotNil(t, s.nextFrame(false))
+	}
+	vt.Write([]byte("y"))
+	r := newScreen(20, 5)
+	_, base := applyFrame(t, r, s.nextFrame(false))
+	require.Equal(t, uint64(0), base)
+	requireSameScreen(t, vt, r)
+	require.Len(t, s.sent, 1)
+}
+
+func TestSyncInput(t *testing.T) {
+	s := newTestSyncClient(20, 5)
+	require.True(t, s.accept(1))
+	require.False(t, s.accept(1))
+	require.False(t, s.accept(3))
+	require.True(t, s.accept(2))
+	f := s.nextFrame(false)
+	require.Equal(t, uint32(2), binary.BigEndian.Uint32(f[16:]))
+	// an input ack is a new frame even if the screen didn't change
+	require.True(t, s.accept(3))
+	f = s.nextFrame(false)
+	require.NotNil(t, f)
+	require.Equal(t, uint32(3), binary.BigEndian.Uint32(f[16:]))
+}
+
+func TestValidateMode(t *testing.T) {
+	a := AddPaneArgs{Command: []string{"bash"}, Mode: ModeScreen}
+	require.NoError(t, a.Validate())
+	a.Pipe = true
+	require.Error(t, a.Validate())
+	a = AddPaneArgs{Command: []string{"bash"}, Mode: ModeScreen, Compression: "deflate"}
+	require.Error(t, a.Validate())
+	a = AddPaneArgs{Command: []string{"bash"}, Mode: "video"}
+	require.Error(t, a.Validate())
+	offset := int64(0)
+	r := ReconnectPaneArgs{ID: 1, Mode: ModeScreen, Offset: &offset}
+	require.Error(t, r.Validate())
+	r = ReconnectPaneArgs{ID: 1, Mode: ModeRaw}
+	require.NoError(t, r.Validate())
+}
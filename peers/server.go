@@ -0,0 +1,148 @@
+// This file holds the server, the owner of the peers, panes & clients of a
+// webexec agent
+package peers
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Server holds all the state of an agent: its peers, panes, clients and
+// the client's payload. Servers share nothing so a process, i.e. a test,
+// can run more than one.
+type Server struct {
+	Conf *Conf
+	// Peers holds all the peers (connected and disconnected)
+	Peers *PeersDB
+	// Panes holds all the panes, running and exited
+	Panes *PanesDB
+	// PtyMux starts the commands of panes with a pty
+	PtyMux PtyMuxInterface
+	// Payload holds the client's payload
+	Payload    []byte
+	payloadM   sync.RWMutex
+	cdb        *ClientsDB
+	webrtcAPI  *webrtc.API
+	webrtcAPIM sync.Mutex
+	// the id of the last marker used
+	lastMarker int
+	markerM    sync.RWMutex
+}
+
+// NewServer returns a new server with no peers & panes
+func NewServer(conf *Conf) *Server {
+	return &Server{
+		Conf:   conf,
+		Peers:  NewPeersDB(),
+		Panes:  NewPanesDB(),
+		PtyMux: PtyMuxType{},
+		cdb:    NewClientsDB(),
+	}
+}
+
+// GetPayload returns the client's payload
+func (s *Server) GetPayload() []byte {
+	s.payloadM.RLock()
+	defer s.payloadM.RUnlock()
+	return s.Payload
+}
+
+// SetPayload sets the client's payload
+func (s *Server) SetPayload(payload []byte) {
+	s.payloadM.Lock()
+	s.Payload = payload
+	s.payloadM.Unlock()
+}
+
+// nextMarker returns a new marker id
+func (s *Server) nextMarker() int {
+	s.markerM.Lock()
+	defer s.markerM.Unlock()
+	s.lastMarker++
+	return s.lastMarker
+}
+
+// api returns the gateway to webrtc calls, creating it on first use
+func (s *Server) api() *webrtc.API {
+	s.webrtcAPIM.Lock()
+	defer s.webrtcAPIM.Unlock()
+	if s.webrtcAPI == nil {
+		se := webrtc.SettingEngine{}
+		if s.Conf.PortMax > 0 {
+			se.SetEphemeralUDPPortRange(s.Conf.PortMin, s.Conf.PortMax)
+		}
+		se.SetICETimeouts(s.Conf.DisconnectTimeout, s.Conf.FailedTimeout,
+			s.Conf.KeepAliveInterval)
+		s.webrtcAPI = webrtc.NewAPI(webrtc.WithSettingEngine(se))
+	}
+	return s.webrtcAPI
+}
+
+// NewPeer funcions starts listening to incoming peer connection from a remote
+func (s *Server) NewPeer(fp string) (*Peer, error) {
+	conf := s.Conf
+	iceservers, err := conf.GetICEServers()
+	if err != nil {
+		conf.Logger.Errorf("Failed to get ICE servers: %s", err)
+	}
+	config := webrtc.Configuration{
+		PeerIdentity: "webexec",
+		ICEServers:   iceservers,
+		Certificates: []webrtc.Certificate{*conf.Certificate},
+	}
+	pc, err := s.api().NewPeerConnection(config)
+	if err != nil {
+		return nil, fmt.Errorf("NewPeerConnection failed: %s", err)
+	}
+	peer := Peer{
+		FP:                fp,
+		Token:             "",
+		LastContact:       nil,
+		LastRef:           0,
+		PC:                pc,
+		Marker:            -1,
+		APIVersion:        1,
+		pendingCandidates: make(chan *webrtc.ICECandidateInit, 8),
+		Conf:              conf,
+		server:            s,
+	}
+	s.Peers.Add(&peer) // This will set peer.ID
+	peer.logger = conf.Logger.With("peer", peer.ID)
+	peer.startLifecycle()
+	// Status changes happend when the peer has connected/disconnected
+	pc.OnConnectionStateChange(peer.onConnectionStateChange)
+	pc.OnDataChannel(peer.OnChannelReq)
+	return &peer, nil
+}
+
+// newOrphanPeer returns a peer with no connection, used as the peer of panes
+// restored after an agent restart. Clients reconnect to these panes.
+func (s *Server) newOrphanPeer() *Peer {
+	return &Peer{Marker: -1, logger: s.Conf.Logger, Conf: s.Conf, server: s}
+}
+
+// Shutdown is called when it's time to go.Sweet dreams.
+func (s *Server) Shutdown() {
+	logger := s.Conf.Logger
+	var err error
+	for _, peer := range s.Peers.All() {
+		if pc := peer.GetPC(); pc != nil {
+			err = pc.Close()
+			if err != nil {
+				logger.Error("Failed closing peer connection: %w", err)
+			}
+		}
+	}
+	// kept panes have no C and are left running for the next agent
+	for _, p := range s.Panes.All() {
+		if !p.running() || p.C == nil {
+			continue
+		}
+		err = p.C.Process.Kill()
+		if err != nil {
+			logger.Error("Failed closing a process: %w", err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// This file holds the code that spills the history overwritten in a
+// buffer's ring to compressed files, so scrollback can be larger than memory
+package peers
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// spillBlockSize is the size of the uncompressed blocks written to disk
+const spillBlockSize = 64 * 1024
+
+// DefaultSpillMax is the default limit of a pane's spilled history on disk
+const DefaultSpillMax = 64 * 1024 * 1024
+
+// spillBlock is a compressed block of history in a spill file
+type spillBlock struct {
+	// Offset is the offset of the block's first byte
+	Offset int64 `json:"offset"`
+	// Pos is the block's position in the file
+	Pos int64 `json:"pos"`
+	// Len is the compressed length and N the uncompressed one
+	Len int `json:"len"`
+	N   int `json:"n"`
+}
+
+// spillFile is a file of compressed blocks
+type spillFile struct {
+	Path   string       `json:"path"`
+	Blocks []spillBlock `json:"blocks"`
+	Size   int64        `json:"size"`
+	f      *os.File
+}
+
+// spill holds the history overwritten in a buffer's ring. Blocks are
+// written to the last file and when it's full the oldest file is removed,
+// so there are at most two files.
+type spill struct {
+	dir   string
+	max   int64
+	files []*spillFile
+	// pending holds the bytes that are not yet in a block and
+	// pendingOffset is the offset of its first byte
+	pending       []byte
+	pendingOffset int64
+}
+
+func newSpill(dir string, max int64) *spill {
+	if max <= 0 {
+		max = DefaultSpillMax
+	}
+	return &spill{dir: dir, max: max}
+}
+
+// start returns the offset of the oldest spilled byte
+func (s *spill) start() int64 {
+	for _, f := range s.files {
+		if len(f.Blocks) > 0 {
+			return f.Blocks[0].Offset
+		}
+	}
+	return s.pendingOffset
+}
+
+// end returns the offset after the last spilled byte
+func (s *spill) end() int64 {
+	return s.pendingOffset + int64(len(s.pending))
+}
+
+// write spills b, the history that starts at a given offset
+func (s *spill) write(b []byte, offset int64) error {
+	if len(s.pending) == 0 {
+		s.pendingOffset = offset
+	}
+	s.pending = append(s.pending, b...)
+	for len(s.pending) >= spillBlockSize {
+		err := s.flushBlock(spillBlockSize)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the pending bytes to disk
+func (s *spill) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	return s.flushBlock(len(s.pending))
+}
+
+// flushBlock compresses n pending bytes and writes them as a block
+func (s *spill) flushBlock(n int) error {
+	var c bytes.Buffer
+	w, err := flate.NewWriter(&c, flate.BestSpeed)
+	if err != nil {
+		return err
+	}
+	w.Write(s.pending[:n])
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	f, err := s.current()
+	if err != nil {
+		return err
+	}
+	_, err = f.f.WriteAt(c.Bytes(), f.Size)
+	if err != nil {
+		return fmt.Errorf("Failed to write to spill file: %s", err)
+	}
+	f.Blocks = append(f.Blocks, spillBlock{
+		Offset: s.pendingOffset,
+		Pos:    f.Size,
+		Len:    c.Len(),
+		N:      n,
+	})
+	f.Size += int64(c.Len())
+	s.pendingOffset += int64(n)
+	s.pending = append(s.pending[:0], s.pending[n:]...)
+	return nil
+}
+
+// current returns the file to write to, rotating the files when it's full
+func (s *spill) current() (*spillFile, error) {
+	if len(s.files) > 0 {
+		last := s.files[len(s.files)-1]
+		if last.Size < s.max/2 {
+			return last, nil
+		}
+	}
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the spill dir: %s", err)
+	}
+	f, err := ioutil.TempFile(s.dir, "pane-*.z")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a spill file: %s", err)
+	}
+	s.files = append(s.files, &spillFile{Path: f.Name(), f: f})
+	if len(s.files) > 2 {
+		s.files[0].remove()
+		s.files = s.files[1:]
+	}
+	return s.files[len(s.files)-1], nil
+}
+
+// read calls fn with the spilled history from a given offset to the end
+func (s *spill) read(from int64, fn func([]byte) error) error {
+	for _, f := range s.files {
+		for _, b := range f.Blocks {
+			if b.Offset+int64(b.N) <= from {
+				continue
+			}
+			data, err := f.readBlock(b)
+			if err != nil {
+				return err
+			}
+			if from > b.Offset {
+				data = data[from-b.Offset:]
+			}
+			err = fn(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(s.pending) > 0 && s.end() > from {
+		p := s.pending
+		if from > s.pendingOffset {
+			p = p[from-s.pendingOffset:]
+		}
+		return fn(append([]byte{}, p...))
+	}
+	return nil
+}
+
+// readBlock reads & decompresses a block
+func (f *spillFile) readBlock(b spillBlock) ([]byte, error) {
+	c := make([]byte, b.Len)
+	_, err := f.f.ReadAt(c, b.Pos)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read spill file: %s", err)
+	}
+	r := flate.NewReader(bytes.NewReader(c))
+	defer r.Close()
+	data := make([]byte, b.N)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress spill block: %s", err)
+	}
+	return data, nil
+}
+
+// shift moves the spilled history's offsets by delta
+func (s *spill) shift(delta int64) {
+	for _, f := range s.files {
+		for i := range f.Blocks {
+			f.Blocks[i].Offset += delta
+		}
+	}
+	s.pendingOffset += delta
+}
+
+// state flushes the pending bytes and returns the spill files
+func (s *spill) state() ([]*spillFile, error) {
+	err := s.flush()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*spillFile, len(s.files))
+	for i, f := range s.files {
+		files[i] = &spillFile{
+			Path:   f.Path,
+			Blocks: append([]spillBlock{}, f.Blocks...),
+			Size:   f.Size,
+		}
+	}
+	return files, nil
+}
+
+// restore opens spill files returned by state()
+func (s *spill) restore(files []*spillFile) error {
+	for _, sf := range files {
+		f, err := os.OpenFile(sf.Path, os.O_RDWR, 0600)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("Failed to open spill file: %s", err)
+		}
+		s.files = append(s.files, &spillFile{
+			Path:   sf.Path,
+			Blocks: sf.Blocks,
+			Size:   sf.Size,
+			f:      f,
+		})
+	}
+	s.pendingOffset = s.start()
+	for _, f := range s.files {
+		if n := len(f.Blocks); n > 0 {
+			b := f.Blocks[n-1]
+			s.pendingOffset = b.Offset + int64(b.N)
+		}
+	}
+	return nil
+}
+
+// close removes the spill files
+func (s *spill) close() {
+	for _, f := range s.files {
+		f.remove()
+	}
+	s.files = nil
+	s.pending = nil
+}
+
+func (f *spillFile) remove() {
+	if f.f != nil {
+		f.f.Close()
+	}
+	os.Remove(f.Path)
+}
+
+// RemoveSpillFiles removes the spill files left in a directory, i.e. by an
+// agent that crashed
+func RemoveSpillFiles(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "pane-*.z"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		os.Remove(f)
+	}
+	return nil
+}
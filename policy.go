@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/tuzig/webexec/peers"
+)
+
+// FilePolicy is a policy backend that maps clients' fingerprints & tokens to
+// policies in a toml file. The file is parsed again when it changes, so
+// changes apply to the clients that connect after them.
+type FilePolicy struct {
+	Path string
+	m    sync.Mutex
+	// tree is the parsed file, as it was at mtime with size bytes
+	tree  *toml.Tree
+	mtime time.Time
+	size  int64
+}
+
+// NewFilePolicy returns a policy backend for a file, the default file when
+// path is empty
+func NewFilePolicy(path string) *FilePolicy {
+	if path == "" {
+		path = ConfPath("policy.toml")
+	}
+	return &FilePolicy{Path: path}
+}
+
+// Get returns the policy of the first of the file's policies that lists the
+// fingerprint or the token, the default policy when none does and nil, to
+// allow everything, when there's no default or no file. Tokens granted read
+// only access get a read only policy whatever their policy is.
+func (f *FilePolicy) Get(fp string, token string) (*peers.Policy, error) {
+	t, err := f.load()
+	if t == nil || err != nil {
+		return nil, err
+	}
+	readOnly, err := stringsValue(t, "read_only_tokens")
+	if err != nil {
+		return nil, err
+	}
+	if token != "" && peers.Contains(readOnly, token) {
+		return &peers.Policy{Name: "read_only_tokens", ReadOnly: true}, nil
+	}
+	v := t.Get("policies")
+	if v != nil {
+		trees, ok := v.([]*toml.Tree)
+		if !ok {
+			return nil, fmt.Errorf("policies should be an array of tables")
+		}
+		for i, tree := range trees {
+			fps, err := stringsValue(tree, "fingerprints")
+			if err != nil {
+				return nil, err
+			}
+			tokens, err := stringsValue(tree, "tokens")
+			if err != nil {
+				return nil, err
+			}
+			if peers.Contains(fps, fp) || (token != "" && peers.Contains(tokens, token)) {
+				return parsePolicy(tree, fmt.Sprintf("policies[%d]", i))
+			}
+		}
+	}
+	v = t.Get("default")
+	if v == nil {
+		return nil, nil
+	}
+	tree, ok := v.(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("default should be a table")
+	}
+	return parsePolicy(tree, "default")
+}
+
+// load returns the parsed file, parsing it only when its modification time
+// or size changed, and nil when there's no file
+func (f *FilePolicy) load() (*toml.Tree, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	info, err := os.Stat(f.Path)
+	if os.IsNotExist(err) {
+		f.tree = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load policy file %q: %s", f.Path, err)
+	}
+	if f.tree != nil && info.ModTime().Equal(f.mtime) && info.Size() == f.size {
+		return f.tree, nil
+	}
+	t, err := toml.LoadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load policy file %q: %s", f.Path, err)
+	}
+	f.tree, f.mtime, f.size = t, info.ModTime(), info.Size()
+	return t, nil
+}
+
+// parsePolicy returns the policy in a table of the policy file. Missing keys
+// allow everything.
+func parsePolicy(t *toml.Tree, name string) (*peers.Policy, error) {
+	var err error
+	p := &peers.Policy{Name: name}
+	if v, ok := t.Get("name").(string); ok {
+		p.Name = v
+	}
+	if t.Has("commands") {
+		p.Commands, err = stringsValue(t, "commands")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.Has("profiles") {
+		p.Profiles, err = stringsValue(t, "profiles")
+		if err != nil {
+			return nil, err
+		}
+	}
+	pty, err := boolValue(t, "pty", true)
+	if err != nil {
+		return nil, err
+	}
+	p.NoPTY = !pty
+	payload, err := boolValue(t, "payload", true)
+	if err != nil {
+		return nil, err
+	}
+	p.NoPayload = !payload
+	p.ReadOnly, err = boolValue(t, "read_only", false)
+	if err != nil {
+		return nil, err
+	}
+	if v := t.Get("max_panes"); v != nil {
+		n, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("max_panes should be an integer")
+		}
+		p.MaxPanes = int(n)
+	}
+	return p, nil
+}
+
+// boolValue returns a boolean, def when the key is missing
+func boolValue(t *toml.Tree, key string, def bool) (bool, error) {
+	v := t.Get(key)
+	if v == nil {
+		return def, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s should be a boolean", key)
+	}
+	return b, nil
+}
+
+// stringsValue returns the strings in an array, an empty slice when the key
+// is missing
+func stringsValue(t *toml.Tree, key string) ([]string, error) {
+	r := []string{}
+	v := t.Get(key)
+	if v == nil {
+		return r, nil
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s should be an array of strings", key)
+	}
+	for _, s := range l {
+		s, ok := s.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s should be an array of strings", key)
+		}
+		r = append(r, s)
+	}
+	return r, nil
+}
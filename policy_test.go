@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tuzig/webexec/peers"
+)
+
+func TestFilePolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.toml")
+	f := NewFilePolicy(path)
+	// no file, no limits
+	p, err := f.Get("FP", "")
+	require.NoError(t, err)
+	require.Nil(t, p)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`read_only_tokens = [ "WATCHTOKEN" ]
+[default]
+commands = []
+pty = false
+[[policies]]
+name = "viewers"
+tokens = [ "VIEWTOKEN" ]
+read_only = true
+payload = false
+[[policies]]
+fingerprints = [ "DEVFP" ]
+commands = [ "htop", "tail -f *" ]
+profiles = [ "dev" ]
+max_panes = 4
+`), 0600))
+	p, err = f.Get("UNKNOWN", "VIEWTOKEN")
+	require.NoError(t, err)
+	require.Equal(t, &peers.Policy{Name: "viewers", ReadOnly: true,
+		NoPayload: true}, p)
+	p, err = f.Get("DEVFP", "")
+	require.NoError(t, err)
+	require.Equal(t, &peers.Policy{Name: "policies[1]",
+		Commands: []string{"htop", "tail -f *"}, Profiles: []string{"dev"},
+		MaxPanes: 4}, p)
+	p, err = f.Get("UNKNOWN", "")
+	require.NoError(t, err)
+	require.Equal(t, &peers.Policy{Name: "default", Commands: []string{},
+		NoPTY: true}, p)
+	// a token granted read only access is read only whatever its
+	// fingerprint's policy is
+	p, err = f.Get("DEVFP", "WATCHTOKEN")
+	require.NoError(t, err)
+	require.Equal(t, &peers.Policy{Name: "read_only_tokens", ReadOnly: true}, p)
+	// the file is parsed again only when it changes
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	bad := fmt.Sprintf("[default]\npty = %q\n", strings.Repeat("y", int(info.Size())-19))
+	require.NoError(t, ioutil.WriteFile(path, []byte(bad), 0600))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	p, err = f.Get("UNKNOWN", "")
+	require.NoError(t, err)
+	require.Equal(t, "default", p.Name)
+	later := info.ModTime().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	_, err = f.Get("UNKNOWN", "")
+	require.Error(t, err)
+	os.Remove(path)
+	p, err = f.Get("UNKNOWN", "")
+	require.NoError(t, err)
+	require.Nil(t, p)
+}
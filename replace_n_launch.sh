@@ -1,10 +1,10 @@
 #!/bin/sh
 # this should be run as root
-command_exists() {
-	command -v "$@" > /dev/null 2>&1
-}
 
-if command_exists webexec; then
-    webexec stop
+# rename so a running agent's binary is not overwritten
+cp webexec /usr/local/bin/webexec.new
+mv /usr/local/bin/webexec.new /usr/local/bin/webexec
+# hand the panes to the new binary
+if webexec status | grep -q "is running"; then
+    webexec upgrade
 fi
-cp webexec /usr/local/bin
@@ -22,7 +22,7 @@ import (
 type sockServer struct {
 	currentOffers map[string]*LiveOffer
 	coMutex       sync.Mutex
-	conf          *peers.Conf
+	server        *peers.Server
 }
 
 type LiveOffer struct {
@@ -42,9 +42,9 @@ func (lo *LiveOffer) handleIncoming(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case can := <-lo.incoming:
-			if lo.p.PC != nil {
+			if pc := lo.p.GetPC(); pc != nil {
 				Logger.Infof("Adding ICE candidate: %v", can)
-				err := lo.p.PC.AddICECandidate(can)
+				err := pc.AddICECandidate(can)
 				if err != nil {
 					Logger.Errorf("Failed to add ICE candidate: " + err.Error())
 				}
@@ -61,10 +61,10 @@ func (la *LiveOffer) OnCandidate(can *webrtc.ICECandidate) {
 		la.cs <- can
 	}
 }
-func NewSockServer(conf *peers.Conf) *sockServer {
+func NewSockServer(server *peers.Server) *sockServer {
 	return &sockServer{
 		currentOffers: make(map[string]*LiveOffer),
-		conf:          conf,
+		server:        server,
 	}
 }
 
@@ -98,6 +98,7 @@ func StartSocketServer(lc fx.Lifecycle, s *sockServer) (*http.Server, error) {
 	m.Handle("/status", http.HandlerFunc(s.handleStatus))
 	m.Handle("/layout", http.HandlerFunc(s.handleLayout))
 	m.Handle("/offer/", http.HandlerFunc(s.handleOffer))
+	m.Handle("/upgrade", http.HandlerFunc(s.handleUpgrade))
 	server := http.Server{Handler: &m}
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
@@ -125,11 +126,11 @@ func (s *sockServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("READY"))
 	}
 	/* TODO: return status of all connected peers
-	if len(peers.Peers) == 0 {
+	if s.server.Peers.Len() == 0 {
 		fmt.Println("No peers connected")
 	} else {
 		fmt.Println("Connected peers:")
-		for _, peer := range peers.Peers {
+		for _, peer := range s.server.Peers.All() {
 			fmt.Printf("  %s", peer.FP)
 		}
 	}
@@ -137,10 +138,10 @@ func (s *sockServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 }
 func (s *sockServer) handleLayout(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		w.Write(peers.Payload)
+		w.Write(s.server.GetPayload())
 	} else if r.Method == "POST" {
 		b, _ := ioutil.ReadAll(r.Body)
-		peers.Payload = b
+		s.server.SetPayload(b)
 	}
 }
 
@@ -171,9 +172,10 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		case <-time.After(time.Second * 5):
-			if a.p.PC == nil {
+			pc := a.p.GetPC()
+			if pc == nil {
 				http.Error(w, "Connection failed", http.StatusServiceUnavailable)
-			} else if a.p.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			} else if pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
 				http.Error(w, "Connection established", http.StatusNoContent)
 			}
 		}
@@ -197,7 +199,7 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		peer, err := peers.NewPeer(fp, s.conf)
+		peer, err := s.server.NewPeer(fp)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to create a new peer: %s", err),
 				http.StatusInternalServerError)
@@ -212,8 +214,13 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 		s.coMutex.Lock()
 		s.currentOffers[h] = lo
 		s.coMutex.Unlock()
-		peer.PC.OnICECandidate(lo.OnCandidate)
-		err = peer.PC.SetRemoteDescription(offer)
+		pc := peer.GetPC()
+		if pc == nil {
+			http.Error(w, "Connection failed", http.StatusServiceUnavailable)
+			return
+		}
+		pc.OnICECandidate(lo.OnCandidate)
+		err = pc.SetRemoteDescription(offer)
 		if err != nil {
 			msg := fmt.Sprintf("Peer failed to listen: %s", err)
 			http.Error(w, msg, http.StatusInternalServerError)
@@ -221,12 +228,15 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 		}
 		ctx, cancel := context.WithCancel(context.Background())
 		go lo.handleIncoming(ctx)
-		answer, err := peer.PC.CreateAnswer(nil)
+		answer, err := pc.CreateAnswer(nil)
 		if err != nil {
+			cancel()
 			http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+			return
 		}
-		err = peer.PC.SetLocalDescription(answer)
+		err = pc.SetLocalDescription(answer)
 		if err != nil {
+			cancel()
 			http.Error(w, "Failed to set local description", http.StatusInternalServerError)
 			return
 		}
@@ -234,11 +244,13 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 		m := map[string]string{"type": "answer", "sdp": answer.SDP, "id": h}
 		j, err := json.Marshal(m)
 		if err != nil {
+			cancel()
 			http.Error(w, "Failed to encode offer", http.StatusInternalServerError)
 			return
 		}
 		_, err = w.Write(j)
 		if err != nil {
+			cancel()
 			http.Error(w, "Failed to write answer", http.StatusInternalServerError)
 			return
 		}
@@ -35,7 +35,7 @@ func TestOfferGetCandidate(t *testing.T) {
 			return nil, nil
 		},
 	}
-	sockServer := NewSockServer(&conf)
+	sockServer := NewSockServer(peers.NewServer(&conf))
 	require.NotNil(t, sockServer, "Failed to create a new server")
 	server, err := StartSocketServer(lifecycle, sockServer)
 	require.NoError(t, err, "Failed to start a new server")
@@ -114,7 +114,7 @@ func TestOfferPutCandidates(t *testing.T) {
 			return nil, nil
 		},
 	}
-	sockServer := NewSockServer(&conf)
+	sockServer := NewSockServer(peers.NewServer(&conf))
 	server, err := StartSocketServer(lifecycle, sockServer)
 	lifecycle.RequireStart()
 	require.NoError(t, err, "Failed to start a new server")
@@ -182,7 +182,7 @@ func TestOfferPutCandidates(t *testing.T) {
 			err = r.Body.Close()
 			require.Nil(t, err, "Failed to close put body: %q", err)
 		case <-time.After(time.Second):
-			if a.p.PC.ICEGatheringState() != webrtc.ICEGatheringStateGathering {
+			if a.p.GetPC().ICEGatheringState() != webrtc.ICEGatheringStateGathering {
 				break
 			}
 		}
@@ -41,9 +41,6 @@ func isAlive(pid int) bool {
 }
 
 func initTest(t *testing.T) {
-	if peers.PtyMux == nil {
-		peers.PtyMux = peers.PtyMuxType{}
-	}
 	Logger = zaptest.NewLogger(t).Sugar()
 	conf, addr, err := parseConf(defaultConf)
 	require.Nil(t, err, "parseConf failed with: %s", err)
@@ -60,7 +57,7 @@ func initTest(t *testing.T) {
 	require.Nil(t, err)
 	key.save(cert)
 }
-func newPeer(t *testing.T, fp string, certificate *webrtc.Certificate) *peers.Peer {
+func newServer(t *testing.T, certificate *webrtc.Certificate) *peers.Server {
 	conf := peers.Conf{
 		Certificate:       certificate,
 		Logger:            Logger,
@@ -72,7 +69,10 @@ func newPeer(t *testing.T, fp string, certificate *webrtc.Certificate) *peers.Pe
 			return []webrtc.ICEServer{}, nil
 		},
 	}
-	peer, err := peers.NewPeer(fp, &conf)
+	return peers.NewServer(&conf)
+}
+func newPeer(t *testing.T, server *peers.Server, fp string) *peers.Peer {
+	peer, err := server.NewPeer(fp)
 	require.NoError(t, err)
 	require.NotNil(t, peer)
 	return peer
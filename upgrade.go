@@ -0,0 +1,325 @@
+// This file holds the code for upgrading a running agent without killing
+// its panes. The new agent listens on a unix socket and asks the running
+// agent to hand it its state. The running agent sends the panes' files
+// using SCM_RIGHTS followed by the state, waits for the new agent to confirm
+// and exits.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kardianos/osext"
+	"github.com/tuzig/webexec/peers"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// handOffTimeout is how long each side waits for the other
+const handOffTimeout = 10 * time.Second
+
+// maxFDsPerMessage keeps us below the kernel's limit of fds in a message
+const maxFDsPerMessage = 250
+
+// handedOff gets a value once the agent handed off its state and should exit
+var handedOff = make(chan bool, 1)
+
+// upgradeCMD starts a new agent from the current executable that takes over
+// the running agent
+func upgradeCMD(c *cli.Context) error {
+	certs, err := GetCerts()
+	if err != nil {
+		return fmt.Errorf("Failed to load certificates: %s", err)
+	}
+	_, _, err = LoadConf(certs)
+	if err != nil {
+		return err
+	}
+	pid, err := getAgentPid()
+	if err != nil {
+		return err
+	}
+	if pid == 0 {
+		return ErrAgentNotRunning
+	}
+	execPath, err := osext.Executable()
+	if err != nil {
+		return fmt.Errorf("Failed to find the executable: %s", err)
+	}
+	cmd := exec.Command("bash", "-c",
+		fmt.Sprintf("%s start --agent --takeover >> %s",
+			execPath, Conf.logFilePath))
+	cmd.Env = nil
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("new agent failed to start: %s", err)
+	}
+	go cmd.Wait()
+	fmt.Printf("Waiting for agent process %d to hand off\n", pid)
+	err = waitForExit(pid, 2*handOffTimeout)
+	if err != nil {
+		return fmt.Errorf("Upgrade failed, please check the log: %s", err)
+	}
+	// give the new agent a chance to write its pid file
+	for i := 0; i < 30; i++ {
+		newPid, err := getAgentPid()
+		if err == nil && newPid != 0 {
+			fmt.Printf("Agent upgraded, running as process %d\n", newPid)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Upgrade failed, the new agent is not running")
+}
+
+// waitForExit waits for a process to exit
+func waitForExit(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(pid, 0) != syscall.ESRCH {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for process %d to exit", pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// takeOver gets the state of the running agent and waits for it to exit
+func takeOver(server *peers.Server, logger *zap.SugaredLogger) error {
+	server.Conf.Logger = logger
+	pid, err := getAgentPid()
+	if err != nil {
+		return err
+	}
+	if pid == 0 {
+		return fmt.Errorf("No agent to take over")
+	}
+	socket := upgradeSocket()
+	os.Remove(socket)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("Failed to listen to the upgrade socket: %s", err)
+	}
+	defer os.Remove(socket)
+	defer l.Close()
+	reqErr := make(chan error, 1)
+	go func() {
+		reqErr <- requestHandOff(socket)
+	}()
+	l.SetDeadline(time.Now().Add(handOffTimeout))
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		select {
+		case e := <-reqErr:
+			if e != nil {
+				return e
+			}
+		default:
+		}
+		return fmt.Errorf("Failed to accept the hand off: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handOffTimeout))
+	h, files, err := receiveHandOff(conn)
+	if err != nil {
+		fmt.Fprintf(conn, "%s\n", err)
+		return fmt.Errorf("Failed to receive the hand off: %s", err)
+	}
+	server.Adopt(h, files)
+	_, err = conn.Write([]byte("ok\n"))
+	if err != nil {
+		return fmt.Errorf("Failed to confirm the hand off: %s", err)
+	}
+	logger.Infof("Took over %d panes, waiting for agent %d to exit",
+		len(h.Panes), pid)
+	// the old agent has to free the ports before we can listen
+	err = waitForExit(pid, handOffTimeout)
+	if err != nil {
+		return err
+	}
+	return createPIDFile()
+}
+
+// upgradeSocket returns the path of the socket the new agent listens on
+func upgradeSocket() string {
+	return RunPath("webexec.upgrade.sock")
+}
+
+// requestHandOff asks the running agent to hand off its state to the agent
+// listening on a unix socket
+func requestHandOff(socket string) error {
+	fp := GetSockFP()
+	httpc := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", fp)
+			},
+		},
+	}
+	r, err := httpc.Post("http://unix/upgrade", "text/plain",
+		strings.NewReader(socket))
+	if err != nil {
+		return fmt.Errorf("Failed to request a hand off: %s", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(r.Body)
+		return fmt.Errorf("Agent failed to hand off: %s", strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// handleUpgrade hands the agent's state off to the new agent listening on
+// the unix socket in the request's body
+func (s *sockServer) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "upgrade should be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read the request body", http.StatusBadRequest)
+		return
+	}
+	// only the user can listen on the upgrade socket, handing off to any
+	// other socket would pass the panes' ptys to whoever asked for them
+	if string(b) != upgradeSocket() {
+		Logger.Warnf("Refused to hand off to %q", string(b))
+		http.Error(w, "Hand off is only done to the upgrade socket",
+			http.StatusForbidden)
+		return
+	}
+	err = handOff(s.server, string(b))
+	if err != nil {
+		Logger.Errorf("Hand off failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Logger.Info("Handed off to the new agent, exiting")
+	w.Write([]byte("OK"))
+	// the agent is already exiting after an earlier hand off
+	select {
+	case handedOff <- true:
+	default:
+	}
+}
+
+// handOff sends the agent's state to a new agent. If the new agent fails to
+// confirm, the panes are resumed.
+func handOff(server *peers.Server, socket string) error {
+	conn, err := net.DialUnix("unix", nil,
+		&net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the new agent: %s", err)
+	}
+	defer conn.Close()
+	h, files, err := server.Detach()
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(handOffTimeout))
+		err = sendHandOff(conn, h, files)
+	}
+	if err == nil {
+		var reply string
+		reply, err = bufio.NewReader(conn).ReadString('\n')
+		reply = strings.TrimSpace(reply)
+		if err == nil && reply != "ok" {
+			err = fmt.Errorf("new agent failed: %s", reply)
+		}
+	}
+	if err != nil {
+		server.Resume()
+		return err
+	}
+	return nil
+}
+
+// sendHandOff sends the files in batches, each with a one byte 'f' message,
+// and then 's' followed by the json encoded state
+func sendHandOff(conn *net.UnixConn, h *peers.Handoff, files []*os.File) error {
+	for i := 0; i < len(files); i += maxFDsPerMessage {
+		end := i + maxFDsPerMessage
+		if end > len(files) {
+			end = len(files)
+		}
+		fds := make([]int, 0, end-i)
+		for _, f := range files[i:end] {
+			rc, err := f.SyscallConn()
+			if err != nil {
+				return err
+			}
+			// using Fd() would make the file blocking
+			rc.Control(func(fd uintptr) {
+				fds = append(fds, int(fd))
+			})
+		}
+		_, _, err := conn.WriteMsgUnix([]byte{'f'}, syscall.UnixRights(fds...), nil)
+		if err != nil {
+			return fmt.Errorf("Failed to send files: %s", err)
+		}
+	}
+	_, err := conn.Write([]byte{'s'})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(conn).Encode(h)
+}
+
+// receiveHandOff receives the files & state sent by sendHandOff
+func receiveHandOff(conn *net.UnixConn) (*peers.Handoff, []*os.File, error) {
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	b := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(maxFDsPerMessage*4))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		if oobn > 0 {
+			msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				closeFiles()
+				return nil, nil, err
+			}
+			for i := range msgs {
+				fds, err := syscall.ParseUnixRights(&msgs[i])
+				if err != nil {
+					closeFiles()
+					return nil, nil, err
+				}
+				for _, fd := range fds {
+					files = append(files, os.NewFile(uintptr(fd), "handoff"))
+				}
+			}
+		}
+		if n == 1 && b[0] == 's' {
+			break
+		}
+		if n != 1 || b[0] != 'f' {
+			closeFiles()
+			return nil, nil, fmt.Errorf("unexpected hand off message")
+		}
+	}
+	var h peers.Handoff
+	err := json.NewDecoder(conn).Decode(&h)
+	if err != nil {
+		closeFiles()
+		return nil, nil, err
+	}
+	return &h, files, nil
+}
@@ -0,0 +1,71 @@
+// This files contains tests for handing off the agent's state
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tuzig/webexec/peers"
+	"go.uber.org/zap/zaptest"
+)
+
+// unixPair returns a pair of connected unix sockets
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		require.NoError(t, err)
+		f.Close()
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestHandOffTransport(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	a, b := unixPair(t)
+	defer a.Close()
+	defer b.Close()
+	h := &peers.Handoff{
+		LastMarker: 7,
+		Payload:    []byte("{}"),
+		Panes:      []peers.HandoffPane{{ID: 3, Files: []int{0}}},
+	}
+	go func() {
+		require.NoError(t, sendHandOff(a, h, []*os.File{w}))
+		w.Close()
+	}()
+	got, files, err := receiveHandOff(b)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, 7, got.LastMarker)
+	require.Equal(t, 3, got.Panes[0].ID)
+	_, err = files[0].Write([]byte("BADWOLF"))
+	require.NoError(t, err)
+	files[0].Close()
+	buf := make([]byte, 10)
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "BADWOLF", string(buf[:n]))
+}
+
+func TestUpgradeSocketOnly(t *testing.T) {
+	Logger = zaptest.NewLogger(t).Sugar()
+	s := &sockServer{}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/upgrade",
+		strings.NewReader("/tmp/somebody.else.sock"))
+	s.handleUpgrade(w, r)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/kardianos/osext"
 	"github.com/pion/webrtc/v3"
 	"github.com/tuzig/webexec/httpserver"
+	"github.com/tuzig/webexec/keeper"
 	"github.com/tuzig/webexec/peers"
 	"github.com/tuzig/webexec/pidfile"
 	"github.com/urfave/cli/v2"
@@ -187,6 +188,18 @@ func forkAgent(address httpserver.AddressType) (int, error) {
 	return cmd.Process.Pid, nil
 }
 
+// restoreKeptPanes restores the panes kept while the agent was down
+func restoreKeptPanes(server *peers.Server, logger *zap.SugaredLogger) error {
+	server.Conf.Logger = logger
+	return server.RestoreKeptPanes()
+}
+
+// keeperCMD is the main function of a keeper process, holding a pane's pty
+// across agent restarts
+func keeperCMD(c *cli.Context) error {
+	return keeper.Run(os.Stdin, os.Stdout)
+}
+
 // start - start the user's agent
 func start(c *cli.Context) error {
 	// test if the config directory exists
@@ -202,15 +215,13 @@ func start(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("Failed to get the certificates: %s", err)
 	}
-	_, address, err := LoadConf(certs)
+	conf, address, err := LoadConf(certs)
 	if err != nil {
 		return err
 	}
 	if c.IsSet("address") {
 		address = httpserver.AddressType(c.String("address"))
 	}
-	// TODO: do we need this?
-	peers.PtyMux = peers.PtyMuxType{}
 	debug := c.Bool("debug")
 	var loggerOption fx.Option
 	if debug {
@@ -229,12 +240,24 @@ func start(c *cli.Context) error {
 			return nil
 		} else {
 			loggerOption = fx.Provide(InitAgentLogger)
-			err := createPIDFile()
-			if err != nil {
-				return err
+			// when taking over, the pid file is created once the running
+			// agent exits
+			if !c.Bool("takeover") {
+				err := createPIDFile()
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
+	invokes := []interface{}{restoreKeptPanes, httpserver.StartHTTPServer,
+		StartSocketServer, StartPeerbookClient}
+	if c.Bool("takeover") {
+		invokes = append([]interface{}{takeOver}, invokes...)
+	} else if conf.SpillDir != "" {
+		// history spilled by a previous agent is of no use
+		peers.RemoveSpillFiles(conf.SpillDir)
+	}
 	// the code below runs for both --debug and --agent
 	sigChan := make(chan os.Signal, 1)
 	app := fx.New(
@@ -242,6 +265,7 @@ func start(c *cli.Context) error {
 		fx.Supply(""),
 		fx.Provide(
 			LoadConf,
+			peers.NewServer,
 			httpserver.NewConnectHandler,
 			// TODO: find a way to pass the filepath
 			fx.Annotate(NewFileAuth, fx.As(new(httpserver.AuthBackend))),
@@ -249,7 +273,7 @@ func start(c *cli.Context) error {
 			NewPeerbookClient,
 			GetCerts,
 		),
-		fx.Invoke(httpserver.StartHTTPServer, StartSocketServer, StartPeerbookClient),
+		fx.Invoke(invokes...),
 	)
 	if debug {
 		app.Run()
@@ -258,9 +282,14 @@ func start(c *cli.Context) error {
 		err = app.Start(context.Background())
 	}
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	Logger.Infof("Shutting down")
-	os.Remove(PIDFilePath())
+	select {
+	case <-sigChan:
+		Logger.Infof("Shutting down")
+		os.Remove(PIDFilePath())
+	case <-handedOff:
+		// the new agent creates the pid file once we're gone
+		os.Remove(PIDFilePath())
+	}
 	return nil
 }
 
@@ -412,7 +441,6 @@ func TrickleCandidates(ctx context.Context, httpc http.Client) {
 			}
 		}
 	}
-	can = []byte{}
 }
 func getAgentCandidates(ctx context.Context, httpc http.Client, id string) {
 	for {
@@ -599,8 +627,17 @@ func main() {
 						Name:  "agent",
 						Usage: "Run as agent, in the background",
 					},
+					&cli.BoolFlag{
+						Name:   "takeover",
+						Usage:  "Take over the running agent's panes",
+						Hidden: true,
+					},
 				},
 				Action: start,
+			}, {
+				Name:   "upgrade",
+				Usage:  "replaces the running agent without killing the panes",
+				Action: upgradeCMD,
 			}, {
 				Name:   "status",
 				Usage:  "webexec agent's status",
@@ -617,6 +654,11 @@ func main() {
 				Name:   "accept",
 				Usage:  "accepts an offer to connect",
 				Action: accept,
+			}, {
+				Name:   "keeper",
+				Usage:  "keeps a pane running, used by the agent",
+				Hidden: true,
+				Action: keeperCMD,
 			},
 		},
 	}